@@ -4,11 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-)
 
-// Google Cloud Storage Buckets (uncomment below to enable)
-// StorageBucketName = "<your-storage-bucket>"
-// StorageBucket, err = configureStorage(StorageBucketName)
+	"muto/email"
+	"muto/storage"
+)
 
 type PostgresConfig struct {
 	Host     string `json:"host"`
@@ -44,12 +43,104 @@ func DefaultPostgresConfig() PostgresConfig {
 	}
 }
 
+// MailerConfig chooses how outgoing email is delivered.
+// Mode "smtp" sends mail through the configured server, while
+// "log" (the default) writes messages to LogFile, or stdout
+// when no file is given.
+type MailerConfig struct {
+	Mode     string `json:"mode"`
+	From     string `json:"from"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	LogFile  string `json:"log_file"`
+}
+
+func (c MailerConfig) Mailer() (email.Mailer, error) {
+	switch c.Mode {
+	case "smtp":
+		return email.NewSMTPMailer(c.Host, c.Port, c.Username, c.Password), nil
+	default:
+		if c.LogFile == "" {
+			return email.NewLogMailer(os.Stdout), nil
+		}
+		f, err := os.OpenFile(c.LogFile,
+			os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return email.NewLogMailer(f), nil
+	}
+}
+
+func DefaultMailerConfig() MailerConfig {
+	return MailerConfig{
+		Mode: "log",
+		From: "MUTO Support <support@muto.world>",
+	}
+}
+
+// StorageConfig chooses where uploaded images are kept. Backend
+// "s3" keeps them in an S3 compatible bucket, while "local" (the
+// default) keeps them on disk under Dir.
+type StorageConfig struct {
+	Backend string `json:"backend"`
+	Dir     string `json:"dir"`
+	// Endpoint is the S3 service's base URL, eg
+	// "https://s3.eu-west-1.amazonaws.com".
+	Endpoint        string `json:"endpoint"`
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	// PathStyle puts the bucket in the path of URLs rather than
+	// the host name, as MinIO and other stand-ins expect.
+	PathStyle bool `json:"path_style"`
+}
+
+func (c StorageConfig) BlobStore() (storage.BlobStore, error) {
+	switch c.Backend {
+	case "s3":
+		return storage.NewS3(storage.S3Config{
+			Endpoint:        c.Endpoint,
+			Region:          c.Region,
+			Bucket:          c.Bucket,
+			AccessKeyID:     c.AccessKeyID,
+			SecretAccessKey: c.SecretAccessKey,
+			PathStyle:       c.PathStyle,
+		})
+	default:
+		if c.Dir == "" {
+			c.Dir = "images"
+		}
+		return storage.NewLocal(c.Dir), nil
+	}
+}
+
+func DefaultStorageConfig() StorageConfig {
+	return StorageConfig{
+		Backend: "local",
+		Dir:     "images",
+	}
+}
+
 type Config struct {
 	Port     int            `json:"port"`
 	Env      string         `json:"env"`
+	BaseURL  string         `json:"base_url"`
 	Pepper   string         `json:"pepper"`
 	HMACKey  string         `json:"hmac_key"`
+	TOTPKey  string         `json:"totp_key"`
 	Database PostgresConfig `json:"database"`
+	Mailer   MailerConfig   `json:"mailer"`
+	Storage  StorageConfig  `json:"storage"`
+	// LoginThrottle is where failed sign in attempts are
+	// counted, either "memory" or "postgres".
+	LoginThrottle string `json:"login_throttle"`
+	// Search is where the search index is kept, either "memory"
+	// or "postgres".
+	Search string `json:"search"`
 }
 
 func (c Config) IsProd() bool {
@@ -60,9 +151,16 @@ func DefaultConfig() Config {
 	return Config{
 		Port:     8080,
 		Env:      "dev",
+		BaseURL:  "http://localhost:8080",
 		Pepper:   "secret-random-string",
 		HMACKey:  "secret-hmac-key",
+		TOTPKey:  "secret-totp-key",
 		Database: DefaultPostgresConfig(),
+		Mailer:   DefaultMailerConfig(),
+		Storage:  DefaultStorageConfig(),
+
+		LoginThrottle: "memory",
+		Search:        "postgres",
 	}
 }
 
@@ -95,6 +193,11 @@ func LoadConfig(configReq bool) Config {
 	if err != nil {
 		panic(err)
 	}
+	// Two-factor secrets are encrypted with TOTPKey, so refuse to
+	// run in production with the key everyone can read above.
+	if c.IsProd() && (c.TOTPKey == "" || c.TOTPKey == DefaultConfig().TOTPKey) {
+		panic("totp_key must be set to a secret value in production")
+	}
 	// If all goes well, return the loaded config.
 	fmt.Println("Successfully loaded .config")
 	return c
@@ -10,6 +10,9 @@ type privateKey string
 
 const (
 	accountKey privateKey = "account"
+	sessionKey privateKey = "session"
+	galleryKey privateKey = "gallery"
+	tokenKey   privateKey = "api_token"
 )
 
 func WithAccount(ctx context.Context, account *models.Account) context.Context {
@@ -24,3 +27,44 @@ func Account(ctx context.Context) *models.Account {
 	}
 	return nil
 }
+
+func WithSession(ctx context.Context, session *models.Session) context.Context {
+	return context.WithValue(ctx, sessionKey, session)
+}
+
+func Session(ctx context.Context) *models.Session {
+	if temp := ctx.Value(sessionKey); temp != nil {
+		if session, ok := temp.(*models.Session); ok {
+			return session
+		}
+	}
+	return nil
+}
+
+func WithGallery(ctx context.Context, gallery *models.Gallery) context.Context {
+	return context.WithValue(ctx, galleryKey, gallery)
+}
+
+func Gallery(ctx context.Context) *models.Gallery {
+	if temp := ctx.Value(galleryKey); temp != nil {
+		if gallery, ok := temp.(*models.Gallery); ok {
+			return gallery
+		}
+	}
+	return nil
+}
+
+// WithAPIToken stores the token an API request was authenticated
+// with, so handlers can check its scopes.
+func WithAPIToken(ctx context.Context, token *models.APIToken) context.Context {
+	return context.WithValue(ctx, tokenKey, token)
+}
+
+func APIToken(ctx context.Context) *models.APIToken {
+	if temp := ctx.Value(tokenKey); temp != nil {
+		if token, ok := temp.(*models.APIToken); ok {
+			return token
+		}
+	}
+	return nil
+}
@@ -1,26 +1,73 @@
 package controllers
 
 import (
+	"encoding/base64"
 	"fmt"
+	"html/template"
+	"io"
+	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 
+	"muto/context"
+	"muto/email"
 	"muto/models"
-	"muto/rand"
 	"muto/views"
+
+	"github.com/gorilla/mux"
+	"rsc.io/qr"
 )
 
-func NewAccounts(as models.AccountService) *Accounts {
+func NewAccounts(as models.AccountService, ss models.SessionService,
+	tfs models.TwoFactorService, lt models.LoginThrottle,
+	ps models.ProfileService, gs models.GalleryService,
+	is models.ImageService, es models.ExportService,
+	ts models.APITokenService, emailer *email.Client) *Accounts {
 	return &Accounts{
-		NewView:   views.NewView("materialize", "accounts/new"),
-		LoginView: views.NewView("materialize", "accounts/enter"),
-		as:        as,
+		NewView:            views.NewView("materialize", "accounts/new"),
+		LoginView:          views.NewView("materialize", "accounts/enter"),
+		TwoFactorLoginView: views.NewView("materialize", "accounts/enter_two_factor"),
+		SessionsView:       views.NewView("materialize", "accounts/sessions"),
+		ForgotPwView:       views.NewView("materialize", "accounts/forgot_pw"),
+		ResetPwView:        views.NewView("materialize", "accounts/reset_pw"),
+		VerifyView:         views.NewView("materialize", "accounts/verify"),
+		TwoFactorView:      views.NewView("materialize", "accounts/two_factor"),
+		SettingsView:       views.NewView("materialize", "accounts/settings"),
+		as:                 as,
+		ss:                 ss,
+		tfs:                tfs,
+		lt:                 lt,
+		ps:                 ps,
+		gs:                 gs,
+		is:                 is,
+		es:                 es,
+		ts:                 ts,
+		emailer:            emailer,
 	}
 }
 
 type Accounts struct {
-	NewView   *views.View
-	LoginView *views.View
-	as        models.AccountService
+	NewView            *views.View
+	LoginView          *views.View
+	TwoFactorLoginView *views.View
+	SessionsView       *views.View
+	ForgotPwView       *views.View
+	ResetPwView        *views.View
+	VerifyView         *views.View
+	TwoFactorView      *views.View
+	SettingsView       *views.View
+	as                 models.AccountService
+	ss                 models.SessionService
+	tfs                models.TwoFactorService
+	lt                 models.LoginThrottle
+	ps                 models.ProfileService
+	gs                 models.GalleryService
+	is                 models.ImageService
+	es                 models.ExportService
+	ts                 models.APITokenService
+	emailer            *email.Client
 }
 
 type LoginForm struct {
@@ -33,6 +80,59 @@ type RegisterForm struct {
 	Password string `schema:"password"`
 }
 
+// ChangeEmailForm is used to move an account to a new email
+// address. The current password is required to make the change.
+type ChangeEmailForm struct {
+	Email    string `schema:"email"`
+	Password string `schema:"password"`
+}
+
+// ChangePasswordForm is used to set a new password.
+// ChangePasswordForm can also revoke the account's API tokens,
+// which are otherwise left working, as scripts using them don't
+// know the password.
+type ChangePasswordForm struct {
+	CurrentPassword string `schema:"current_password"`
+	NewPassword     string `schema:"new_password"`
+	RevokeAPITokens bool   `schema:"revoke_api_tokens"`
+}
+
+// DeleteAccountForm asks for the password one last time before
+// an account and everything it owns is deleted.
+type DeleteAccountForm struct {
+	Password string `schema:"password"`
+}
+
+// TwoFactorForm is used whenever a TOTP or recovery code is
+// submitted.
+type TwoFactorForm struct {
+	Code string `schema:"code"`
+}
+
+// DisableTwoFactorForm asks for the password as well as a code,
+// so a stolen session alone can't turn two-factor off.
+type DisableTwoFactorForm struct {
+	Password string `schema:"password"`
+	Code     string `schema:"code"`
+}
+
+// TwoFactorData is used to render the two-factor settings page.
+type TwoFactorData struct {
+	Enabled       bool
+	Secret        string
+	URI           string
+	QRCode        template.URL
+	RecoveryCodes []string
+}
+
+// ResetPwForm is used both for the forgot password form,
+// where only the email is filled in, and the reset form.
+type ResetPwForm struct {
+	Email    string `schema:"email"`
+	Token    string `schema:"token"`
+	Password string `schema:"password"`
+}
+
 // login is used to process form when accessing an existing account.
 // POST/enter
 func (a *Accounts) Login(w http.ResponseWriter, r *http.Request) {
@@ -44,19 +144,115 @@ func (a *Accounts) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := clientIP(r)
+	if err := a.lt.Allow(form.Email, ip); err != nil {
+		vd.SetAlert(err)
+		a.LoginView.Render(w, r, vd)
+		return
+	}
+
 	account, err := a.as.Authenticate(form.Email, form.Password)
 	if err != nil {
 		switch err {
-		case models.ErrNotFound:
-			vd.AlertError("No account exists with that email address")
+		case models.ErrNotFound, models.ErrPasswordIncorrect:
+			// Never tell the visitor which of the two was wrong,
+			// that would reveal whether an account exists.
+			if err := a.lt.Failed(form.Email, ip); err != nil {
+				log.Println(err)
+			}
+			vd.AlertError("Invalid email or password")
 		default:
 			vd.SetAlert(err)
 		}
 		a.LoginView.Render(w, r, vd)
 		return
 	}
-	err = a.signIn(w, account)
+	// The failures are only forgiven once signing in is complete,
+	// so the password can't be used to reset the count while
+	// guessing two-factor codes. Until then this attempt counts
+	// as a failed one.
+	if account.TwoFactorEnabled() {
+		a.pendTwoFactor(w, r, account)
+		return
+	}
+	err = a.signIn(w, r, account)
+	if err != nil {
+		vd.SetAlert(err)
+		a.LoginView.Render(w, r, vd)
+		return
+	}
+	if err := a.lt.Succeeded(form.Email, ip); err != nil {
+		log.Println(err)
+	}
+	http.Redirect(w, r, "/dashboard", http.StatusFound)
+}
+
+// pendTwoFactor holds off on signing in until we have a valid
+// code, sending the visitor on to enter one.
+func (a *Accounts) pendTwoFactor(w http.ResponseWriter, r *http.Request,
+	account *models.Account) {
+	cookie := http.Cookie{
+		Name:     "pending_login",
+		Value:    a.tfs.PendingToken(account),
+		Path:     "/enter",
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+	http.Redirect(w, r, "/enter/2fa", http.StatusFound)
+}
+
+// LoginTwoFactor is the second step of signing in for accounts
+// with two-factor authentication enabled.
+// POST /enter/2fa
+func (a *Accounts) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.TwoFactorLoginView.Render(w, r, vd)
+		return
+	}
+
+	cookie, err := r.Cookie("pending_login")
+	if err != nil {
+		vd.AlertError("Your sign in attempt expired. Please try again.")
+		a.LoginView.Render(w, r, vd)
+		return
+	}
+	account, err := a.tfs.ByPendingToken(cookie.Value)
 	if err != nil {
+		vd.AlertError("Your sign in attempt expired. Please try again.")
+		a.LoginView.Render(w, r, vd)
+		return
+	}
+	ip := clientIP(r)
+	if err := a.lt.Allow(account.Email, ip); err != nil {
+		vd.SetAlert(err)
+		a.TwoFactorLoginView.Render(w, r, vd)
+		return
+	}
+	if err := a.tfs.Verify(account, form.Code); err != nil {
+		if err == models.ErrCodeInvalid {
+			if err := a.lt.Failed(account.Email, ip); err != nil {
+				log.Println(err)
+			}
+		}
+		vd.SetAlert(err)
+		a.TwoFactorLoginView.Render(w, r, vd)
+		return
+	}
+	if err := a.lt.Succeeded(account.Email, ip); err != nil {
+		log.Println(err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "pending_login",
+		Path:     "/enter",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	if err := a.signIn(w, r, account); err != nil {
 		vd.SetAlert(err)
 		a.LoginView.Render(w, r, vd)
 		return
@@ -92,15 +288,573 @@ func (a *Accounts) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := a.signIn(w, &account)
+	if err := a.sendVerification(&account); err != nil {
+		log.Println(err)
+	}
+
+	err := a.signIn(w, r, &account)
 	if err != nil {
 		http.Redirect(w, r, "/enter", http.StatusFound)
 		return
 	}
 
+	http.Redirect(w, r, "/verify", http.StatusFound)
+}
+
+// Verify confirms an email address when given a token, otherwise
+// it lets the signed in account know a link is waiting in their
+// inbox.
+// GET /verify
+func (a *Accounts) Verify(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	vd.Yield = context.Account(r.Context())
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		a.VerifyView.Render(w, r, vd)
+		return
+	}
+	account, err := a.as.VerifyEmail(token)
+	if err != nil {
+		vd.SetAlert(err)
+		a.VerifyView.Render(w, r, vd)
+		return
+	}
+	vd.Yield = account
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Thanks! Your email address has been verified.",
+	}
+	a.VerifyView.Render(w, r, vd)
+}
+
+// ResendVerification sends a fresh verification link to the
+// current account's email address.
+// POST /verify/resend
+func (a *Accounts) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	account := context.Account(r.Context())
+	vd.Yield = account
+	if account.Verified() {
+		http.Redirect(w, r, "/dashboard", http.StatusFound)
+		return
+	}
+	if err := a.sendVerification(account); err != nil {
+		vd.SetAlert(err)
+		a.VerifyView.Render(w, r, vd)
+		return
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "A new verification link has been sent to " + account.Email,
+	}
+	a.VerifyView.Render(w, r, vd)
+}
+
+// sendVerification emails a verification link for the
+// account's current email address.
+func (a *Accounts) sendVerification(account *models.Account) error {
+	return a.emailer.VerifyEmail(account.Email, a.as.VerifyEmailToken(account))
+}
+
+// InitiateReset emails a password reset link to the account with
+// the provided email address. The same message is shown whether or
+// not an account exists, so this form can't be used to discover
+// which email addresses are registered.
+// POST /forgot
+func (a *Accounts) InitiateReset(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ResetPwForm
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.ForgotPwView.Render(w, r, vd)
+		return
+	}
+
+	account, token, err := a.as.InitiateReset(form.Email)
+	switch err {
+	case nil:
+		// Send the link to the address on file rather than the one
+		// typed in, which only has to match it after normalizing.
+		if err := a.emailer.ResetPw(account.Email, token); err != nil {
+			vd.SetAlert(err)
+			a.ForgotPwView.Render(w, r, vd)
+			return
+		}
+	case models.ErrNotFound:
+		// Fall through to the success message below.
+	default:
+		vd.SetAlert(err)
+		a.ForgotPwView.Render(w, r, vd)
+		return
+	}
+
+	vd.Alert = &views.Alert{
+		Level: views.AlertLvlSuccess,
+		Message: "If an account exists for that email address, " +
+			"instructions for resetting your password are on their way.",
+	}
+	a.ForgotPwView.Render(w, r, vd)
+}
+
+// ResetPw renders the reset password form, prefilling the token
+// from the link we emailed.
+// GET /reset
+func (a *Accounts) ResetPw(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ResetPwForm
+	vd.Yield = &form
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+	}
+	a.ResetPwView.Render(w, r, vd)
+}
+
+// CompleteReset sets the new password, signs the account out of
+// every other device, revokes its API tokens and then signs it in
+// here. Accounts with two-factor authentication still have to
+// enter a code, as the reset link only proves access to the email
+// address.
+// POST /reset
+func (a *Accounts) CompleteReset(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ResetPwForm
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.ResetPwView.Render(w, r, vd)
+		return
+	}
+
+	account, err := a.as.CompleteReset(form.Token, form.Password)
+	if err != nil {
+		vd.SetAlert(err)
+		a.ResetPwView.Render(w, r, vd)
+		return
+	}
+
+	// Whoever had the old password may have made API tokens
+	// with it, so they go along with every session.
+	if err := a.ss.DeleteByAccountID(account.ID); err != nil {
+		log.Println(err)
+	}
+	if err := a.ts.DeleteByAccountID(account.ID); err != nil {
+		log.Println(err)
+	}
+	if account.TwoFactorEnabled() {
+		a.pendTwoFactor(w, r, account)
+		return
+	}
+	if err := a.signIn(w, r, account); err != nil {
+		http.Redirect(w, r, "/enter", http.StatusFound)
+		return
+	}
 	http.Redirect(w, r, "/dashboard", http.StatusFound)
 }
 
+// Settings renders the account settings page.
+// GET /account
+func (a *Accounts) Settings(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	vd.Yield = context.Account(r.Context())
+	a.SettingsView.Render(w, r, vd)
+}
+
+// ChangeEmail moves the account to a new email address, which
+// has to be verified again before galleries can be created.
+// POST /account/email
+func (a *Accounts) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ChangeEmailForm
+	account := context.Account(r.Context())
+	vd.Yield = account
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.SettingsView.Render(w, r, vd)
+		return
+	}
+	if err := a.confirmPassword(r, account, form.Password); err != nil {
+		vd.SetAlert(err)
+		a.SettingsView.Render(w, r, vd)
+		return
+	}
+	oldEmail, oldVerifiedAt := account.Email, account.EmailVerifiedAt
+	account.Email = form.Email
+	account.EmailVerifiedAt = nil
+	if err := a.as.Update(account); err != nil {
+		account.Email, account.EmailVerifiedAt = oldEmail, oldVerifiedAt
+		vd.SetAlert(err)
+		a.SettingsView.Render(w, r, vd)
+		return
+	}
+	if err := a.sendVerification(account); err != nil {
+		log.Println(err)
+	}
+	http.Redirect(w, r, "/verify", http.StatusFound)
+}
+
+// ChangePassword sets a new password after checking the current
+// one, then signs every other device out.
+// POST /account/password
+func (a *Accounts) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ChangePasswordForm
+	account := context.Account(r.Context())
+	vd.Yield = account
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.SettingsView.Render(w, r, vd)
+		return
+	}
+	if err := a.confirmPassword(r, account, form.CurrentPassword); err != nil {
+		vd.SetAlert(err)
+		a.SettingsView.Render(w, r, vd)
+		return
+	}
+	if form.NewPassword == "" {
+		vd.SetAlert(models.ErrPasswordRequired)
+		a.SettingsView.Render(w, r, vd)
+		return
+	}
+	account.Password = form.NewPassword
+	if err := a.as.Update(account); err != nil {
+		vd.SetAlert(err)
+		a.SettingsView.Render(w, r, vd)
+		return
+	}
+	a.revokeOtherSessions(r, account)
+	message := "Password updated. Your other devices have been signed out."
+	if form.RevokeAPITokens {
+		if err := a.ts.DeleteByAccountID(account.ID); err != nil {
+			log.Println(err)
+			vd.SetAlert(err)
+			a.SettingsView.Render(w, r, vd)
+			return
+		}
+		message = "Password updated. Your other devices have been " +
+			"signed out and your API tokens revoked."
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: message,
+	}
+	a.SettingsView.Render(w, r, vd)
+}
+
+// DeleteAccount permanently deletes the account along with its
+// galleries, profile, the image files on disk and every session.
+// The database rows go in a single transaction first, so a failure
+// leaves the account as it was. Files left behind by a failure
+// after that are only logged, as nothing points at them anymore.
+// POST /account/delete
+func (a *Accounts) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form DeleteAccountForm
+	account := context.Account(r.Context())
+	vd.Yield = account
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.SettingsView.Render(w, r, vd)
+		return
+	}
+	if err := a.confirmPassword(r, account, form.Password); err != nil {
+		vd.SetAlert(err)
+		a.SettingsView.Render(w, r, vd)
+		return
+	}
+	galleries, err := a.gs.ByAccountID(account.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		a.SettingsView.Render(w, r, vd)
+		return
+	}
+	if err := a.as.Delete(account.ID); err != nil {
+		vd.SetAlert(err)
+		a.SettingsView.Render(w, r, vd)
+		return
+	}
+	for _, gallery := range galleries {
+		if err := a.is.DeleteAll(gallery.ID); err != nil {
+			log.Println(err)
+		}
+	}
+	if err := a.is.DeleteAvatar(account.ID); err != nil {
+		log.Println(err)
+	}
+	a.clearCookie(w)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// Export downloads a ZIP archive with all of the data we have
+// for the current account.
+// GET /account/export
+func (a *Accounts) Export(w http.ResponseWriter, r *http.Request) {
+	account := context.Account(r.Context())
+	// The archive is built in a temporary file first, so a failure
+	// halfway gets an error page instead of a truncated download.
+	f, err := os.CreateTemp("", "muto-export-*.zip")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := a.es.Export(f, account); err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	filename := fmt.Sprintf("muto-export-%d-%s.zip",
+		account.ID, now.Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		"attachment; filename=\""+filename+"\"")
+	http.ServeContent(w, r, filename, now, f)
+}
+
+// confirmPassword checks the password of an account that is
+// already signed in. Failures count towards the same lockout as
+// the sign in form, so this can't be used to guess passwords.
+func (a *Accounts) confirmPassword(r *http.Request, account *models.Account, password string) error {
+	ip := clientIP(r)
+	if err := a.lt.Allow(account.Email, ip); err != nil {
+		return err
+	}
+	_, err := a.as.Authenticate(account.Email, password)
+	switch err {
+	case nil:
+		if err := a.lt.Succeeded(account.Email, ip); err != nil {
+			log.Println(err)
+		}
+	case models.ErrPasswordIncorrect:
+		if err := a.lt.Failed(account.Email, ip); err != nil {
+			log.Println(err)
+		}
+	}
+	return err
+}
+
+// revokeOtherSessions signs the account out of every device
+// except the one making this request.
+func (a *Accounts) revokeOtherSessions(r *http.Request, account *models.Account) {
+	current := context.Session(r.Context())
+	sessions, err := a.ss.ByAccountID(account.ID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, session := range sessions {
+		if current != nil && session.ID == current.ID {
+			continue
+		}
+		if err := a.ss.Delete(session.ID); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// TwoFactor shows the two-factor settings for the current account.
+// When two-factor authentication is off a secret is enrolled and
+// rendered as a QR code ready to be scanned.
+// GET /account/2fa
+func (a *Accounts) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	a.renderTwoFactor(w, r, vd)
+}
+
+// EnableTwoFactor confirms the enrolled secret with a code from
+// the authenticator app and shows the recovery codes once.
+// POST /account/2fa/enable
+func (a *Accounts) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.renderTwoFactor(w, r, vd)
+		return
+	}
+	account := context.Account(r.Context())
+	codes, err := a.tfs.Confirm(account, form.Code)
+	if err != nil {
+		vd.SetAlert(err)
+		a.renderTwoFactor(w, r, vd)
+		return
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Two-factor authentication is now enabled",
+	}
+	vd.Yield = TwoFactorData{
+		Enabled:       true,
+		RecoveryCodes: codes,
+	}
+	a.TwoFactorView.Render(w, r, vd)
+}
+
+// DisableTwoFactor turns two-factor authentication off after
+// checking the password and a current code.
+// POST /account/2fa/disable
+func (a *Accounts) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form DisableTwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.renderTwoFactor(w, r, vd)
+		return
+	}
+	account := context.Account(r.Context())
+	// The password and the code are checked as a single attempt,
+	// like confirmPassword does for the password alone. Succeeding
+	// with the password mustn't forgive failures while the code is
+	// still being guessed.
+	ip := clientIP(r)
+	if err := a.lt.Allow(account.Email, ip); err != nil {
+		vd.SetAlert(err)
+		a.renderTwoFactor(w, r, vd)
+		return
+	}
+	_, err := a.as.Authenticate(account.Email, form.Password)
+	if err == nil {
+		err = a.tfs.Verify(account, form.Code)
+	}
+	if err != nil {
+		if err == models.ErrPasswordIncorrect || err == models.ErrCodeInvalid {
+			if err := a.lt.Failed(account.Email, ip); err != nil {
+				log.Println(err)
+			}
+		}
+		vd.SetAlert(err)
+		a.renderTwoFactor(w, r, vd)
+		return
+	}
+	if err := a.lt.Succeeded(account.Email, ip); err != nil {
+		log.Println(err)
+	}
+	if err := a.tfs.Disable(account); err != nil {
+		vd.SetAlert(err)
+		a.renderTwoFactor(w, r, vd)
+		return
+	}
+	http.Redirect(w, r, "/account/2fa", http.StatusFound)
+}
+
+func (a *Accounts) renderTwoFactor(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	account := context.Account(r.Context())
+	if account.TwoFactorEnabled() {
+		vd.Yield = TwoFactorData{Enabled: true}
+		a.TwoFactorView.Render(w, r, vd)
+		return
+	}
+	secret, uri, err := a.tfs.Enroll(account)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	data := TwoFactorData{
+		Secret: secret,
+		URI:    uri,
+	}
+	if code, err := qr.Encode(uri, qr.M); err == nil {
+		data.QRCode = template.URL("data:image/png;base64," +
+			base64.StdEncoding.EncodeToString(code.PNG()))
+	}
+	vd.Yield = data
+	a.TwoFactorView.Render(w, r, vd)
+}
+
+// Logout revokes the current session and clears the cookie.
+// POST /logout
+func (a *Accounts) Logout(w http.ResponseWriter, r *http.Request) {
+	if session := context.Session(r.Context()); session != nil {
+		if err := a.ss.Delete(session.ID); err != nil {
+			log.Println(err)
+		}
+	}
+	a.clearCookie(w)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// SessionsData is used to render the list of active sessions.
+type SessionsData struct {
+	CurrentID uint
+	Sessions  []models.Session
+}
+
+// Sessions lists every device the current account is signed in on.
+// GET /account/sessions
+func (a *Accounts) Sessions(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	a.renderSessions(w, r, vd)
+}
+
+// RevokeSession signs a single device out.
+// POST /account/sessions/:id/revoke
+func (a *Accounts) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	account := context.Account(r.Context())
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusNotFound)
+		return
+	}
+	session, err := a.ss.ByID(uint(id))
+	if err != nil || session.AccountID != account.ID {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err := a.ss.Delete(session.ID); err != nil {
+		vd.SetAlert(err)
+		a.renderSessions(w, r, vd)
+		return
+	}
+	if current := context.Session(r.Context()); current != nil &&
+		current.ID == session.ID {
+		a.clearCookie(w)
+		http.Redirect(w, r, "/enter", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/account/sessions", http.StatusFound)
+}
+
+// RevokeAllSessions signs the account out everywhere,
+// including the current device.
+// POST /account/sessions/revoke
+func (a *Accounts) RevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	account := context.Account(r.Context())
+	if err := a.ss.DeleteByAccountID(account.ID); err != nil {
+		vd.SetAlert(err)
+		a.renderSessions(w, r, vd)
+		return
+	}
+	a.clearCookie(w)
+	http.Redirect(w, r, "/enter", http.StatusFound)
+}
+
+func (a *Accounts) renderSessions(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	account := context.Account(r.Context())
+	sessions, err := a.ss.ByAccountID(account.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	data := SessionsData{Sessions: sessions}
+	if current := context.Session(r.Context()); current != nil {
+		data.CurrentID = current.ID
+	}
+	vd.Yield = data
+	a.SessionsView.Render(w, r, vd)
+}
+
 // CookieTest displays cookie info on the screen to the current account.
 func (a *Accounts) CookieTest(w http.ResponseWriter, r *http.Request) {
 	cookie, err := r.Cookie("remember_token")
@@ -108,33 +862,55 @@ func (a *Accounts) CookieTest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	account, err := a.as.ByRemember(cookie.Value)
+	session, err := a.ss.ByRemember(cookie.Value)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprintln(w, account)
+	account, err := a.as.ByID(session.AccountID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, account, session.Device)
 }
 
-// signIn is ised to sign the given account in via cookie.
-func (a *Accounts) signIn(w http.ResponseWriter, account *models.Account) error {
-	if account.Remember == "" {
-		token, err := rand.RememberToken()
-		if err != nil {
-			return err
-		}
-		account.Remember = token
-		err = a.as.Update(account)
-		if err != nil {
-			return err
-		}
+// signIn is used to sign the given account in via cookie. A new
+// session is created for every sign in, so each device gets its
+// own remember token.
+func (a *Accounts) signIn(w http.ResponseWriter, r *http.Request, account *models.Account) error {
+	if account.Disabled() {
+		return models.ErrAccountDisabled
+	}
+	session := models.Session{
+		AccountID: account.ID,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+	}
+	if err := a.ss.Create(&session); err != nil {
+		return err
 	}
 
 	cookie := http.Cookie{
 		Name:     "remember_token",
-		Value:    account.Remember,
+		Value:    session.Remember,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
 		HttpOnly: true,
 	}
 	http.SetCookie(w, &cookie)
 	return nil
 }
+
+// clearCookie removes the remember token cookie from the browser.
+func (a *Accounts) clearCookie(w http.ResponseWriter) {
+	cookie := http.Cookie{
+		Name:     "remember_token",
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+}
@@ -0,0 +1,327 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"muto/context"
+	"muto/models"
+	"muto/views"
+
+	"github.com/gorilla/mux"
+)
+
+// ADMIN - ERRORS
+const (
+	errAdminSelf = "You can't do that to your own account"
+)
+
+func NewAdmin(as models.AccountService, ss models.SessionService,
+	gs models.GalleryService, is models.ImageService) *Admin {
+	return &Admin{
+		AccountsView:  views.NewView("materialize", "admin/accounts", "admin/partials"),
+		AccountView:   views.NewView("materialize", "admin/account", "admin/partials"),
+		GalleriesView: views.NewView("materialize", "admin/galleries", "admin/partials"),
+		as:            as,
+		ss:            ss,
+		gs:            gs,
+		is:            is,
+	}
+}
+
+// Admin is the operator console. Every route is expected to be
+// wrapped in the RequireAdmin middleware.
+type Admin struct {
+	AccountsView  *views.View
+	AccountView   *views.View
+	GalleriesView *views.View
+	as            models.AccountService
+	ss            models.SessionService
+	gs            models.GalleryService
+	is            models.ImageService
+}
+
+// AdminSearchForm is the query string of the listing pages.
+type AdminSearchForm struct {
+	Query string `schema:"q"`
+	Page  int    `schema:"page"`
+}
+
+type AdminRoleForm struct {
+	Role string `schema:"role"`
+}
+
+// AdminGalleryDeleteForm carries the page to return to once the
+// gallery is gone.
+type AdminGalleryDeleteForm struct {
+	Next string `schema:"next"`
+}
+
+// AdminAccountsData is used to render the account listing.
+type AdminAccountsData struct {
+	Query    string
+	Accounts []models.Account
+	Page     models.PageInfo
+}
+
+// AdminGalleriesData is used to render the gallery listing.
+type AdminGalleriesData struct {
+	Query     string
+	Galleries []models.Gallery
+	Page      models.PageInfo
+}
+
+// AdminGallery is a gallery with the number of images in it.
+type AdminGallery struct {
+	models.Gallery
+	ImageCount int
+}
+
+// AdminAccountData is used to render a single account.
+type AdminAccountData struct {
+	Account   *models.Account
+	Galleries []AdminGallery
+	Sessions  int
+	Roles     []models.Role
+}
+
+// GET /admin/accounts
+func (a *Admin) Accounts(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form AdminSearchForm
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.AccountsView.Render(w, r, vd)
+		return
+	}
+	accounts, info, err := a.as.List(form.Query,
+		models.Page{Number: form.Page})
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = AdminAccountsData{
+		Query:    form.Query,
+		Accounts: accounts,
+		Page:     info,
+	}
+	a.AccountsView.Render(w, r, vd)
+}
+
+// GET /admin/accounts/:id
+func (a *Admin) Account(w http.ResponseWriter, r *http.Request) {
+	account, err := a.accountByID(w, r)
+	if err != nil {
+		return
+	}
+	a.renderAccount(w, r, views.Data{}, account)
+}
+
+// POST /admin/accounts/:id/disable
+func (a *Admin) Disable(w http.ResponseWriter, r *http.Request) {
+	account, err := a.accountByID(w, r)
+	if err != nil {
+		return
+	}
+	if a.isSelf(r, account) {
+		var vd views.Data
+		vd.AlertError(errAdminSelf)
+		a.renderAccount(w, r, vd, account)
+		return
+	}
+	if !account.Disabled() {
+		now := time.Now()
+		account.DisabledAt = &now
+		if err := a.as.Update(account); err != nil {
+			var vd views.Data
+			vd.SetAlert(err)
+			a.renderAccount(w, r, vd, account)
+			return
+		}
+	}
+	// A disabled account shouldn't stay signed in anywhere.
+	if err := a.ss.DeleteByAccountID(account.ID); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		a.renderAccount(w, r, vd, account)
+		return
+	}
+	http.Redirect(w, r, adminAccountPath(account.ID), http.StatusFound)
+}
+
+// POST /admin/accounts/:id/enable
+func (a *Admin) Enable(w http.ResponseWriter, r *http.Request) {
+	account, err := a.accountByID(w, r)
+	if err != nil {
+		return
+	}
+	account.DisabledAt = nil
+	if err := a.as.Update(account); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		a.renderAccount(w, r, vd, account)
+		return
+	}
+	http.Redirect(w, r, adminAccountPath(account.ID), http.StatusFound)
+}
+
+// Logout signs the account out of every device.
+// POST /admin/accounts/:id/logout
+func (a *Admin) Logout(w http.ResponseWriter, r *http.Request) {
+	account, err := a.accountByID(w, r)
+	if err != nil {
+		return
+	}
+	if err := a.ss.DeleteByAccountID(account.ID); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		a.renderAccount(w, r, vd, account)
+		return
+	}
+	http.Redirect(w, r, adminAccountPath(account.ID), http.StatusFound)
+}
+
+// POST /admin/accounts/:id/role
+func (a *Admin) Role(w http.ResponseWriter, r *http.Request) {
+	account, err := a.accountByID(w, r)
+	if err != nil {
+		return
+	}
+	var form AdminRoleForm
+	if err := parseForm(r, &form); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		a.renderAccount(w, r, vd, account)
+		return
+	}
+	if a.isSelf(r, account) {
+		// Keeps the last admin from locking everyone out.
+		var vd views.Data
+		vd.AlertError(errAdminSelf)
+		a.renderAccount(w, r, vd, account)
+		return
+	}
+	account.Role = models.Role(form.Role)
+	if err := a.as.Update(account); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		a.renderAccount(w, r, vd, account)
+		return
+	}
+	http.Redirect(w, r, adminAccountPath(account.ID), http.StatusFound)
+}
+
+// GET /admin/galleries
+func (a *Admin) Galleries(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form AdminSearchForm
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.GalleriesView.Render(w, r, vd)
+		return
+	}
+	galleries, info, err := a.gs.List(form.Query,
+		models.Page{Number: form.Page})
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = AdminGalleriesData{
+		Query:     form.Query,
+		Galleries: galleries,
+		Page:      info,
+	}
+	a.GalleriesView.Render(w, r, vd)
+}
+
+// DeleteGallery removes an abusive gallery and its images. The
+// Gallery middleware has already loaded it and checked the
+// policy.
+// POST /admin/galleries/:id/delete
+func (a *Admin) DeleteGallery(w http.ResponseWriter, r *http.Request) {
+	gallery := context.Gallery(r.Context())
+	var form AdminGalleryDeleteForm
+	if err := parseForm(r, &form); err != nil {
+		log.Println(err)
+	}
+	err := a.is.DeleteAll(gallery.ID)
+	if err == nil {
+		err = a.gs.Delete(gallery.ID)
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	next := adminAccountPath(gallery.AccountID)
+	// Only follow next within the console, so the form can't
+	// be used to bounce admins to another site.
+	if strings.HasPrefix(form.Next, "/admin/") {
+		next = form.Next
+	}
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+// renderAccount renders the account page, keeping any alert
+// already set on vd.
+func (a *Admin) renderAccount(w http.ResponseWriter, r *http.Request,
+	vd views.Data, account *models.Account) {
+	data := AdminAccountData{
+		Account: account,
+		Roles: []models.Role{models.RoleUser,
+			models.RoleModerator, models.RoleAdmin},
+	}
+	galleries, err := a.gs.ByAccountID(account.ID)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	for _, g := range galleries {
+		images, err := a.is.ByGalleryID(g.ID)
+		if err != nil {
+			log.Println(err)
+		}
+		data.Galleries = append(data.Galleries,
+			AdminGallery{Gallery: g, ImageCount: len(images)})
+	}
+	sessions, err := a.ss.ByAccountID(account.ID)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	data.Sessions = len(sessions)
+	vd.Yield = data
+	a.AccountView.Render(w, r, vd)
+}
+
+// accountByID looks up the account named by the "id" route
+// variable. Like galleries it renders the error itself, so
+// callers only need to return.
+func (a *Admin) accountByID(w http.ResponseWriter, r *http.Request) (*models.Account, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Account not found", http.StatusNotFound)
+		return nil, err
+	}
+	account, err := a.as.ByID(uint(id))
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Account not found", http.StatusNotFound)
+		default:
+			log.Println(err)
+			http.Error(w, "Something went wrong.",
+				http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return account, nil
+}
+
+func (a *Admin) isSelf(r *http.Request, account *models.Account) bool {
+	return context.Account(r.Context()).ID == account.ID
+}
+
+func adminAccountPath(id uint) string {
+	return fmt.Sprintf("/admin/accounts/%d", id)
+}
@@ -0,0 +1,575 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"muto/context"
+	"muto/markdown"
+	"muto/models"
+	"muto/policy"
+	"muto/views"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxJSONBody caps the size of JSON request bodies.
+	maxJSONBody = 1 << 20 // 1 megabyte
+)
+
+func NewAPI(gs models.GalleryService, is models.ImageService) *API {
+	return &API{
+		gs: gs,
+		is: is,
+	}
+}
+
+// API serves galleries and images as JSON under /api/v1. Requests
+// are authenticated with the bearer tokens checked by the Account
+// middleware, and each route is wrapped in RequireScope.
+type API struct {
+	gs models.GalleryService
+	is models.ImageService
+}
+
+// APIError is the body of every error response, eg
+// {"error": {"status": 404, "message": "Gallery not found"}}
+type APIError struct {
+	Error APIErrorDetail `json:"error"`
+}
+
+type APIErrorDetail struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+type APIGallery struct {
+	ID        uint   `json:"id"`
+	AccountID uint   `json:"account_id"`
+	Title     string `json:"title"`
+	// Description is markdown, DescriptionHTML the sanitised
+	// HTML it renders to.
+	Description     string `json:"description"`
+	DescriptionHTML string `json:"description_html"`
+	CoverImage      string `json:"cover_image"`
+	// Visibility is one of private, unlisted or public.
+	Visibility string     `json:"visibility"`
+	Category   string     `json:"category"`
+	Tags       []string   `json:"tags"`
+	ImageCount int        `json:"image_count"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	Images     []APIImage `json:"images,omitempty"`
+}
+
+type APIImage struct {
+	ID        uint `json:"id"`
+	GalleryID uint `json:"gallery_id"`
+	// Name identifies the image within its gallery, eg as its
+	// cover. Filename is the name it was uploaded with. URL
+	// downloads the image with the same API token.
+	Name        string `json:"name"`
+	Filename    string `json:"filename"`
+	URL         string `json:"url"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Checksum    string `json:"sha256"`
+	Position    int    `json:"position"`
+	Caption     string `json:"caption"`
+	// Sizes maps the downscaled sizes the image has, eg "thumb",
+	// to their URLs.
+	Sizes     map[string]string `json:"sizes,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// APIPage describes a page of a listing. Pass NextCursor or
+// PrevCursor as the cursor query parameter to fetch the page after
+// or before it; they are omitted at either end of the listing.
+type APIPage struct {
+	Size       int    `json:"size"`
+	Total      int    `json:"total"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
+}
+
+// APIGalleryList is a single page of galleries.
+type APIGalleryList struct {
+	Data []APIGallery `json:"data"`
+	Page APIPage      `json:"page"`
+}
+
+// APIImageList lists images. Images aren't paginated since a
+// gallery only has so many.
+type APIImageList struct {
+	Data []APIImage `json:"data"`
+}
+
+// APIGalleryForm is the body of gallery create and update
+// requests. Fields are pointers so updates can tell a missing
+// field from an empty one.
+type APIGalleryForm struct {
+	Title       *string `json:"title"`
+	Description *string `json:"description"`
+	CoverImage  *string `json:"cover_image"`
+	Visibility  *string `json:"visibility"`
+	Category    *string `json:"category"`
+	// Tags replaces every tag of the gallery when sent.
+	Tags *[]string `json:"tags"`
+}
+
+// apply copies the fields that were sent onto gallery.
+func (form *APIGalleryForm) apply(gallery *models.Gallery) {
+	if form.Title != nil {
+		gallery.Title = *form.Title
+	}
+	if form.Description != nil {
+		gallery.Description = *form.Description
+	}
+	if form.CoverImage != nil {
+		gallery.CoverImage = *form.CoverImage
+	}
+	if form.Visibility != nil {
+		gallery.Visibility = models.Visibility(*form.Visibility)
+	}
+	if form.Category != nil {
+		gallery.Category = models.Category(*form.Category)
+	}
+	if form.Tags != nil {
+		gallery.SetTags(*form.Tags)
+	}
+}
+
+// APIGalleryListForm is the query string of gallery listings.
+// Sort is one of created (the default), updated, title or images
+// and order is asc or desc.
+type APIGalleryListForm struct {
+	Sort    string `schema:"sort"`
+	Order   string `schema:"order"`
+	Cursor  string `schema:"cursor"`
+	PerPage int    `schema:"per_page"`
+}
+
+// APIImageFileForm is the query string of image downloads. Size
+// is one of the image's sizes, eg thumb, and the full image is
+// downloaded without it.
+type APIImageFileForm struct {
+	Size string `schema:"size"`
+}
+
+// RequireScope only lets requests through when they were made
+// with an API token that has scope. Unlike RequireAccount it
+// answers with JSON instead of redirecting to the sign in page.
+func (a *API) RequireScope(scope models.Scope, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := context.APIToken(r.Context())
+		if token == nil || context.Account(r.Context()) == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="muto"`)
+			a.writeError(w, http.StatusUnauthorized,
+				"A valid API token is required")
+			return
+		}
+		if !token.HasScope(scope) {
+			a.writeError(w, http.StatusForbidden,
+				fmt.Sprintf("This token is missing the %s scope", scope))
+			return
+		}
+		next(w, r)
+	})
+}
+
+// GET /api/v1/galleries
+func (a *API) ListGalleries(w http.ResponseWriter, r *http.Request) {
+	var form APIGalleryListForm
+	if err := parseURLParams(r, &form); err != nil {
+		a.writeError(w, http.StatusBadRequest, "Invalid query string")
+		return
+	}
+	account := context.Account(r.Context())
+	galleries, info, err := a.gs.ListByAccountID(account.ID,
+		models.GalleryListOptions{
+			Sort:   models.GallerySort(form.Sort),
+			Order:  models.SortOrder(form.Order),
+			Cursor: form.Cursor,
+			Size:   form.PerPage,
+		})
+	switch err {
+	case nil:
+	case models.ErrSortInvalid, models.ErrOrderInvalid, models.ErrCursorInvalid:
+		a.writeError(w, http.StatusBadRequest, err.(views.PublicError).Public())
+		return
+	default:
+		a.writeModelError(w, err)
+		return
+	}
+	list := APIGalleryList{
+		Data: make([]APIGallery, len(galleries)),
+		Page: APIPage{
+			Size:       info.Size,
+			Total:      info.Total,
+			NextCursor: info.Next,
+			PrevCursor: info.Prev,
+		},
+	}
+	for i := range galleries {
+		list.Data[i] = apiGallery(&galleries[i])
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// GET /api/v1/galleries/:id
+func (a *API) GetGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.galleryFor(w, r, policy.ViewGallery)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, apiGallery(gallery))
+}
+
+// POST /api/v1/galleries
+func (a *API) CreateGallery(w http.ResponseWriter, r *http.Request) {
+	account := context.Account(r.Context())
+	if !account.Verified() {
+		a.writeError(w, http.StatusForbidden,
+			"Verify your email address before creating galleries")
+		return
+	}
+	var form APIGalleryForm
+	if !a.decodeJSON(w, r, &form) {
+		return
+	}
+	gallery := models.Gallery{AccountID: account.ID}
+	form.apply(&gallery)
+	if gallery.CoverImage != "" {
+		// A new gallery doesn't have any images yet.
+		a.writeModelError(w, models.ErrCoverImageInvalid)
+		return
+	}
+	if err := a.gs.Create(&gallery); err != nil {
+		a.writeModelError(w, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/galleries/%d", gallery.ID))
+	writeJSON(w, http.StatusCreated, apiGallery(&gallery))
+}
+
+// PATCH /api/v1/galleries/:id
+func (a *API) UpdateGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.galleryFor(w, r, policy.EditGallery)
+	if !ok {
+		return
+	}
+	var form APIGalleryForm
+	if !a.decodeJSON(w, r, &form) {
+		return
+	}
+	form.apply(gallery)
+	if !hasImage(gallery, gallery.CoverImage) {
+		a.writeModelError(w, models.ErrCoverImageInvalid)
+		return
+	}
+	if err := a.gs.Update(gallery); err != nil {
+		a.writeModelError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, apiGallery(gallery))
+}
+
+// DELETE /api/v1/galleries/:id
+func (a *API) DeleteGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.galleryFor(w, r, policy.DeleteGallery)
+	if !ok {
+		return
+	}
+	err := a.is.DeleteAll(gallery.ID)
+	if err == nil {
+		err = a.gs.Delete(gallery.ID)
+	}
+	if err != nil {
+		a.writeModelError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/v1/galleries/:id/images
+func (a *API) ListImages(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.galleryFor(w, r, policy.ViewGallery)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, APIImageList{Data: apiImages(gallery.Images)})
+}
+
+// UploadImages stores every file sent in the "images" field of a
+// multipart form and responds with the images that were created.
+// POST /api/v1/galleries/:id/images
+func (a *API) UploadImages(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.galleryFor(w, r, policy.UploadImage)
+	if !ok {
+		return
+	}
+	if !context.Account(r.Context()).Verified() {
+		a.writeError(w, http.StatusForbidden,
+			"Verify your email address before uploading images")
+		return
+	}
+	if err := r.ParseMultipartForm(maxMultipartMem); err != nil {
+		if err = uploadError(err); err == models.ErrUploadTooLarge {
+			a.writeModelError(w, err)
+			return
+		}
+		a.writeError(w, http.StatusBadRequest,
+			"Expected a multipart form with an images field")
+		return
+	}
+	files := r.MultipartForm.File["images"]
+	if len(files) == 0 {
+		a.writeError(w, http.StatusBadRequest,
+			"Expected a multipart form with an images field")
+		return
+	}
+	var created []models.Image
+	for _, f := range files {
+		if f.Size > models.MaxImageSize {
+			a.writeModelError(w, models.ErrImageTooLarge)
+			return
+		}
+		file, err := f.Open()
+		if err != nil {
+			a.writeModelError(w, err)
+			return
+		}
+		image, err := a.is.Create(gallery.ID, file, f.Filename)
+		file.Close()
+		if err != nil {
+			a.writeModelError(w, err)
+			return
+		}
+		created = append(created, *image)
+	}
+	writeJSON(w, http.StatusCreated, APIImageList{Data: apiImages(created)})
+}
+
+// DELETE /api/v1/galleries/:id/images/:image_id
+func (a *API) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.galleryFor(w, r, policy.DeleteImage)
+	if !ok {
+		return
+	}
+	image := galleryImage(gallery, mux.Vars(r)["image_id"])
+	if image == nil {
+		a.writeError(w, http.StatusNotFound, "Image not found")
+		return
+	}
+	if err := a.is.Delete(gallery.ID, image.ID); err != nil {
+		a.writeModelError(w, err)
+		return
+	}
+	if gallery.CoverImage == image.Name() {
+		gallery.CoverImage = ""
+		if err := a.gs.Update(gallery); err != nil {
+			log.Println(err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ImageFile downloads an image, or one of its sizes, for clients
+// that can't use the cookies the /images pages are served with.
+// Like there, stores that hand out signed URLs get a redirect.
+// GET /api/v1/images/:id/file
+func (a *API) ImageFile(w http.ResponseWriter, r *http.Request) {
+	var form APIImageFileForm
+	if err := parseURLParams(r, &form); err != nil {
+		a.writeError(w, http.StatusBadRequest, "Invalid query string")
+		return
+	}
+	size := models.ImageSize(form.Size)
+	if size != "" && !size.Valid() {
+		a.writeError(w, http.StatusNotFound, "Image not found")
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		a.writeError(w, http.StatusNotFound, "Image not found")
+		return
+	}
+	image, err := a.is.ByID(uint(id))
+	if err != nil {
+		a.writeModelError(w, err)
+		return
+	}
+	gallery, err := a.gs.ByID(image.GalleryID)
+	if err != nil {
+		a.writeModelError(w, err)
+		return
+	}
+	if !policy.Can(context.Account(r.Context()), policy.ViewGallery, gallery) {
+		a.writeError(w, http.StatusNotFound, "Image not found")
+		return
+	}
+	signed, err := a.is.SignedURL(image, size)
+	if err != nil {
+		a.writeModelError(w, err)
+		return
+	}
+	if signed != "" {
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, signed, http.StatusFound)
+		return
+	}
+	serveImage(w, r, func() (*models.ImageFile, error) {
+		if size != "" {
+			return a.is.OpenSize(image, size)
+		}
+		return a.is.OpenFile(image)
+	}, "private, no-cache")
+}
+
+// galleryFor looks up the gallery named by the "id" route
+// variable and checks the policy the same way the Gallery
+// middleware does for the HTML pages. It writes the error
+// response itself, so callers only need to return when ok is
+// false.
+func (a *API) galleryFor(w http.ResponseWriter, r *http.Request,
+	action policy.Action) (*models.Gallery, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		a.writeError(w, http.StatusNotFound, "Gallery not found")
+		return nil, false
+	}
+	gallery, err := a.gs.ByID(uint(id))
+	if err != nil {
+		a.writeModelError(w, err)
+		return nil, false
+	}
+	account := context.Account(r.Context())
+	if !policy.Can(account, policy.ViewGallery, gallery) {
+		a.writeError(w, http.StatusNotFound, "Gallery not found")
+		return nil, false
+	}
+	if !policy.Can(account, action, gallery) {
+		a.writeError(w, http.StatusForbidden,
+			"You do not have permission to do that")
+		return nil, false
+	}
+	images, err := a.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	gallery.Images = images
+	return gallery, true
+}
+
+// decodeJSON reads a JSON request body into dst, writing a 400
+// response if it can't.
+func (a *API) decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	body := http.MaxBytesReader(w, r.Body, maxJSONBody)
+	if err := json.NewDecoder(body).Decode(dst); err != nil {
+		a.writeError(w, http.StatusBadRequest, "Request body must be valid JSON")
+		return false
+	}
+	return true
+}
+
+// writeModelError picks the status code for an error returned by
+// the models package. Errors with a public message are the
+// client's fault, anything else is ours and isn't shown.
+func (a *API) writeModelError(w http.ResponseWriter, err error) {
+	pErr, ok := err.(views.PublicError)
+	switch {
+	case err == models.ErrNotFound:
+		a.writeError(w, http.StatusNotFound, pErr.Public())
+	case err == models.ErrImageTooLarge, err == models.ErrUploadTooLarge:
+		a.writeError(w, http.StatusRequestEntityTooLarge, pErr.Public())
+	case ok:
+		a.writeError(w, http.StatusUnprocessableEntity, pErr.Public())
+	default:
+		log.Println(err)
+		a.writeError(w, http.StatusInternalServerError,
+			"Something went wrong.")
+	}
+}
+
+func (a *API) writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, APIError{
+		Error: APIErrorDetail{
+			Status:  status,
+			Message: msg,
+		},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+func apiGallery(g *models.Gallery) APIGallery {
+	return APIGallery{
+		ID:              g.ID,
+		AccountID:       g.AccountID,
+		Title:           g.Title,
+		Description:     g.Description,
+		DescriptionHTML: string(markdown.Render(g.Description)),
+		CoverImage:      g.CoverImage,
+		Visibility:      string(g.Visibility),
+		Category:        string(g.Category),
+		Tags:            g.TagNames(),
+		ImageCount:      g.ImageCount,
+		CreatedAt:       g.CreatedAt,
+		UpdatedAt:       g.UpdatedAt,
+		Images:          apiImages(g.Images),
+	}
+}
+
+func apiImages(images []models.Image) []APIImage {
+	ret := make([]APIImage, len(images))
+	for i := range images {
+		ret[i] = APIImage{
+			ID:          images[i].ID,
+			GalleryID:   images[i].GalleryID,
+			Name:        images[i].Name(),
+			Filename:    images[i].Filename,
+			URL:         apiImageURL(&images[i], ""),
+			Size:        images[i].Size,
+			ContentType: images[i].ContentType,
+			Width:       images[i].Width,
+			Height:      images[i].Height,
+			Checksum:    images[i].Checksum,
+			Position:    images[i].Position,
+			Caption:     images[i].Caption,
+			CreatedAt:   images[i].CreatedAt,
+		}
+		for _, size := range models.ImageSizes {
+			if !images[i].HasSize(size) {
+				continue
+			}
+			if ret[i].Sizes == nil {
+				ret[i].Sizes = make(map[string]string)
+			}
+			ret[i].Sizes[string(size)] = apiImageURL(&images[i], size)
+		}
+	}
+	return ret
+}
+
+// apiImageURL returns the URL of ImageFile for the image, or its
+// size s unless s is empty.
+func apiImageURL(image *models.Image, s models.ImageSize) string {
+	url := fmt.Sprintf("%s/images/%d/file", APIPrefix, image.ID)
+	if s != "" {
+		url += "?size=" + string(s)
+	}
+	return url
+}
@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"net/http"
+
+	"muto/models"
+	"muto/openapi"
+
+	"github.com/gorilla/mux"
+)
+
+// APIPrefix is where the routes of the JSON API live.
+const APIPrefix = "/api/v1"
+
+// APIInfo describes the JSON API in its OpenAPI document.
+var APIInfo = openapi.Info{
+	Title:   "MUTO API",
+	Version: "1",
+}
+
+// Routes adds the routes of the JSON API to r, under APIPrefix.
+func (a *API) Routes(r *mux.Router) {
+	apiR := r.PathPrefix(APIPrefix).Subrouter()
+	apiR.HandleFunc("/galleries",
+		a.RequireScope(models.ScopeGalleriesRead, a.ListGalleries)).
+		Methods("GET")
+	apiR.HandleFunc("/galleries",
+		a.RequireScope(models.ScopeGalleriesWrite, a.CreateGallery)).
+		Methods("POST")
+	apiR.HandleFunc("/galleries/{id:[0-9]+}",
+		a.RequireScope(models.ScopeGalleriesRead, a.GetGallery)).
+		Methods("GET")
+	apiR.HandleFunc("/galleries/{id:[0-9]+}",
+		a.RequireScope(models.ScopeGalleriesWrite, a.UpdateGallery)).
+		Methods("PATCH", "PUT")
+	apiR.HandleFunc("/galleries/{id:[0-9]+}",
+		a.RequireScope(models.ScopeGalleriesWrite, a.DeleteGallery)).
+		Methods("DELETE")
+	apiR.HandleFunc("/galleries/{id:[0-9]+}/images",
+		a.RequireScope(models.ScopeGalleriesRead, a.ListImages)).
+		Methods("GET")
+	apiR.HandleFunc("/galleries/{id:[0-9]+}/images",
+		a.RequireScope(models.ScopeImagesWrite, a.UploadImages)).
+		Methods("POST")
+	apiR.HandleFunc("/galleries/{id:[0-9]+}/images/{image_id:[0-9]+}",
+		a.RequireScope(models.ScopeImagesWrite, a.DeleteImage)).
+		Methods("DELETE")
+	apiR.HandleFunc("/images/{id:[0-9]+}/file",
+		a.RequireScope(models.ScopeGalleriesRead, a.ImageFile)).
+		Methods("GET")
+}
+
+// Operations documents every route of the JSON API for the
+// OpenAPI document served at /api/openapi.json. The document is
+// built from the router when the app starts, and building it fails
+// if a route under /api/v1 isn't listed here.
+func (a *API) Operations() []openapi.Operation {
+	read := string(models.ScopeGalleriesRead)
+	write := string(models.ScopeGalleriesWrite)
+	images := string(models.ScopeImagesWrite)
+	return []openapi.Operation{
+		{
+			Method:   "GET",
+			Path:     "/api/v1/galleries",
+			Summary:  "List your galleries, one page at a time",
+			Scope:    read,
+			Query:    APIGalleryListForm{},
+			Status:   http.StatusOK,
+			Response: APIGalleryList{},
+			Error:    APIError{},
+		},
+		{
+			Method:   "POST",
+			Path:     "/api/v1/galleries",
+			Summary:  "Create a gallery",
+			Scope:    write,
+			Body:     APIGalleryForm{},
+			Status:   http.StatusCreated,
+			Response: APIGallery{},
+			Error:    APIError{},
+		},
+		{
+			Method:   "GET",
+			Path:     "/api/v1/galleries/{id}",
+			Summary:  "Get a gallery and its images",
+			Scope:    read,
+			Status:   http.StatusOK,
+			Response: APIGallery{},
+			Error:    APIError{},
+		},
+		{
+			Method:   "PATCH",
+			Path:     "/api/v1/galleries/{id}",
+			Summary:  "Update a gallery",
+			Scope:    write,
+			Body:     APIGalleryForm{},
+			Status:   http.StatusOK,
+			Response: APIGallery{},
+			Error:    APIError{},
+		},
+		{
+			Method:   "PUT",
+			Path:     "/api/v1/galleries/{id}",
+			Summary:  "Update a gallery",
+			Scope:    write,
+			Body:     APIGalleryForm{},
+			Status:   http.StatusOK,
+			Response: APIGallery{},
+			Error:    APIError{},
+		},
+		{
+			Method:  "DELETE",
+			Path:    "/api/v1/galleries/{id}",
+			Summary: "Delete a gallery and all of its images",
+			Scope:   write,
+			Status:  http.StatusNoContent,
+			Error:   APIError{},
+		},
+		{
+			Method:   "GET",
+			Path:     "/api/v1/galleries/{id}/images",
+			Summary:  "List the images in a gallery",
+			Scope:    read,
+			Status:   http.StatusOK,
+			Response: APIImageList{},
+			Error:    APIError{},
+		},
+		{
+			Method:    "POST",
+			Path:      "/api/v1/galleries/{id}/images",
+			Summary:   "Upload images to a gallery",
+			Scope:     images,
+			Multipart: []string{"images"},
+			Status:    http.StatusCreated,
+			Response:  APIImageList{},
+			Error:     APIError{},
+		},
+		{
+			Method:  "DELETE",
+			Path:    "/api/v1/galleries/{id}/images/{image_id}",
+			Summary: "Delete an image",
+			Scope:   images,
+			Status:  http.StatusNoContent,
+			Error:   APIError{},
+		},
+		{
+			Method:  "GET",
+			Path:    "/api/v1/images/{id}/file",
+			Summary: "Download an image or one of its sizes",
+			Scope:   read,
+			Query:   APIImageFileForm{},
+			Status:  http.StatusOK,
+			File:    "image/*",
+			Error:   APIError{},
+		},
+	}
+}
@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"muto/openapi"
+
+	"github.com/gorilla/mux"
+)
+
+// apiRouter returns a router with the real API routes, and a page
+// outside the API, which doesn't need documenting.
+func apiRouter() (*mux.Router, *API) {
+	api := NewAPI(nil, nil)
+	r := mux.NewRouter()
+	r.HandleFunc("/galleries", func(http.ResponseWriter, *http.Request) {}).
+		Methods("GET")
+	api.Routes(r)
+	return r, api
+}
+
+func TestAPIOperationsDocumentEveryRoute(t *testing.T) {
+	r, api := apiRouter()
+	doc, err := openapi.Build(r, APIPrefix, APIInfo, api.Operations())
+	if err != nil {
+		t.Fatalf("Build() err = %v", err)
+	}
+	want := map[string][]string{
+		"/api/v1/galleries":                        {"get", "post"},
+		"/api/v1/galleries/{id}":                   {"get", "patch", "put", "delete"},
+		"/api/v1/galleries/{id}/images":            {"get", "post"},
+		"/api/v1/galleries/{id}/images/{image_id}": {"delete"},
+		"/api/v1/images/{id}/file":                 {"get"},
+	}
+	if len(doc.Paths) != len(want) {
+		t.Errorf("documented %d paths, want %d", len(doc.Paths), len(want))
+	}
+	for path, methods := range want {
+		for _, method := range methods {
+			if doc.Paths[path][method] == nil {
+				t.Errorf("%s %s is not documented", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+func TestAPIUndocumentedRoute(t *testing.T) {
+	r, api := apiRouter()
+	r.HandleFunc(APIPrefix+"/tags", func(http.ResponseWriter, *http.Request) {}).
+		Methods("GET")
+	_, err := openapi.Build(r, APIPrefix, APIInfo, api.Operations())
+	if err == nil || !strings.Contains(err.Error(), "route missing from the spec: GET /api/v1/tags") {
+		t.Errorf("Build() err = %v, want the undocumented route named", err)
+	}
+}
+
+func TestAPIStaleOperation(t *testing.T) {
+	r, api := apiRouter()
+	ops := append(api.Operations(), openapi.Operation{
+		Method:  "GET",
+		Path:    APIPrefix + "/tags",
+		Summary: "List tags",
+		Status:  http.StatusOK,
+	})
+	_, err := openapi.Build(r, APIPrefix, APIInfo, ops)
+	if err == nil || !strings.Contains(err.Error(), "no route for documented GET /api/v1/tags") {
+		t.Errorf("Build() err = %v, want the stale operation named", err)
+	}
+}
@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"muto/context"
+	"muto/models"
+	"muto/views"
+
+	"github.com/gorilla/mux"
+)
+
+func NewAPITokens(ts models.APITokenService) *APITokens {
+	return &APITokens{
+		TokensView: views.NewView("materialize", "accounts/api_tokens"),
+		ts:         ts,
+	}
+}
+
+// APITokens lets an account manage its personal API tokens.
+type APITokens struct {
+	TokensView *views.View
+	ts         models.APITokenService
+}
+
+// APITokenForm is used to create a token. ExpiresIn is in days,
+// and 0 creates a token that never expires.
+type APITokenForm struct {
+	Name      string   `schema:"name"`
+	Scopes    []string `schema:"scopes"`
+	ExpiresIn int      `schema:"expires_in"`
+}
+
+// APITokensData is used to render the token settings page.
+// Created is only set right after a token was created, as that
+// is the only time its raw value is available.
+type APITokensData struct {
+	Tokens  []models.APIToken
+	Scopes  []models.Scope
+	Created *models.APIToken
+}
+
+// GET /account/tokens
+func (t *APITokens) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	t.render(w, r, vd, nil)
+}
+
+// POST /account/tokens
+func (t *APITokens) Create(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form APITokenForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		t.render(w, r, vd, nil)
+		return
+	}
+	account := context.Account(r.Context())
+	token := models.APIToken{
+		AccountID: account.ID,
+		Name:      form.Name,
+	}
+	scopes := make([]models.Scope, len(form.Scopes))
+	for i, s := range form.Scopes {
+		scopes[i] = models.Scope(s)
+	}
+	token.SetScopes(scopes)
+	if form.ExpiresIn > 0 {
+		expires := time.Now().AddDate(0, 0, form.ExpiresIn)
+		token.ExpiresAt = &expires
+	}
+	if err := t.ts.Create(&token); err != nil {
+		vd.SetAlert(err)
+		t.render(w, r, vd, nil)
+		return
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Token created. Copy it now, you won't be able to see it again.",
+	}
+	t.render(w, r, vd, &token)
+}
+
+// POST /account/tokens/:id/revoke
+func (t *APITokens) Revoke(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	account := context.Account(r.Context())
+	tokens, err := t.ts.ByAccountID(account.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		t.render(w, r, vd, nil)
+		return
+	}
+	// Only revoke the token if it belongs to this account.
+	for _, token := range tokens {
+		if token.ID != uint(id) {
+			continue
+		}
+		if err := t.ts.Delete(token.ID); err != nil {
+			vd.SetAlert(err)
+			t.render(w, r, vd, nil)
+			return
+		}
+		http.Redirect(w, r, "/account/tokens", http.StatusFound)
+		return
+	}
+	http.Error(w, "Token not found", http.StatusNotFound)
+}
+
+func (t *APITokens) render(w http.ResponseWriter, r *http.Request,
+	vd views.Data, created *models.APIToken) {
+	account := context.Account(r.Context())
+	tokens, err := t.ts.ByAccountID(account.ID)
+	if err != nil && vd.Alert == nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = APITokensData{
+		Tokens:  tokens,
+		Scopes:  models.Scopes,
+		Created: created,
+	}
+	t.TokensView.Render(w, r, vd)
+}
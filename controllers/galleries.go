@@ -1,13 +1,18 @@
 package controllers
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"muto/context"
 	"muto/models"
+	"muto/policy"
 	"muto/views"
 
 	"github.com/gorilla/mux"
@@ -22,120 +27,286 @@ const (
 	maxMultipartMem = 1 << 20 // 1 megabyte
 )
 
-func NewGalleries(gs models.GalleryService, is models.ImageService, r *mux.Router) *Galleries {
+func NewGalleries(gs models.GalleryService, is models.ImageService,
+	ss models.GalleryShareService, lt models.LoginThrottle, r *mux.Router) *Galleries {
 	return &Galleries{
-		New:       views.NewView("materialize", "galleries/new"),
-		ShowView:  views.NewView("materialize", "galleries/show"),
-		EditView:  views.NewView("materialize", "galleries/edit"),
-		IndexView: views.NewView("materialize", "galleries/index"),
-		gs:        gs,
-		is:        is,
-		r:         r,
+		New:               views.NewView("materialize", "galleries/new"),
+		ShowView:          views.NewView("materialize", "galleries/show"),
+		EditView:          views.NewView("materialize", "galleries/edit"),
+		IndexView:         views.NewView("materialize", "galleries/index"),
+		SharePasswordView: views.NewView("materialize", "galleries/share_password"),
+		BrowseView:        views.NewView("materialize", "galleries/browse"),
+		gs:                gs,
+		is:                is,
+		ss:                ss,
+		lt:                lt,
+		r:                 r,
 	}
 }
 
 type Galleries struct {
-	New       *views.View
-	ShowView  *views.View
-	EditView  *views.View
-	IndexView *views.View
-	gs        models.GalleryService
-	is        models.ImageService
-	r         *mux.Router
+	New               *views.View
+	ShowView          *views.View
+	EditView          *views.View
+	IndexView         *views.View
+	SharePasswordView *views.View
+	BrowseView        *views.View
+	gs                models.GalleryService
+	is                models.ImageService
+	ss                models.GalleryShareService
+	lt                models.LoginThrottle
+	r                 *mux.Router
 }
 
 type GalleryForm struct {
-	Title string `schema:"title"`
+	Title       string `schema:"title"`
+	Description string `schema:"description"`
+	CoverImage  string `schema:"cover_image"`
+	Visibility  string `schema:"visibility"`
+	Category    string `schema:"category"`
+	// Tags is a comma separated list.
+	Tags string `schema:"tags"`
+}
+
+// ShareForm is used to create a share link. ExpiresIn is in
+// days and MaxViews of 0 allows any number of views.
+type ShareForm struct {
+	Label     string `schema:"label"`
+	ExpiresIn int    `schema:"expires_in"`
+	Password  string `schema:"password"`
+	MaxViews  int    `schema:"max_views"`
+}
+
+// SharePasswordForm is used to unlock a password protected share
+// link.
+type SharePasswordForm struct {
+	Password string `schema:"password"`
+}
+
+// GalleryShowData is used to render a gallery. ReadOnly hides the
+// links to manage it from people who can't, including everyone
+// viewing it through a share link.
+type GalleryShowData struct {
+	*models.Gallery
+	ReadOnly bool
+}
+
+// GalleryEditData is used to render the edit page, which also
+// lists the gallery's active share links.
+type GalleryEditData struct {
+	*models.Gallery
+	Shares     []models.GalleryShare
+	Categories []models.Category
+}
+
+// GalleryIndexForm is the query string of the galleries page.
+type GalleryIndexForm struct {
+	Sort   string `schema:"sort"`
+	Order  string `schema:"order"`
+	Cursor string `schema:"cursor"`
+}
+
+// GalleryIndexData is used to render an account's galleries one
+// page at a time.
+type GalleryIndexData struct {
+	Galleries []models.Gallery
+	Sort      models.GallerySort
+	Order     models.SortOrder
+	Sorts     []models.GallerySort
+	Page      models.CursorInfo
+}
+
+// SortURL returns the URL of the first page sorted by sort, in
+// its default order.
+func (gd GalleryIndexData) SortURL(sort models.GallerySort) string {
+	return "/galleries?" + url.Values{
+		"sort": {string(sort)},
+	}.Encode()
+}
+
+// ReverseURL returns the URL of the first page in the opposite
+// order.
+func (gd GalleryIndexData) ReverseURL() string {
+	order := models.Ascending
+	if gd.Order == models.Ascending {
+		order = models.Descending
+	}
+	return "/galleries?" + url.Values{
+		"sort":  {string(gd.Sort)},
+		"order": {string(order)},
+	}.Encode()
+}
+
+// PageURL returns the URL of the page cursor points at.
+func (gd GalleryIndexData) PageURL(cursor string) string {
+	return "/galleries?" + url.Values{
+		"sort":   {string(gd.Sort)},
+		"order":  {string(gd.Order)},
+		"cursor": {cursor},
+	}.Encode()
+}
+
+// BrowseForm picks the page of a tag or category listing.
+type BrowseForm struct {
+	Page int `schema:"page"`
+}
+
+// GalleryBrowseData is used to render a listing of public
+// galleries, eg all the galleries with a tag.
+type GalleryBrowseData struct {
+	Heading   string
+	Galleries []models.Gallery
+	Page      models.PageInfo
 }
 
 // POST /galleries
 func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	account := context.Account(r.Context())
-	galleries, err := g.gs.ByAccountID(account.ID)
-	if err != nil {
+	var vd views.Data
+	var form GalleryIndexForm
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+	}
+	opts := models.GalleryListOptions{
+		Sort:   models.GallerySort(form.Sort),
+		Order:  models.SortOrder(form.Order),
+		Cursor: form.Cursor,
+	}
+	galleries, info, err := g.gs.ListByAccountID(account.ID, opts)
+	switch err {
+	case nil:
+	case models.ErrSortInvalid, models.ErrOrderInvalid, models.ErrCursorInvalid:
+		// Fall back to the first page of the default listing
+		// rather than showing nothing.
+		vd.SetAlert(err)
+		opts = models.GalleryListOptions{}
+		galleries, info, err = g.gs.ListByAccountID(account.ID, opts)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+	default:
 		log.Println(err)
 		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
 	}
-	var vd views.Data
-	vd.Yield = galleries
+	if opts.Sort == "" {
+		opts.Sort = models.SortCreated
+	}
+	if opts.Order == "" {
+		opts.Order = opts.Sort.DefaultOrder()
+	}
+	vd.Yield = GalleryIndexData{
+		Galleries: galleries,
+		Sort:      opts.Sort,
+		Order:     opts.Order,
+		Sorts:     models.GallerySorts,
+		Page:      info,
+	}
 	g.IndexView.Render(w, r, vd)
 }
 
 // GET /galleries/:id
 func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
-	if err != nil {
-		// The galleryByID method will already render the
-		// error for us, so we just need to return here.
-		return
-	}
+	// The Gallery middleware has already looked up the gallery
+	// and checked that the account may perform this action.
+	gallery := context.Gallery(r.Context())
+	account := context.Account(r.Context())
 	var vd views.Data
-	vd.Yield = gallery
+	vd.Yield = GalleryShowData{
+		Gallery:  gallery,
+		ReadOnly: !policy.Can(account, policy.EditGallery, gallery),
+	}
 	g.ShowView.Render(w, r, vd)
 }
 
-// GET /galleries/:id/edit
-func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
-	if err != nil {
-		// The galleryByID method will already render the error for us,
-		// so we just need to return here.
+// Unlisted shows a gallery to anyone with its unlisted link.
+// The link stops working once the gallery is made private, except
+// for those who may see it anyway.
+// GET /g/:slug
+func (g *Galleries) Unlisted(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.gs.BySlug(mux.Vars(r)["slug"])
+	switch err {
+	case nil:
+	case models.ErrNotFound:
+		http.NotFound(w, r)
+		return
+	default:
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
 	}
-	// An account needs to be logged in to access this page,
-	// so we can assume that the RequireAccount middleware has run
-	// and set the account for us in the request context.
 	account := context.Account(r.Context())
-	if gallery.AccountID != account.ID {
-		http.Error(w, "You do not have permission to edit this gallery",
-			http.StatusForbidden)
+	if gallery.Visibility == models.VisibilityPrivate &&
+		!policy.Can(account, policy.ViewGallery, gallery) {
+		http.NotFound(w, r)
 		return
 	}
+	images, err := g.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	gallery.Images = images
+	// Only public galleries have their images served to anyone,
+	// so hand the slug to the image server as proof the link was
+	// followed.
+	http.SetCookie(w, &http.Cookie{
+		Name:     "gallery_link",
+		Value:    gallery.Slug,
+		Path:     fmt.Sprintf("/images/galleries/%d/", gallery.ID),
+		HttpOnly: true,
+	})
 	var vd views.Data
-	vd.Yield = gallery
-	g.EditView.Render(w, r, vd)
+	vd.Yield = GalleryShowData{
+		Gallery:  gallery,
+		ReadOnly: !policy.Can(account, policy.EditGallery, gallery),
+	}
+	g.ShowView.Render(w, r, vd)
+}
+
+// GET /galleries/:id/edit
+func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
+	gallery := context.Gallery(r.Context())
+	var vd views.Data
+	g.renderEdit(w, r, vd, gallery)
 }
 
 // POST /galleries/:id/images
 func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
-	if err != nil {
-		return
-	}
-	account := context.Account(r.Context())
-	if gallery.AccountID != account.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
-		return
-	}
-
+	gallery := context.Gallery(r.Context())
 	var vd views.Data
-	vd.Yield = gallery
-	err = r.ParseMultipartForm(maxMultipartMem)
+	err := r.ParseMultipartForm(maxMultipartMem)
 	if err != nil {
-		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		vd.SetAlert(uploadError(err))
+		g.renderEdit(w, r, vd, gallery)
 		return
 	}
 
 	// Iterate over uploaded files to process them.
 	files := r.MultipartForm.File["images"]
 	for _, f := range files {
+		// Turn away images that are too large before reading them.
+		if f.Size > models.MaxImageSize {
+			vd.SetAlert(models.ErrImageTooLarge)
+			g.renderEdit(w, r, vd, gallery)
+			return
+		}
 		// Open the uploaded file with existing code
 		file, err := f.Open()
 		if err != nil {
 			vd.SetAlert(err)
-			g.EditView.Render(w, r, vd)
+			g.renderEdit(w, r, vd, gallery)
 			return
 		}
 		defer file.Close()
 
 		// Call the ImageService's Create method.
 		// Create the image
-		err = g.is.Create(gallery.ID, file, f.Filename)
+		_, err = g.is.Create(gallery.ID, file, f.Filename)
 		if err != nil {
 			vd.SetAlert(err)
-			g.EditView.Render(w, r, vd)
+			g.renderEdit(w, r, vd, gallery)
 			return
 		}
 	}
@@ -149,37 +320,31 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url.Path, http.StatusFound)
 }
 
-// POST /galleries/:id/images/:filename/delete
+// POST /galleries/:id/images/:image_id/delete
 func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
-	// Look up gallery by it's ID.
-	gallery, err := g.galleryByID(w, r)
-	if err != nil {
-		return
-	}
-	// Verify current account has permission to edit gallery.
-	account := context.Account(r.Context())
-	if gallery.AccountID != account.ID {
-		http.Error(w, "You do not have permission to edit "+
-			"this gallery or image", http.StatusForbidden)
+	gallery := context.Gallery(r.Context())
+	// Find the image among the gallery's images.
+	image := galleryImage(gallery, mux.Vars(r)["image_id"])
+	if image == nil {
+		http.NotFound(w, r)
 		return
 	}
-	// Get the filename from the path.
-	filename := mux.Vars(r)["filename"]
-	// Build the Image model.
-	i := models.Image{
-		Filename:  filename,
-		GalleryID: gallery.ID,
-	}
 	// Try to delete the image.
-	err = g.is.Delete(&i)
+	err := g.is.Delete(gallery.ID, image.ID)
 	if err != nil {
 		// Render the edit page with any errors.
 		var vd views.Data
-		vd.Yield = gallery
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd, gallery)
 		return
 	}
+	// Fall back to the first image if we just deleted the cover.
+	if gallery.CoverImage == image.Name() {
+		gallery.CoverImage = ""
+		if err := g.gs.Update(gallery); err != nil {
+			log.Println(err)
+		}
+	}
 	// If all goes well, redirect to the edit gallery page.
 	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
 	if err != nil {
@@ -201,9 +366,11 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 	}
 	account := context.Account(r.Context())
 	gallery := models.Gallery{
-		Title:     form.Title,
-		AccountID: account.ID,
+		Title:       form.Title,
+		Description: form.Description,
+		AccountID:   account.ID,
 	}
+	gallery.SetTags(splitTags(form.Tags))
 	if err := g.gs.Create(&gallery); err != nil {
 		vd.SetAlert(err)
 		g.New.Render(w, r, vd)
@@ -227,28 +394,29 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 
 // POST /galleries/update
 func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
-	if err != nil {
-		return
-	}
-	account := context.Account(r.Context())
-	if gallery.AccountID != account.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
-		return
-	}
+	gallery := context.Gallery(r.Context())
 	var vd views.Data
-	vd.Yield = gallery
 	var form GalleryForm
 	if err := parseForm(r, &form); err != nil {
 		// If there is an error we are going
 		// to render the EditView again
 		// but with an Alert message.
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd, gallery)
 		return
 	}
 	gallery.Title = form.Title
-	err = g.gs.Update(gallery)
+	gallery.Description = form.Description
+	gallery.CoverImage = form.CoverImage
+	gallery.Visibility = models.Visibility(form.Visibility)
+	gallery.Category = models.Category(form.Category)
+	gallery.SetTags(splitTags(form.Tags))
+	var err error
+	if !hasImage(gallery, form.CoverImage) {
+		err = models.ErrCoverImageInvalid
+	} else {
+		err = g.gs.Update(gallery)
+	}
 	// If there is an error our alert will be an error. Otherwise
 	// we will still render an alert, but instead it will be
 	// a success message.
@@ -262,89 +430,320 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 	}
 	// Error or not, we are going to render the EditView with
 	// our updated information.
-	g.EditView.Render(w, r, vd)
+	g.renderEdit(w, r, vd, gallery)
 }
 
 // POST /gallery/:id/delete
 func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
-	// Lookup the gallery using galleryByID
-	gallery, err := g.galleryByID(w, r)
+	gallery := context.Gallery(r.Context())
+	var vd views.Data
+	err := g.is.DeleteAll(gallery.ID)
+	if err == nil {
+		err = g.gs.Delete(gallery.ID)
+	}
 	if err != nil {
+		// If an error occurs, set an alert and
+		// render the edit page with the error.
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd, gallery)
 		return
 	}
-	// Retrieve the account and verify they have permission
-	// to delete this gallery. Use RequireMiddleware
-	// on any routes mapped to this method.
-	account := context.Account(r.Context())
-	if gallery.AccountID != account.ID {
-		http.Error(w, "Permisson Denied! You do not have access to this gallery.", http.StatusForbidden)
+	url, err := g.r.Get(IndexGalleries).URL()
+	if err != nil {
+		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+// POST /galleries/:id/shares
+func (g *Galleries) ShareCreate(w http.ResponseWriter, r *http.Request) {
+	gallery := context.Gallery(r.Context())
 	var vd views.Data
-	err = g.gs.Delete(gallery.ID)
+	var form ShareForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd, gallery)
+		return
+	}
+	share := models.GalleryShare{
+		GalleryID: gallery.ID,
+		Label:     form.Label,
+		Password:  form.Password,
+		MaxViews:  form.MaxViews,
+	}
+	if form.ExpiresIn > 0 {
+		share.ExpiresAt = time.Now().AddDate(0, 0, form.ExpiresIn)
+	}
+	if err := g.ss.Create(&share); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd, gallery)
+		return
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Share link created",
+	}
+	g.renderEdit(w, r, vd, gallery)
+}
+
+// POST /galleries/:id/shares/:share/revoke
+func (g *Galleries) ShareRevoke(w http.ResponseWriter, r *http.Request) {
+	gallery := context.Gallery(r.Context())
+	var vd views.Data
+	id, err := strconv.Atoi(mux.Vars(r)["share"])
+	if err != nil {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	share, err := g.ss.ByID(uint(id))
+	if err == models.ErrNotFound || (err == nil && share.GalleryID != gallery.ID) {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = g.ss.Revoke(share)
+	}
 	if err != nil {
-		// If an error occurs, set an alert and
-		// render the edit page with the error.
-		// Set the Yield to gallery so that
-		// the EditView is rendered correctly.
 		vd.SetAlert(err)
-		vd.Yield = gallery
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd, gallery)
 		return
 	}
-	url, err := g.r.Get(IndexGalleries).URL()
+	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
 	if err != nil {
-		http.Redirect(w, r, "/", http.StatusFound)
+		log.Println(err)
+		http.Redirect(w, r, "/galleries", http.StatusFound)
 		return
 	}
 	http.Redirect(w, r, url.Path, http.StatusFound)
 }
 
-// galleryByID will parse the "id" variable from the
-// request path using gorilla/mux and then use that ID to
-// retrieve the gallery from the GalleryService
-//
-// galleryByID will return an error if one occurs, but it
-// will also render the error with an http.Error function
-// call, so you do not need to.
-func (g *Galleries) galleryByID(w http.ResponseWriter,
-	r *http.Request) (*models.Gallery, error) {
-	// First we get the vars like we saw earlier. We do this
-	// so we can get variables from our path, like the "id"
-	// variable.
-	vars := mux.Vars(r)
-	// Next we need to get the "id" variable from our vars.
-	idStr := vars["id"]
-	// Our idStr is a string, so we use the Atoi function
-	// provided by the strconv package to convert it into an
-	// integer. This function can also return an error, so we
-	// need to check for errors and render an error.
-	id, err := strconv.Atoi(idStr)
+// Shared shows a gallery to anyone with a share link, asking for
+// the link's password first if it has one. Each time the gallery
+// is shown counts as a view of the link.
+// GET /s/:token
+func (g *Galleries) Shared(w http.ResponseWriter, r *http.Request) {
+	share, gallery, ok := g.sharedGallery(w, r)
+	if !ok {
+		return
+	}
+	if share.HasPassword() {
+		cookie, err := r.Cookie("share_unlock")
+		if err != nil || !g.ss.Unlocked(share, cookie.Value) {
+			var vd views.Data
+			vd.Yield = share
+			g.SharePasswordView.Render(w, r, vd)
+			return
+		}
+	}
+	switch err := g.ss.View(share); err {
+	case nil:
+	case models.ErrShareUsedUp:
+		http.Error(w, models.ErrShareUsedUp.Public(), http.StatusGone)
+		return
+	default:
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	images, err := g.is.ByGalleryID(gallery.ID)
 	if err != nil {
-		// If there is an error we will return the StatusNotFound
-		// status code, as the page requested is for an invalid
-		// gallery ID, which means the page doesn't exist.
 		log.Println(err)
-		http.Error(w, "Invalid gallery ID", http.StatusNotFound)
-		return nil, err
 	}
-	gallery, err := g.gs.ByID(uint(id))
+	gallery.Images = images
+	// The images of private galleries are only served to people
+	// who can view the gallery, so hand the image server proof of
+	// this visit. It only lasts a while, so a link that has run
+	// out of views doesn't keep the images open.
+	http.SetCookie(w, &http.Cookie{
+		Name:     "gallery_share",
+		Value:    g.ss.VisitToken(share),
+		Path:     fmt.Sprintf("/images/galleries/%d/", gallery.ID),
+		HttpOnly: true,
+	})
+	var vd views.Data
+	vd.Yield = GalleryShowData{
+		Gallery:  gallery,
+		ReadOnly: true,
+	}
+	g.ShowView.Render(w, r, vd)
+}
+
+// SharedUnlock checks the password of a share link. The
+// password is remembered in a cookie for as long as the link
+// lasts. Wrong passwords are throttled like sign ins, both for
+// the link and for the client's IP address.
+// POST /s/:token
+func (g *Galleries) SharedUnlock(w http.ResponseWriter, r *http.Request) {
+	share, _, ok := g.sharedGallery(w, r)
+	if !ok {
+		return
+	}
+	var vd views.Data
+	vd.Yield = share
+	var form SharePasswordForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.SharePasswordView.Render(w, r, vd)
+		return
+	}
+	key := fmt.Sprintf("share:%d", share.ID)
+	ip := clientIP(r)
+	if err := g.lt.Allow(key, ip); err != nil {
+		vd.SetAlert(err)
+		g.SharePasswordView.Render(w, r, vd)
+		return
+	}
+	if err := g.ss.CheckPassword(share, form.Password); err != nil {
+		if err == models.ErrPasswordIncorrect {
+			if err := g.lt.Failed(key, ip); err != nil {
+				log.Println(err)
+			}
+		}
+		vd.SetAlert(err)
+		g.SharePasswordView.Render(w, r, vd)
+		return
+	}
+	if err := g.lt.Succeeded(key, ip); err != nil {
+		log.Println(err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "share_unlock",
+		Value:    g.ss.UnlockToken(share),
+		Path:     share.Path(),
+		Expires:  share.ExpiresAt,
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, share.Path(), http.StatusFound)
+}
+
+// sharedGallery looks up the share link named by the "token"
+// route variable and the gallery it shares. If either can't be
+// found the response is written and ok is false.
+func (g *Galleries) sharedGallery(w http.ResponseWriter,
+	r *http.Request) (share *models.GalleryShare, gallery *models.Gallery, ok bool) {
+	share, err := g.ss.ByToken(mux.Vars(r)["token"])
+	if err == nil {
+		gallery, err = g.gs.ByID(share.GalleryID)
+	}
+	switch err {
+	case nil:
+		return share, gallery, true
+	case models.ErrNotFound, models.ErrTokenInvalid:
+		http.Error(w, "Share link not found", http.StatusNotFound)
+	case models.ErrShareUnavailable:
+		http.Error(w, models.ErrShareUnavailable.Public(), http.StatusGone)
+	case models.ErrShareUsedUp:
+		http.Error(w, models.ErrShareUsedUp.Public(), http.StatusGone)
+	default:
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+	}
+	return nil, nil, false
+}
+
+// renderEdit renders the edit page for gallery along with its
+// share links.
+func (g *Galleries) renderEdit(w http.ResponseWriter, r *http.Request,
+	vd views.Data, gallery *models.Gallery) {
+	shares, err := g.ss.ByGalleryID(gallery.ID)
+	if err != nil && vd.Alert == nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = GalleryEditData{
+		Gallery:    gallery,
+		Shares:     shares,
+		Categories: models.Categories,
+	}
+	g.EditView.Render(w, r, vd)
+}
+
+// uploadError returns ErrUploadTooLarge if err came from the
+// request body going over the limit set by the LimitBody
+// middleware, and err otherwise.
+func uploadError(err error) error {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return models.ErrUploadTooLarge
+	}
+	return err
+}
+
+// galleryImage returns the gallery's image with the ID, or nil if
+// id isn't the ID of one of them.
+func galleryImage(gallery *models.Gallery, id string) *models.Image {
+	n, err := strconv.ParseUint(id, 10, 64)
 	if err != nil {
-		switch err {
-		case models.ErrNotFound:
-			http.Error(w, "Gallery not found", http.StatusNotFound)
-		default:
-			log.Println(err)
-			http.Error(w, "Hmmm..Something went wrong.",
-				http.StatusInternalServerError)
+		return nil
+	}
+	for i := range gallery.Images {
+		if gallery.Images[i].ID == uint(n) {
+			return &gallery.Images[i]
 		}
-		return nil, err
 	}
-	images, _ := g.is.ByGalleryID(gallery.ID)
-	gallery.Images = images
-	return gallery, nil
+	return nil
 }
 
-// Lookup galleryByCatergory
-// Lookup galleryByTag
-// Lookup galleryByDateCreated
+// hasImage reports whether filename is one of the gallery's
+// images. An empty filename always is, as it picks the default
+// cover.
+func hasImage(gallery *models.Gallery, filename string) bool {
+	if filename == "" {
+		return true
+	}
+	for _, image := range gallery.Images {
+		if image.Name() == filename {
+			return true
+		}
+	}
+	return false
+}
+
+// GET /tags/:tag
+func (g *Galleries) Tag(w http.ResponseWriter, r *http.Request) {
+	tag := models.NormalizeTag(mux.Vars(r)["tag"])
+	g.browse(w, r, "#"+tag, func(page models.Page) ([]models.Gallery, models.PageInfo, error) {
+		return g.gs.ByTag(tag, page)
+	})
+}
+
+// GET /categories/:category
+func (g *Galleries) Category(w http.ResponseWriter, r *http.Request) {
+	category := models.Category(mux.Vars(r)["category"])
+	if !category.Valid() {
+		http.NotFound(w, r)
+		return
+	}
+	g.browse(w, r, string(category), func(page models.Page) ([]models.Gallery, models.PageInfo, error) {
+		return g.gs.ByCategory(category, page)
+	})
+}
+
+// browse renders the page of public galleries that list returns.
+func (g *Galleries) browse(w http.ResponseWriter, r *http.Request, heading string,
+	list func(models.Page) ([]models.Gallery, models.PageInfo, error)) {
+	var vd views.Data
+	var form BrowseForm
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+	}
+	galleries, info, err := list(models.Page{Number: form.Page})
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = GalleryBrowseData{
+		Heading:   heading,
+		Galleries: galleries,
+		Page:      info,
+	}
+	g.BrowseView.Render(w, r, vd)
+}
+
+// splitTags splits a comma separated list of tags. The gallery
+// validator takes care of normalizing them.
+func splitTags(list string) []string {
+	if strings.TrimSpace(list) == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
@@ -1,7 +1,9 @@
 package controllers
 
 import (
+	"net"
 	"net/http"
+	"net/url"
 
 	"github.com/gorilla/schema"
 )
@@ -10,12 +12,35 @@ func parseForm(r *http.Request, dst interface{}) error {
 	if err := r.ParseForm(); err != nil {
 		return err
 	}
+	return parseValues(r.PostForm, dst)
+}
+
+// parseURLParams works like parseForm, but decodes the
+// query string of a GET request instead.
+func parseURLParams(r *http.Request, dst interface{}) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	return parseValues(r.Form, dst)
+}
+
+func parseValues(values url.Values, dst interface{}) error {
 	dec := schema.NewDecoder()
 	// Call IgnoreUnknownKeys function to tell schema's decoder
 	// to ignore the CSRF token key.
 	dec.IgnoreUnknownKeys(true)
-	if err := dec.Decode(dst, r.PostForm); err != nil {
+	if err := dec.Decode(dst, values); err != nil {
 		return err
 	}
 	return nil
 }
+
+// clientIP returns the IP address the request came from,
+// without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,208 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"muto/context"
+	"muto/models"
+	"muto/policy"
+
+	"github.com/gorilla/mux"
+)
+
+func NewImages(gs models.GalleryService, is models.ImageService,
+	ss models.GalleryShareService) *Images {
+	return &Images{
+		gs: gs,
+		is: is,
+		ss: ss,
+	}
+}
+
+// Images serves uploaded images. Gallery images are only served to
+// people who can view their gallery, either through the policy
+// package or with a share link. Avatars are public.
+type Images struct {
+	gs models.GalleryService
+	is models.ImageService
+	ss models.GalleryShareService
+}
+
+// imageTypes are the content types images are served with, by
+// extension. Anything else is served as a download so a browser
+// never renders an uploaded file as a page.
+var imageTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+}
+
+// GET /images/galleries/:id/:filename
+// GET /images/galleries/:id/:size/:filename
+func (i *Images) Show(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	gallery, err := i.gs.ByID(uint(id))
+	switch err {
+	case nil:
+	case models.ErrNotFound:
+		http.NotFound(w, r)
+		return
+	default:
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	account := context.Account(r.Context())
+	if !policy.Can(account, policy.ViewGallery, gallery) &&
+		!i.linked(r, gallery) && !i.shared(r, gallery) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Only serve files the ImageService lists for the gallery, so
+	// the filename can't point anywhere else.
+	images, err := i.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	filename := mux.Vars(r)["filename"]
+	size := models.ImageSize(mux.Vars(r)["size"])
+	if size != "" && !size.Valid() {
+		http.NotFound(w, r)
+		return
+	}
+	for _, image := range images {
+		name := image.Name()
+		if size != "" {
+			name = image.SizeName(size)
+		}
+		if name == "" || name != filename {
+			continue
+		}
+		// Stores that can hand out signed URLs serve the file
+		// themselves. The URL expires, so the redirect mustn't be
+		// cached. HEAD requests are answered by us, as a signed
+		// URL only works for GET.
+		var signed string
+		if r.Method != http.MethodHead {
+			signed, err = i.is.SignedURL(&image, size)
+		}
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		if signed != "" {
+			w.Header().Set("Cache-Control", "no-store")
+			http.Redirect(w, r, signed, http.StatusFound)
+			return
+		}
+		// Anyone may cache public images, but everything else has
+		// to be checked with us each time, so losing access (or a
+		// revoked share link) takes effect straight away.
+		cacheControl := "private, no-cache"
+		if gallery.Visibility == models.VisibilityPublic {
+			cacheControl = "public, max-age=3600"
+		}
+		serveImage(w, r, func() (*models.ImageFile, error) {
+			if size != "" {
+				return i.is.OpenSize(&image, size)
+			}
+			return i.is.OpenFile(&image)
+		}, cacheControl)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// GET /images/avatars/:id/:filename
+func (i *Images) Avatar(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	filename := mux.Vars(r)["filename"]
+	// Avatars are never changed once stored, only replaced by
+	// one with a new name.
+	serveImage(w, r, func() (*models.ImageFile, error) {
+		return i.is.OpenAvatar(uint(id), filename)
+	}, "public, max-age=3600")
+}
+
+// linked reports whether gallery is unlisted and the request
+// carries its slug, which is set when the gallery is opened with
+// its unlisted link.
+func (i *Images) linked(r *http.Request, gallery *models.Gallery) bool {
+	if gallery.Visibility != models.VisibilityUnlisted || gallery.Slug == "" {
+		return false
+	}
+	cookie, err := r.Cookie("gallery_link")
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(gallery.Slug)) == 1
+}
+
+// shared reports whether the request carries proof of a recent
+// visit to gallery through a share link that hasn't expired or
+// been revoked. The cookie is set when the gallery is opened with
+// the link, after its password was entered and the view counted.
+func (i *Images) shared(r *http.Request, gallery *models.Gallery) bool {
+	cookie, err := r.Cookie("gallery_share")
+	if err != nil {
+		return false
+	}
+	share, err := i.ss.ByVisitToken(cookie.Value)
+	return err == nil && share.GalleryID == gallery.ID
+}
+
+// serveImage writes the file returned by open, with caching
+// headers.
+// http.ServeContent takes care of Range and conditional requests,
+// using the ETag we set.
+func serveImage(w http.ResponseWriter, r *http.Request,
+	open func() (*models.ImageFile, error), cacheControl string) {
+	file, err := open()
+	switch err {
+	case nil:
+	case models.ErrNotFound:
+		http.NotFound(w, r)
+		return
+	default:
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	ext := strings.ToLower(filepath.Ext(file.Name))
+	contentType, ok := imageTypes[ext]
+	if !ok {
+		contentType = "application/octet-stream"
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(
+			"attachment", map[string]string{"filename": file.Name}))
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", cacheControl)
+	// The ETag changes whenever the file is replaced or modified.
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`,
+		file.ModTime.UnixNano(), file.Size))
+	http.ServeContent(w, r, file.Name, file.ModTime, file)
+}
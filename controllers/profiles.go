@@ -0,0 +1,176 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+
+	"muto/context"
+	"muto/models"
+	"muto/views"
+
+	"github.com/gorilla/mux"
+)
+
+func NewProfiles(ps models.ProfileService, gs models.GalleryService, is models.ImageService) *Profiles {
+	return &Profiles{
+		ShowView: views.NewView("materialize", "profiles/show"),
+		EditView: views.NewView("materialize", "profiles/edit"),
+		ps:       ps,
+		gs:       gs,
+		is:       is,
+	}
+}
+
+type Profiles struct {
+	ShowView *views.View
+	EditView *views.View
+	ps       models.ProfileService
+	gs       models.GalleryService
+	is       models.ImageService
+}
+
+type ProfileForm struct {
+	Username    string `schema:"username"`
+	DisplayName string `schema:"display_name"`
+	Bio         string `schema:"bio"`
+}
+
+// ProfileData is used to render a public profile page.
+type ProfileData struct {
+	Profile   *models.Profile
+	Galleries []models.Gallery
+}
+
+// GET /u/:username
+func (p *Profiles) Show(w http.ResponseWriter, r *http.Request) {
+	profile, err := p.ps.ByUsername(mux.Vars(r)["username"])
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Profile not found", http.StatusNotFound)
+		default:
+			log.Println(err)
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		}
+		return
+	}
+	galleries, err := p.gs.ByAccountID(profile.AccountID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	// Only public galleries are listed, even for the owner, so
+	// the page looks the same to everyone.
+	var public []models.Gallery
+	for _, gallery := range galleries {
+		if gallery.Visibility == models.VisibilityPublic {
+			public = append(public, gallery)
+		}
+	}
+	var vd views.Data
+	vd.Yield = ProfileData{
+		Profile:   profile,
+		Galleries: public,
+	}
+	p.ShowView.Render(w, r, vd)
+}
+
+// GET /account/profile
+func (p *Profiles) Edit(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	profile, err := p.accountProfile(r)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = profile
+	p.EditView.Render(w, r, vd)
+}
+
+// Update creates the profile the first time it is saved and
+// updates it after that. An avatar can be uploaded with the form.
+// The old avatar is only removed once the profile is saved, so a
+// profile that fails to validate keeps the avatar it had.
+// POST /account/profile
+func (p *Profiles) Update(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	profile, err := p.accountProfile(r)
+	if err != nil {
+		vd.SetAlert(err)
+		p.EditView.Render(w, r, vd)
+		return
+	}
+	vd.Yield = profile
+
+	if err := r.ParseMultipartForm(maxMultipartMem); err != nil {
+		vd.SetAlert(uploadError(err))
+		p.EditView.Render(w, r, vd)
+		return
+	}
+	var form ProfileForm
+	if err := parseValues(r.MultipartForm.Value, &form); err != nil {
+		vd.SetAlert(err)
+		p.EditView.Render(w, r, vd)
+		return
+	}
+	profile.Username = form.Username
+	profile.DisplayName = form.DisplayName
+	profile.Bio = form.Bio
+	avatar := profile.Avatar
+
+	if files := r.MultipartForm.File["avatar"]; len(files) > 0 {
+		file, err := files[0].Open()
+		if err != nil {
+			vd.SetAlert(err)
+			p.EditView.Render(w, r, vd)
+			return
+		}
+		defer file.Close()
+		profile.Avatar, err = p.is.CreateAvatar(profile.AccountID, file)
+		if err != nil {
+			profile.Avatar = avatar
+			vd.SetAlert(err)
+			p.EditView.Render(w, r, vd)
+			return
+		}
+	}
+
+	if profile.ID == 0 {
+		err = p.ps.Create(profile)
+	} else {
+		err = p.ps.Update(profile)
+	}
+	if err != nil {
+		if profile.Avatar != avatar {
+			// Drop the new avatar and go on showing the old one.
+			profile.Avatar = avatar
+			if err := p.is.PruneAvatars(profile.AccountID, avatar); err != nil {
+				log.Println(err)
+			}
+		}
+		vd.SetAlert(err)
+		p.EditView.Render(w, r, vd)
+		return
+	}
+	if profile.Avatar != avatar {
+		if err := p.is.PruneAvatars(profile.AccountID, profile.Avatar); err != nil {
+			log.Println(err)
+		}
+	}
+	http.Redirect(w, r, "/u/"+profile.Username, http.StatusFound)
+}
+
+// accountProfile returns the current account's profile, or a new
+// unsaved one if the account hasn't created a profile yet.
+func (p *Profiles) accountProfile(r *http.Request) (*models.Profile, error) {
+	account := context.Account(r.Context())
+	profile, err := p.ps.ByAccountID(account.ID)
+	switch err {
+	case nil:
+		return profile, nil
+	case models.ErrNotFound:
+		return &models.Profile{AccountID: account.ID}, nil
+	default:
+		return &models.Profile{AccountID: account.ID}, err
+	}
+}
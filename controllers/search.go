@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"muto/context"
+	"muto/models"
+	"muto/views"
+)
+
+func NewSearch(ss models.SearchService) *Search {
+	return &Search{
+		IndexView: views.NewView("materialize", "search/index"),
+		ss:        ss,
+	}
+}
+
+type Search struct {
+	IndexView *views.View
+	ss        models.SearchService
+}
+
+// SearchForm is the query string of the search page. Tag and
+// category only apply to galleries.
+type SearchForm struct {
+	Query    string `schema:"q"`
+	Kind     string `schema:"kind"`
+	Tag      string `schema:"tag"`
+	Category string `schema:"category"`
+	Page     int    `schema:"page"`
+}
+
+// SearchData is used to render the search page.
+type SearchData struct {
+	Form       SearchForm
+	Results    []models.SearchResult
+	Page       models.PageInfo
+	Categories []models.Category
+}
+
+// PageURL returns the URL of another page of the same search.
+func (sd SearchData) PageURL(page int) string {
+	v := url.Values{}
+	for key, value := range map[string]string{
+		"q":        sd.Form.Query,
+		"kind":     sd.Form.Kind,
+		"tag":      sd.Form.Tag,
+		"category": sd.Form.Category,
+	} {
+		if value != "" {
+			v.Set(key, value)
+		}
+	}
+	v.Set("page", strconv.Itoa(page))
+	return "/search?" + v.Encode()
+}
+
+// GET /search
+func (s *Search) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form SearchForm
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+	}
+	data := SearchData{
+		Form:       form,
+		Categories: models.Categories,
+	}
+	q := models.SearchQuery{
+		Text:     form.Query,
+		Tag:      form.Tag,
+		Category: models.Category(form.Category),
+		Page:     models.Page{Number: form.Page},
+	}
+	switch kind := models.SearchKind(form.Kind); kind {
+	case models.SearchGalleries, models.SearchProfiles:
+		q.Kind = kind
+	}
+	if q.Category != "" && !q.Category.Valid() {
+		q.Category = ""
+	}
+	// Tags and categories only belong to galleries.
+	if q.Tag != "" || q.Category != "" {
+		q.Kind = models.SearchGalleries
+	}
+	if account := context.Account(r.Context()); account != nil {
+		q.ViewerID = account.ID
+	}
+	// Without anything to search for, just show the form.
+	if q.Text != "" || q.Tag != "" || q.Category != "" {
+		results, info, err := s.ss.Search(q)
+		if err != nil {
+			vd.SetAlert(err)
+		}
+		data.Results = results
+		data.Page = info
+	}
+	vd.Yield = data
+	s.IndexView.Render(w, r, vd)
+}
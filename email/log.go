@@ -0,0 +1,28 @@
+package email
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// NewLogMailer returns a Mailer that writes every message to w
+// instead of sending it. Pass os.Stdout while developing, or an
+// *os.File to keep the messages around.
+func NewLogMailer(w io.Writer) Mailer {
+	return &logMailer{w: w}
+}
+
+type logMailer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (m *logMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := fmt.Fprintf(m.w, "----- %s -----\nFrom: %s\nTo: %s\nSubject: %s\n\n%s\n",
+		time.Now().Format(time.RFC3339), msg.From, msg.To, msg.Subject, msg.Text)
+	return err
+}
@@ -0,0 +1,96 @@
+package email
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Message is a single plain text email.
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Text    string
+}
+
+// Mailer is anything that can deliver a Message. We ship an
+// SMTP implementation for production and a log based one for
+// development, so the rest of the app never needs to know
+// which one is in use.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// NewClient creates a Client that builds our emails and
+// hands them off to the provided Mailer. baseURL is used to
+// build absolute links, eg "https://www.muto.world".
+func NewClient(m Mailer, from, baseURL string) *Client {
+	return &Client{
+		mailer:  m,
+		from:    from,
+		baseURL: baseURL,
+	}
+}
+
+// Client knows how to write each of the emails the app sends.
+type Client struct {
+	mailer  Mailer
+	from    string
+	baseURL string
+}
+
+const resetTextTmpl = `Hi there!
+
+It appears that you have requested a password reset. If this was you, please follow the link below to update your password:
+
+%s
+
+If you are asked for a token, please use the following value:
+
+%s
+
+If you didn't request a password reset you can safely ignore this email and your account will not be changed.
+
+Best,
+MUTO Support
+`
+
+// ResetPw emails the password reset link for the provided token.
+func (c *Client) ResetPw(toEmail, token string) error {
+	v := url.Values{}
+	v.Set("token", token)
+	resetURL := c.baseURL + "/reset?" + v.Encode()
+	return c.mailer.Send(Message{
+		From:    c.from,
+		To:      toEmail,
+		Subject: "Instructions for resetting your password",
+		Text:    fmt.Sprintf(resetTextTmpl, resetURL, token),
+	})
+}
+
+const verifyTextTmpl = `Welcome to MUTO!
+
+Please confirm your email address by following the link below:
+
+%s
+
+The link is valid for 48 hours. If it has expired you can request a new one from your account.
+
+If you didn't create an account you can safely ignore this email.
+
+Best,
+MUTO Support
+`
+
+// VerifyEmail emails the link used to confirm an email address.
+func (c *Client) VerifyEmail(toEmail, token string) error {
+	v := url.Values{}
+	v.Set("token", token)
+	verifyURL := c.baseURL + "/verify?" + v.Encode()
+	return c.mailer.Send(Message{
+		From:    c.from,
+		To:      toEmail,
+		Subject: "Please confirm your email address",
+		Text:    fmt.Sprintf(verifyTextTmpl, verifyURL),
+	})
+}
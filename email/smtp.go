@@ -0,0 +1,39 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+)
+
+// NewSMTPMailer returns a Mailer that delivers messages through
+// the SMTP server at host:port. If username is empty no
+// authentication is attempted.
+func NewSMTPMailer(host string, port int, username, password string) Mailer {
+	m := &smtpMailer{
+		addr: net.JoinHostPort(host, strconv.Itoa(port)),
+	}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+}
+
+func (m *smtpMailer) Send(msg Message) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", msg.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", msg.Subject)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(msg.Text)
+	return smtp.SendMail(m.addr, m.auth, msg.From, []string{msg.To}, buf.Bytes())
+}
@@ -0,0 +1,66 @@
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+
+	"muto/rand"
+)
+
+var errCiphertext = errors.New("encrypt: ciphertext is too short")
+
+// NewAESGCM creates and returns a new AESGCM object. The key can
+// be any string; it is stretched to a 256 bit AES key with SHA-256.
+func NewAESGCM(key string) AESGCM {
+	k := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		// A 32 byte key is always valid for AES.
+		panic(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return AESGCM{
+		gcm: gcm,
+	}
+}
+
+// AESGCM is a wrapper around crypto/cipher making it easy to
+// encrypt small secrets before storing them in the database.
+type AESGCM struct {
+	gcm cipher.AEAD
+}
+
+// Encrypt seals the plaintext with a random nonce and returns
+// the base64 URL encoded nonce and ciphertext.
+func (a AESGCM) Encrypt(plaintext string) (string, error) {
+	nonce, err := rand.Bytes(a.gcm.NonceSize())
+	if err != nil {
+		return "", err
+	}
+	b := a.gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+// Decrypt reverses Encrypt, returning an error if the value was
+// tampered with or encrypted using a different key.
+func (a AESGCM) Decrypt(ciphertext string) (string, error) {
+	b, err := base64.URLEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	n := a.gcm.NonceSize()
+	if len(b) < n {
+		return "", errCiphertext
+	}
+	plain, err := a.gcm.Open(nil, b[:n], b[n:], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
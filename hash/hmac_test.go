@@ -0,0 +1,37 @@
+package hash
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestHMACConcurrent(t *testing.T) {
+	h := NewHMAC("secret")
+	want := make(map[string]string)
+	for i := 0; i < 16; i++ {
+		input := fmt.Sprintf("input %d", i)
+		want[input] = h.Hash(input)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan string, 64)
+	for g := 0; g < 64; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				for input, hash := range want {
+					if got := h.Hash(input); got != hash {
+						errs <- fmt.Sprintf("Hash(%q) = %q, want %q", input, got, hash)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -4,10 +4,14 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"muto/controllers"
+	"muto/email"
 	"muto/middleware"
 	"muto/models"
+	"muto/openapi"
+	"muto/policy"
 	"muto/rand"
 
 	"github.com/gorilla/csrf"
@@ -19,6 +23,8 @@ func main() {
 	boolPtr := flag.Bool("prod", false, "Provide this flag "+
 		"in production. This ensures that a .config file is "+
 		"provided before the application starts.")
+	promotePtr := flag.String("promote", "", "Give the account with "+
+		"this email address the admin role and exit.")
 	flag.Parse()
 	// Configuartion Information.
 	// boolPtr is a pointer to a boolean, so we need to use
@@ -26,6 +32,10 @@ func main() {
 	// into our LoadConfig function.
 	cfg := LoadConfig(*boolPtr)
 	dbCfg := cfg.Database
+	store, err := cfg.Storage.BlobStore()
+	if err != nil {
+		panic(err)
+	}
 	// Create a service, check for errors,
 	// defer close until main func exits,
 	// and call the AutoMigrate function.
@@ -35,7 +45,15 @@ func main() {
 		models.WithLogMode(!cfg.IsProd()),
 		models.WithAccount(cfg.Pepper, cfg.HMACKey),
 		models.WithGallery(),
-		models.WithImage(),
+		models.WithImage(store),
+		models.WithSession(cfg.HMACKey),
+		models.WithTwoFactor(cfg.HMACKey, cfg.TOTPKey),
+		models.WithLoginThrottle(cfg.LoginThrottle),
+		models.WithProfile(),
+		models.WithAPIToken(cfg.HMACKey),
+		models.WithGalleryShare(cfg.Pepper, cfg.HMACKey),
+		models.WithSearch(cfg.Search),
+		models.WithExport(),
 	)
 
 	if err != nil {
@@ -43,30 +61,98 @@ func main() {
 	}
 
 	defer services.Close()
-	services.AutoMigrate()
+	if err := services.AutoMigrate(); err != nil {
+		panic(err)
+	}
+
+	// Promote the first admin from the command line. After that
+	// roles can be managed from inside the app.
+	if *promotePtr != "" {
+		account, err := services.Account.ByEmail(*promotePtr)
+		if err != nil {
+			panic(err)
+		}
+		account.Role = models.RoleAdmin
+		if err := services.Account.Update(account); err != nil {
+			panic(err)
+		}
+		fmt.Printf("%s is now an admin.\n", account.Email)
+		return
+	}
+
+	// The memory index starts out empty, and the database may
+	// have changed since the Postgres index was last updated.
+	if err := services.Search.Reindex(); err != nil {
+		panic(err)
+	}
+
+	// Mailer
+	mailer, err := cfg.Mailer.Mailer()
+	if err != nil {
+		panic(err)
+	}
+	emailer := email.NewClient(mailer, cfg.Mailer.From, cfg.BaseURL)
 
 	// Controllers
 	r := mux.NewRouter()
 	staticC := controllers.NewStatic()
-	accountsC := controllers.NewAccounts(services.Account)
-	galleriesC := controllers.NewGalleries(services.Gallery, services.Image, r)
+	accountsC := controllers.NewAccounts(services.Account,
+		services.Session, services.TwoFactor, services.LoginThrottle,
+		services.Profile, services.Gallery, services.Image,
+		services.Export, services.APIToken, emailer)
+	galleriesC := controllers.NewGalleries(services.Gallery, services.Image,
+		services.GalleryShare, services.LoginThrottle, r)
+	imagesC := controllers.NewImages(services.Gallery, services.Image,
+		services.GalleryShare)
+	profilesC := controllers.NewProfiles(services.Profile, services.Gallery, services.Image)
+	searchC := controllers.NewSearch(services.Search)
+	apiTokensC := controllers.NewAPITokens(services.APIToken)
+	apiC := controllers.NewAPI(services.Gallery, services.Image)
+	adminC := controllers.NewAdmin(services.Account, services.Session,
+		services.Gallery, services.Image)
 
 	// Middleware - Check Account Logged In
 	AccountMw := middleware.Account{
-		AccountService: services.Account,
+		AccountService:  services.Account,
+		SessionService:  services.Session,
+		APITokenService: services.APIToken,
 	}
 
 	// Middleware - Require Account Logged In
 	requireAccountMw := middleware.RequireAccount{}
 
+	// Middleware - Require Verified Email Address
+	requireVerifiedMw := middleware.RequireVerified{}
+
+	// Middleware - Require Admin Role
+	requireAdminMw := middleware.RequireAdmin{}
+
+	// Middleware - Load Gallery & Authorize Action
+	galleryMw := func(action policy.Action) *middleware.Gallery {
+		return &middleware.Gallery{
+			GalleryService: services.Gallery,
+			ImageService:   services.Image,
+			Action:         action,
+		}
+	}
+
 	// Asset Routes
 	assetHandler := http.FileServer(http.Dir("./assets/"))
 	assetHandler = http.StripPrefix("/assets/", assetHandler)
 	r.PathPrefix("/assets/").Handler(assetHandler)
 
 	// Image Routes
-	imageHandler := http.FileServer(http.Dir("./images/"))
-	r.PathPrefix("/images/").Handler(http.StripPrefix("/images/", imageHandler))
+	// Gallery images are only served to those who can view the
+	// gallery they belong to, or who opened it with a share link.
+	r.HandleFunc("/images/galleries/{id:[0-9]+}/{filename}",
+		imagesC.Show).
+		Methods("GET", "HEAD")
+	r.HandleFunc("/images/galleries/{id:[0-9]+}/{size:[a-z]+}/{filename}",
+		imagesC.Show).
+		Methods("GET", "HEAD")
+	r.HandleFunc("/images/avatars/{id:[0-9]+}/{filename}",
+		imagesC.Avatar).
+		Methods("GET", "HEAD")
 
 	// Static Routes
 	r.Handle("/", staticC.LandingView).Methods("GET")
@@ -80,39 +166,175 @@ func main() {
 	r.HandleFunc("/register", accountsC.Create).Methods("POST")
 	r.Handle("/enter", accountsC.LoginView).Methods("GET")
 	r.HandleFunc("/enter", accountsC.Login).Methods("POST")
+	r.Handle("/enter/2fa", accountsC.TwoFactorLoginView).Methods("GET")
+	r.HandleFunc("/enter/2fa", accountsC.LoginTwoFactor).Methods("POST")
+	r.Handle("/forgot", accountsC.ForgotPwView).Methods("GET")
+	r.HandleFunc("/forgot", accountsC.InitiateReset).Methods("POST")
+	r.HandleFunc("/reset", accountsC.ResetPw).Methods("GET")
+	r.HandleFunc("/reset", accountsC.CompleteReset).Methods("POST")
+	r.HandleFunc("/verify", accountsC.Verify).Methods("GET")
+	r.HandleFunc("/verify/resend",
+		requireAccountMw.ApplyFn(accountsC.ResendVerification)).
+		Methods("POST")
+	r.HandleFunc("/logout",
+		requireAccountMw.ApplyFn(accountsC.Logout)).
+		Methods("POST")
+	r.HandleFunc("/account",
+		requireAccountMw.ApplyFn(accountsC.Settings)).
+		Methods("GET")
+	r.HandleFunc("/account/email",
+		requireAccountMw.ApplyFn(accountsC.ChangeEmail)).
+		Methods("POST")
+	r.HandleFunc("/account/password",
+		requireAccountMw.ApplyFn(accountsC.ChangePassword)).
+		Methods("POST")
+	r.HandleFunc("/account/export",
+		requireAccountMw.ApplyFn(accountsC.Export)).
+		Methods("GET")
+	r.HandleFunc("/account/delete",
+		requireAccountMw.ApplyFn(accountsC.DeleteAccount)).
+		Methods("POST")
+	r.HandleFunc("/account/2fa",
+		requireAccountMw.ApplyFn(accountsC.TwoFactor)).
+		Methods("GET")
+	r.HandleFunc("/account/2fa/enable",
+		requireAccountMw.ApplyFn(accountsC.EnableTwoFactor)).
+		Methods("POST")
+	r.HandleFunc("/account/2fa/disable",
+		requireAccountMw.ApplyFn(accountsC.DisableTwoFactor)).
+		Methods("POST")
+	r.HandleFunc("/account/sessions",
+		requireAccountMw.ApplyFn(accountsC.Sessions)).
+		Methods("GET")
+	r.HandleFunc("/account/sessions/revoke",
+		requireAccountMw.ApplyFn(accountsC.RevokeAllSessions)).
+		Methods("POST")
+	r.HandleFunc("/account/sessions/{id:[0-9]+}/revoke",
+		requireAccountMw.ApplyFn(accountsC.RevokeSession)).
+		Methods("POST")
+	r.HandleFunc("/account/tokens",
+		requireAccountMw.ApplyFn(apiTokensC.Index)).
+		Methods("GET")
+	r.HandleFunc("/account/tokens",
+		requireAccountMw.ApplyFn(apiTokensC.Create)).
+		Methods("POST")
+	r.HandleFunc("/account/tokens/{id:[0-9]+}/revoke",
+		requireAccountMw.ApplyFn(apiTokensC.Revoke)).
+		Methods("POST")
 	r.HandleFunc("/cookietest", accountsC.CookieTest).Methods("GET")
 
+	// Profile Routes
+	r.HandleFunc("/u/{username}", profilesC.Show).Methods("GET")
+	r.HandleFunc("/account/profile",
+		requireAccountMw.ApplyFn(profilesC.Edit)).
+		Methods("GET")
+	r.HandleFunc("/account/profile",
+		requireAccountMw.ApplyFn(profilesC.Update)).
+		Methods("POST")
+
 	// Gallery Routes
 	r.Handle("/galleries/new",
-		requireAccountMw.Apply(galleriesC.New)).
+		requireVerifiedMw.Apply(galleriesC.New)).
 		Methods("GET")
 	r.Handle("/galleries",
-		requireAccountMw.ApplyFn(galleriesC.Create)).
+		requireVerifiedMw.ApplyFn(galleriesC.Create)).
 		Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}",
-		galleriesC.Show).
+		galleryMw(policy.ViewGallery).ApplyFn(galleriesC.Show)).
 		Methods("GET").
 		Name(controllers.ShowGallery)
 	r.HandleFunc("/galleries/{id:[0-9]+}/edit",
-		requireAccountMw.ApplyFn(galleriesC.Edit)).
+		requireAccountMw.ApplyFn(
+			galleryMw(policy.EditGallery).ApplyFn(galleriesC.Edit))).
 		Methods("GET").
 		Name(controllers.EditGallery)
 	r.HandleFunc("/galleries/{id:[0-9]+}/update",
-		requireAccountMw.ApplyFn(galleriesC.Update)).
+		requireAccountMw.ApplyFn(
+			galleryMw(policy.EditGallery).ApplyFn(galleriesC.Update))).
 		Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}/delete",
-		requireAccountMw.ApplyFn(galleriesC.Delete)).
+		requireAccountMw.ApplyFn(
+			galleryMw(policy.DeleteGallery).ApplyFn(galleriesC.Delete))).
 		Methods("POST")
 	r.HandleFunc("/galleries",
 		requireAccountMw.ApplyFn(galleriesC.Index)).
 		Methods("GET").
 		Name(controllers.IndexGalleries)
 	r.HandleFunc("/galleries/{id:[0-9]+}/images",
-		requireAccountMw.ApplyFn(galleriesC.ImageUpload)).
+		requireVerifiedMw.ApplyFn(
+			galleryMw(policy.UploadImage).ApplyFn(galleriesC.ImageUpload))).
 		Methods("POST")
-	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete",
-		requireAccountMw.ApplyFn(galleriesC.ImageDelete)).
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{image_id:[0-9]+}/delete",
+		requireAccountMw.ApplyFn(
+			galleryMw(policy.DeleteImage).ApplyFn(galleriesC.ImageDelete))).
 		Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/shares",
+		requireAccountMw.ApplyFn(
+			galleryMw(policy.EditGallery).ApplyFn(galleriesC.ShareCreate))).
+		Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/shares/{share:[0-9]+}/revoke",
+		requireAccountMw.ApplyFn(
+			galleryMw(policy.EditGallery).ApplyFn(galleriesC.ShareRevoke))).
+		Methods("POST")
+
+	// Browse Routes
+	r.HandleFunc("/tags/{tag}", galleriesC.Tag).Methods("GET")
+	r.HandleFunc("/categories/{category}", galleriesC.Category).Methods("GET")
+
+	// Search Routes
+	r.HandleFunc("/search", searchC.Index).Methods("GET")
+
+	// Unlisted Gallery Routes
+	r.HandleFunc("/g/{slug}", galleriesC.Unlisted).Methods("GET")
+
+	// Share Link Routes
+	r.HandleFunc("/s/{token}", galleriesC.Shared).Methods("GET")
+	r.HandleFunc("/s/{token}", galleriesC.SharedUnlock).Methods("POST")
+
+	// Admin Routes
+	r.Handle("/admin",
+		requireAdminMw.Apply(http.RedirectHandler("/admin/accounts",
+			http.StatusFound))).
+		Methods("GET")
+	r.HandleFunc("/admin/accounts",
+		requireAdminMw.ApplyFn(adminC.Accounts)).
+		Methods("GET")
+	r.HandleFunc("/admin/accounts/{id:[0-9]+}",
+		requireAdminMw.ApplyFn(adminC.Account)).
+		Methods("GET")
+	r.HandleFunc("/admin/accounts/{id:[0-9]+}/disable",
+		requireAdminMw.ApplyFn(adminC.Disable)).
+		Methods("POST")
+	r.HandleFunc("/admin/accounts/{id:[0-9]+}/enable",
+		requireAdminMw.ApplyFn(adminC.Enable)).
+		Methods("POST")
+	r.HandleFunc("/admin/accounts/{id:[0-9]+}/logout",
+		requireAdminMw.ApplyFn(adminC.Logout)).
+		Methods("POST")
+	r.HandleFunc("/admin/accounts/{id:[0-9]+}/role",
+		requireAdminMw.ApplyFn(adminC.Role)).
+		Methods("POST")
+	r.HandleFunc("/admin/galleries",
+		requireAdminMw.ApplyFn(adminC.Galleries)).
+		Methods("GET")
+	r.HandleFunc("/admin/galleries/{id:[0-9]+}/delete",
+		requireAdminMw.ApplyFn(
+			galleryMw(policy.DeleteGallery).ApplyFn(adminC.DeleteGallery))).
+		Methods("POST")
+
+	// API Routes
+	apiC.Routes(r)
+
+	// API Documentation
+	// Building the spec fails when a route under /api/v1 is missing
+	// from apiC.Operations, so the app won't start with an
+	// undocumented API route.
+	spec, err := openapi.Build(r, controllers.APIPrefix,
+		controllers.APIInfo, apiC.Operations())
+	if err != nil {
+		panic(err)
+	}
+	r.Handle("/api/openapi.json", openapi.Handler(spec)).Methods("GET")
 
 	b, err := rand.Bytes(32)
 	if err != nil {
@@ -121,10 +343,25 @@ func main() {
 
 	// CSRF Protection
 	csrfMw := csrf.Protect(b, csrf.Secure(cfg.IsProd()))
+	appHandler := AccountMw.Apply(r)
+	csrfHandler := csrfMw(appHandler)
+	// API requests are authenticated with bearer tokens and never
+	// with cookies, so they skip the CSRF check.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			appHandler.ServeHTTP(w, r)
+			return
+		}
+		csrfHandler.ServeHTTP(w, r)
+	})
+	// No request may be larger than an upload. The limit has to be
+	// in place before the CSRF check reads the body.
+	limitBodyMw := middleware.LimitBody{Limit: models.MaxUploadSize}
+	handler = limitBodyMw.Apply(handler)
 
 	// Server Messages / Listen & Serve
 	fmt.Printf("Starting the server on Port:%d...\n", cfg.Port)
 	fmt.Println("Success! Application Compiled.")
 	fmt.Println("Application Running...")
-	http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), csrfMw(AccountMw.Apply(r)))
+	http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), handler)
 }
@@ -0,0 +1,33 @@
+// Package markdown turns user written markdown into HTML that is
+// safe to put on a page.
+package markdown
+
+import (
+	"html/template"
+	"regexp"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/russross/blackfriday/v2"
+)
+
+// policy allows the markup markdown produces for user content,
+// such as links, lists, emphasis and code, and nothing else.
+// Links get rel="nofollow" so spam doesn't pay.
+var policy = bluemonday.UGCPolicy()
+
+// htmlTag matches raw HTML tags, but not markdown autolinks like
+// <https://muto.world>.
+var htmlTag = regexp.MustCompile(`<(/?[a-zA-Z][a-zA-Z0-9]*)(\s|/?>)`)
+
+// Render converts markdown to sanitised HTML.
+func Render(src string) template.HTML {
+	unsafe := blackfriday.Run([]byte(src))
+	return template.HTML(policy.SanitizeBytes(unsafe))
+}
+
+// HasHTML reports whether src contains raw HTML tags. Render
+// would strip anything unsafe, but we'd rather tell people their
+// markup won't show up than silently drop it.
+func HasHTML(src string) bool {
+	return htmlTag.MatchString(src)
+}
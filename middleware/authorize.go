@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"muto/context"
+	"muto/models"
+	"muto/policy"
+
+	"github.com/gorilla/mux"
+)
+
+// Gallery looks up the gallery named by the "id" route variable,
+// checks with the policy package that the current account may
+// perform Action on it and stores it in the request context for
+// the next handler.
+//
+// Missing galleries, and galleries the account isn't allowed to
+// see, get a 404. Galleries the account can see but not perform
+// Action on get a 403. This middleware assumes the Account
+// middleware has already been run.
+type Gallery struct {
+	models.GalleryService
+	models.ImageService
+	Action policy.Action
+}
+
+func (mw *Gallery) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *Gallery) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+			return
+		}
+		gallery, err := mw.GalleryService.ByID(uint(id))
+		switch err {
+		case nil:
+		case models.ErrNotFound:
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+			return
+		default:
+			log.Println(err)
+			http.Error(w, "Something went wrong.",
+				http.StatusInternalServerError)
+			return
+		}
+
+		account := context.Account(r.Context())
+		if !policy.Can(account, policy.ViewGallery, gallery) {
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+			return
+		}
+		if !policy.Can(account, mw.Action, gallery) {
+			http.Error(w, "You do not have permission to do that",
+				http.StatusForbidden)
+			return
+		}
+
+		images, err := mw.ImageService.ByGalleryID(gallery.ID)
+		if err != nil {
+			log.Println(err)
+		}
+		gallery.Images = images
+		next(w, r.WithContext(context.WithGallery(r.Context(), gallery)))
+	})
+}
+
+// RequireAdmin only lets admins through. Everyone else gets a
+// 404 so the admin console doesn't advertise itself. Like
+// RequireAccount it assumes the Account middleware has run.
+type RequireAdmin struct{}
+
+func (mw *RequireAdmin) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *RequireAdmin) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		account := context.Account(r.Context())
+		if !policy.Can(account, policy.UseAdmin, nil) {
+			http.NotFound(w, r)
+			return
+		}
+		next(w, r)
+	})
+}
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"net/http"
+
+	"muto/models"
+)
+
+// LimitBody caps the size of request bodies at Limit bytes. It has
+// to run before the CSRF check, which parses the form, multipart
+// uploads included, to find its token before any of our handlers
+// get a chance to limit the body themselves.
+//
+// Bodies that say up front they are too large get a 413 straight
+// away. Anything else stops being read at the limit, and the
+// handler parsing it gets an *http.MaxBytesError.
+type LimitBody struct {
+	Limit int64
+}
+
+func (mw *LimitBody) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *LimitBody) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > mw.Limit {
+			http.Error(w, models.ErrUploadTooLarge.Public(),
+				http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, mw.Limit)
+		next(w, r)
+	})
+}
@@ -3,19 +3,30 @@ package middleware
 import (
 	"net/http"
 	"strings"
+	"time"
 
 	"muto/context"
 	"muto/models"
 )
 
 // User middleware will lookup the current user via their
-// remember_token cookie using the UserService. If the user
-// is found, they will be set on the request context.
+// remember_token cookie using the SessionService. If the session
+// and user are found, they will be set on the request context.
 // Regardless, the next handler is always called.
+//
+// Requests under /api/ are authenticated with an API token in the
+// Authorization header instead, and never with the cookie, so the
+// API doesn't need CSRF protection.
 type Account struct {
 	models.AccountService
+	models.SessionService
+	models.APITokenService
 }
 
+// lastSeenInterval limits how often we write a session's
+// LastSeenAt back to the database.
+const lastSeenInterval = time.Minute
+
 func (mw *Account) Apply(next http.Handler) http.HandlerFunc {
 	return mw.ApplyFn(next.ServeHTTP)
 }
@@ -27,32 +38,50 @@ func (mw *Account) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		path := r.URL.Path
 		// If account is requesting a static assets
-		// or image we will not need to lookup
-		// current account, so we can skip it.
-		if strings.HasPrefix(path, "/assets/") ||
-			strings.HasPrefix(path, "/images/") {
+		// we will not need to lookup current account,
+		// so we can skip it. Images are not skipped, as
+		// those of private galleries are only served to
+		// accounts that can view them.
+		if strings.HasPrefix(path, "/assets/") {
 			next(w, r)
 			return
 		}
 
+		if strings.HasPrefix(path, "/api/") {
+			mw.applyToken(next, w, r)
+			return
+		}
+
 		cookie, err := r.Cookie("remember_token")
 		if err != nil {
 			next(w, r)
 			return
 		}
 
-		account, err := mw.AccountService.ByRemember(cookie.Value)
+		session, err := mw.SessionService.ByRemember(cookie.Value)
 		if err != nil {
 			next(w, r)
 			return
 		}
 
+		account, err := mw.AccountService.ByID(session.AccountID)
+		if err != nil || account.Disabled() {
+			next(w, r)
+			return
+		}
+
+		if time.Since(session.LastSeenAt) > lastSeenInterval {
+			session.LastSeenAt = time.Now()
+			mw.SessionService.Update(session)
+		}
+
 		// Get the context from our request.
 		ctx := r.Context()
 		// Create a new context from the existing one
 		// that has our account stored in it
 		// with the private account key.
 		ctx = context.WithAccount(ctx, account)
+		ctx = context.WithSession(ctx, session)
 		// Create a new request from the existing one
 		// with our context attached to it and assign it back to 'r'.
 		r = r.WithContext(ctx)
@@ -61,6 +90,35 @@ func (mw *Account) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	})
 }
 
+// applyToken looks up the account for a bearer token, eg
+// "Authorization: Bearer muto_...". As with cookies, a missing or
+// bad token leaves the request anonymous.
+func (mw *Account) applyToken(next http.HandlerFunc, w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		next(w, r)
+		return
+	}
+	token, err := mw.APITokenService.ByToken(strings.TrimPrefix(auth, "Bearer "))
+	if err != nil {
+		next(w, r)
+		return
+	}
+	account, err := mw.AccountService.ByID(token.AccountID)
+	if err != nil || account.Disabled() {
+		next(w, r)
+		return
+	}
+	now := time.Now()
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > lastSeenInterval {
+		token.LastUsedAt = &now
+		mw.APITokenService.Update(token)
+	}
+	ctx := context.WithAccount(r.Context(), account)
+	ctx = context.WithAPIToken(ctx, token)
+	next(w, r.WithContext(ctx))
+}
+
 // RequireUser will redirect a user to the /login page
 // if they are not logged in. This middleware assumes
 // that User middleware has already been run, otherwise
@@ -81,3 +139,28 @@ func (mw *RequireAccount) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 		next(w, r)
 	})
 }
+
+// RequireVerified will redirect an account to the /verify page
+// if it has not confirmed its email address yet. Like
+// RequireAccount it assumes that the Account middleware has
+// already been run, and guests are sent to the /enter page.
+type RequireVerified struct{}
+
+func (mw *RequireVerified) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *RequireVerified) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		account := context.Account(r.Context())
+		if account == nil {
+			http.Redirect(w, r, "/enter", http.StatusFound)
+			return
+		}
+		if !account.Verified() {
+			http.Redirect(w, r, "/verify", http.StatusFound)
+			return
+		}
+		next(w, r)
+	})
+}
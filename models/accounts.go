@@ -1,11 +1,13 @@
 package models
 
 import (
+	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"muto/hash"
-	"muto/rand"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
@@ -26,6 +28,21 @@ const (
 	ErrPasswordRequired  modelError = "models: password is required"
 	ErrRememberRequired  modelError = "models: remember token is required"
 	ErrRememberTooShort  modelError = "models: remember token must be at least 32 bytes"
+	ErrTokenInvalid      modelError = "models: token provided is not valid"
+	ErrRoleInvalid       modelError = "models: role must be user, moderator or admin"
+	ErrAccountDisabled   modelError = "models: this account has been disabled"
+)
+
+// dummyPasswordHash is compared against when no account exists for
+// an email address, so a failed sign in takes just as long whether
+// or not the address is registered.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword(
+	[]byte("muto-dummy-password"), bcrypt.DefaultCost)
+
+const (
+	// verifyEmailDuration is how long an email verification
+	// link stays valid.
+	verifyEmailDuration = 48 * time.Hour
 )
 
 // Test to verify accountGorm implements the AccountDB interface.
@@ -44,6 +61,22 @@ type AccountService interface {
 	// ErrNotFound, ErrPasswordIncorrect, or related error if something else.
 	// *Reference accountService "Authenticate" func for more detail on errors.
 	Authenticate(email, password string) (*Account, error)
+	// InitiateReset will start the reset password process
+	// by creating a reset token for the account found with the
+	// provided email address. It returns the account along with
+	// the token, so the link goes to the address on file.
+	InitiateReset(email string) (*Account, string, error)
+	// CompleteReset will use the token to find the account and
+	// update its password. Tokens can only be used once and
+	// expire after pwResetDuration.
+	CompleteReset(token, newPw string) (*Account, error)
+	// VerifyEmailToken returns a signed token proving the
+	// account owns its current email address.
+	VerifyEmailToken(account *Account) string
+	// VerifyEmail will mark the account the token was created
+	// for as verified. Tokens are only valid for the email
+	// address they were created with.
+	VerifyEmail(token string) (*Account, error)
 	AccountDB
 }
 
@@ -52,7 +85,11 @@ type AccountDB interface {
 	// Methods for querying single accounts
 	ByID(id uint) (*Account, error)
 	ByEmail(email string) (*Account, error)
-	ByRemember(token string) (*Account, error)
+
+	// List returns one page of accounts whose email address
+	// contains query, oldest first, and how many match in total.
+	// An empty query lists every account.
+	List(query string, page Page) ([]Account, PageInfo, error)
 
 	// Methods for altering accounts
 	Create(account *Account) error
@@ -60,13 +97,45 @@ type AccountDB interface {
 	Delete(id uint) error
 }
 
+// Role decides what an account may do with content that
+// belongs to other accounts. See the policy package.
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
 type Account struct {
 	gorm.Model
-	Email        string `gorm:"not null;unique_index"`
-	Password     string `gorm:"-"`
-	PasswordHash string `gorm:"not null"`
-	Remember     string `gorm:"-"`
-	RememberHash string `gorm:"not null;unique_index"`
+	Email           string `gorm:"not null;unique_index"`
+	EmailVerifiedAt *time.Time
+	Password        string `gorm:"-"`
+	PasswordHash    string `gorm:"not null"`
+	Role            Role   `gorm:"not null;default:'user'"`
+	DisabledAt      *time.Time
+	TOTPSecretEnc   string
+	TOTPEnabledAt   *time.Time
+	TOTPLastStep    int64
+}
+
+// TwoFactorEnabled reports whether signing in to the account
+// requires a TOTP code.
+func (a *Account) TwoFactorEnabled() bool {
+	return a.TOTPEnabledAt != nil
+}
+
+// Disabled reports whether an admin has disabled the account.
+// Disabled accounts can't sign in.
+func (a *Account) Disabled() bool {
+	return a.DisabledAt != nil
+}
+
+// Verified reports whether the account has confirmed
+// its email address.
+func (a *Account) Verified() bool {
+	return a.EmailVerifiedAt != nil
 }
 
 // accountGorm represents our database interaction layer
@@ -97,12 +166,16 @@ func NewAccountService(db *gorm.DB, pepper, hmacKey string) AccountService {
 	return &accountService{
 		AccountDB: av,
 		pepper:    pepper,
+		hmac:      hmac,
+		pwResetDB: newPwResetValidator(&pwResetGorm{db}, hmac),
 	}
 }
 
 type accountService struct {
 	AccountDB
-	pepper string
+	pepper    string
+	hmac      hash.HMAC
+	pwResetDB pwResetDB
 }
 
 func newAccountValidator(adb AccountDB, hmac hash.HMAC, pepper string) *accountValidator {
@@ -138,6 +211,10 @@ func (as *accountService) Authenticate(email, password string) (*Account, error)
 	// Locate account via email.
 	foundAccount, err := as.ByEmail(email)
 	if err != nil {
+		if err == ErrNotFound {
+			bcrypt.CompareHashAndPassword(dummyPasswordHash,
+				[]byte(password+as.pepper))
+		}
 		return nil, err
 	}
 
@@ -149,6 +226,11 @@ func (as *accountService) Authenticate(email, password string) (*Account, error)
 	// Handle errors for each outcome.
 	switch err {
 	case nil:
+		// Only admit the account is disabled to someone who
+		// knows its password.
+		if foundAccount.Disabled() {
+			return nil, ErrAccountDisabled
+		}
 		return foundAccount, nil
 	case bcrypt.ErrMismatchedHashAndPassword:
 		return nil, ErrPasswordIncorrect
@@ -157,6 +239,93 @@ func (as *accountService) Authenticate(email, password string) (*Account, error)
 	}
 }
 
+// InitiateReset creates a password reset token for the account
+// with the provided email address and returns it along with the
+// raw token, which should be emailed to account.Email.
+func (as *accountService) InitiateReset(email string) (*Account, string, error) {
+	account, err := as.ByEmail(email)
+	if err != nil {
+		return nil, "", err
+	}
+	pwr := pwReset{
+		AccountID: account.ID,
+	}
+	if err := as.pwResetDB.Create(&pwr); err != nil {
+		return nil, "", err
+	}
+	return account, pwr.Token, nil
+}
+
+// CompleteReset looks up the reset token, sets the new password
+// on its account and then removes every outstanding reset token
+// for that account so none of them can be reused.
+func (as *accountService) CompleteReset(token, newPw string) (*Account, error) {
+	pwr, err := as.pwResetDB.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+	if pwr.Expired() {
+		as.pwResetDB.Delete(pwr.ID)
+		return nil, ErrTokenInvalid
+	}
+	account, err := as.ByID(pwr.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if newPw == "" {
+		return nil, ErrPasswordRequired
+	}
+	account.Password = newPw
+	if err := as.Update(account); err != nil {
+		return nil, err
+	}
+	as.pwResetDB.DeleteByAccountID(account.ID)
+	return account, nil
+}
+
+// VerifyEmailToken signs the account ID and email address
+// so the link only works for the address it was sent to.
+func (as *accountService) VerifyEmailToken(account *Account) string {
+	return signToken(as.hmac, time.Now().Add(verifyEmailDuration),
+		"verify", fmt.Sprint(account.ID), account.Email)
+}
+
+// VerifyEmail checks the token created by VerifyEmailToken and
+// marks the account's email address as verified.
+func (as *accountService) VerifyEmail(token string) (*Account, error) {
+	fields, err := parseSignedToken(as.hmac, token)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) != 3 || fields[0] != "verify" {
+		return nil, ErrTokenInvalid
+	}
+	id, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	account, err := as.ByID(uint(id))
+	if err != nil {
+		return nil, err
+	}
+	if account.Email != fields[2] {
+		// The email address changed since the link was sent.
+		return nil, ErrTokenInvalid
+	}
+	if account.Verified() {
+		return account, nil
+	}
+	now := time.Now()
+	account.EmailVerifiedAt = &now
+	if err := as.Update(account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
 // VALIDATION - bcryptPassword will hash an accounts's password with an
 // app-wide pepper and bcrypt, which salts for us.
 func (av *accountValidator) bcryptPassword(account *Account) error {
@@ -176,28 +345,6 @@ func (av *accountValidator) bcryptPassword(account *Account) error {
 	return nil
 }
 
-// VALIDATION - hmacRemember
-func (av *accountValidator) hmacRemember(account *Account) error {
-	if account.Remember == "" {
-		return nil
-	}
-	account.RememberHash = av.hmac.Hash(account.Remember)
-	return nil
-}
-
-// VALIDATION - setRememberIfUnset
-func (av *accountValidator) setRememberIfUnset(account *Account) error {
-	if account.Remember != "" {
-		return nil
-	}
-	token, err := rand.RememberToken()
-	if err != nil {
-		return nil
-	}
-	account.Remember = token
-	return nil
-}
-
 // VALIDATION - idGreaterThan
 func (av *accountValidator) idGreaterThan(n uint) accountValFn {
 	return accountValFn(func(account *Account) error {
@@ -208,6 +355,25 @@ func (av *accountValidator) idGreaterThan(n uint) accountValFn {
 	})
 }
 
+// VALIDATION - defaultRole gives new accounts the user role
+// unless another one was set.
+func (av *accountValidator) defaultRole(account *Account) error {
+	if account.Role == "" {
+		account.Role = RoleUser
+	}
+	return nil
+}
+
+// VALIDATION - roleValid
+func (av *accountValidator) roleValid(account *Account) error {
+	switch account.Role {
+	case RoleUser, RoleModerator, RoleAdmin:
+		return nil
+	default:
+		return ErrRoleInvalid
+	}
+}
+
 // VALIDATION - normalizeEmail
 func (av *accountValidator) normalizeEmail(account *Account) error {
 	account.Email = strings.ToLower(account.Email)
@@ -284,29 +450,6 @@ func (av *accountValidator) passwordHashRequried(account *Account) error {
 	return nil
 }
 
-// VALIDATION - rememberMinBytes
-func (av *accountValidator) rememberMinBytes(account *Account) error {
-	if account.Remember == "" {
-		return nil
-	}
-	n, err := rand.NBytes(account.Remember)
-	if err != nil {
-		return err
-	}
-	if n < 32 {
-		return ErrRememberTooShort
-	}
-	return nil
-}
-
-// VALIDATION - rememberHashRequired
-func (av *accountValidator) rememberHashRequired(account *Account) error {
-	if account.RememberHash == "" {
-		return ErrEmailRequired
-	}
-	return nil
-}
-
 // VALIDATION -
 type accountValFn func(*Account) error
 
@@ -320,17 +463,6 @@ func runAccountValFns(account *Account, fns ...accountValFn) error {
 	return nil
 }
 
-// VALIDATION - ByRemember will hash the remember token and then call ByRemember on the subsequent AccountDB layer.
-func (av *accountValidator) ByRemember(token string) (*Account, error) {
-	account := Account{
-		Remember: token,
-	}
-	if err := runAccountValFns(&account, av.hmacRemember); err != nil {
-		return nil, err
-	}
-	return av.AccountDB.ByRemember(account.RememberHash)
-}
-
 // VALIDATION - ByEmail will normalize an email address before passing it
 // on to the database layer to perform the query.
 func (av *accountValidator) ByEmail(email string) (*Account, error) {
@@ -352,33 +484,30 @@ func (av *accountValidator) Create(account *Account) error {
 		av.passwordMinLength,
 		av.bcryptPassword,
 		av.passwordHashRequried,
-		av.setRememberIfUnset,
-		av.rememberMinBytes,
-		av.hmacRemember,
-		av.rememberHashRequired,
 		av.normalizeEmail,
 		av.requireEmail,
 		av.emailFormat,
-		av.emailIsAvail)
+		av.emailIsAvail,
+		av.defaultRole,
+		av.roleValid)
 	if err != nil {
 		return err
 	}
 	return av.AccountDB.Create(account)
 }
 
-// VALIDATION - Update will hash a remember token if provided.
+// VALIDATION - Update will hash a new password if provided.
 func (av *accountValidator) Update(account *Account) error {
 	err := runAccountValFns(account,
 		av.passwordMinLength,
 		av.bcryptPassword,
 		av.passwordHashRequried,
-		av.rememberMinBytes,
-		av.hmacRemember,
-		av.rememberHashRequired,
 		av.normalizeEmail,
 		av.requireEmail,
 		av.emailFormat,
-		av.emailIsAvail)
+		av.emailIsAvail,
+		av.defaultRole,
+		av.roleValid)
 	if err != nil {
 		return err
 	}
@@ -391,7 +520,7 @@ func (av *accountValidator) Delete(id uint) error {
 	account.ID = id
 	err := runAccountValFns(&account, av.idGreaterThan(0))
 	if err != nil {
-		return nil
+		return err
 	}
 	return av.AccountDB.Delete(id)
 }
@@ -415,15 +544,21 @@ func (ag *accountGorm) ByEmail(email string) (*Account, error) {
 	return &account, err
 }
 
-// GORM - ByRemember will lookup an account with the provided remember token.
-// This method expects the remember token to already be hashed.
-func (ag *accountGorm) ByRemember(rememberHash string) (*Account, error) {
-	var account Account
-	err := first(ag.db.Where("remember_hash = ?", rememberHash), &account)
-	if err != nil {
-		return nil, err
+// GORM - List
+func (ag *accountGorm) List(query string, page Page) ([]Account, PageInfo, error) {
+	page = page.normalize()
+	info := PageInfo{Page: page}
+	db := ag.db.Model(&Account{})
+	if query != "" {
+		db = db.Where("email LIKE ?", likePattern(strings.ToLower(query)))
 	}
-	return &account, nil
+	if err := db.Count(&info.Total).Error; err != nil {
+		return nil, info, err
+	}
+	var accounts []Account
+	err := db.Order("id").Offset(page.offset()).Limit(page.Size).
+		Find(&accounts).Error
+	return accounts, info, err
 }
 
 // GORM - Create method produces an account and backfills the data.
@@ -436,10 +571,34 @@ func (ag *accountGorm) Update(account *Account) error {
 	return ag.db.Save(account).Error
 }
 
-// GORM - Delete method deletes the account with the provided ID
+// GORM - Delete method permanently deletes the account with the
+// provided ID, along with its galleries, profile, sessions and
+// everything else of the account's in the database, in a single
+// transaction. We skip GORM's soft delete so the account's data is
+// really gone and its email address can be registered again. Files
+// are left for the ImageService to remove.
 func (ag *accountGorm) Delete(id uint) error {
-	account := Account{Model: gorm.Model{ID: id}}
-	return ag.db.Delete(&account).Error
+	return ag.db.Transaction(func(tx *gorm.DB) error {
+		var galleryIDs []uint
+		err := tx.Unscoped().Model(&Gallery{}).Where("account_id = ?", id).
+			Pluck("id", &galleryIDs).Error
+		if err != nil {
+			return err
+		}
+		if err := deleteGalleries(tx, galleryIDs); err != nil {
+			return err
+		}
+		owned := []interface{}{&Profile{}, &Session{}, &APIToken{},
+			&pwReset{}, &recoveryCode{}}
+		for _, model := range owned {
+			err := tx.Unscoped().Where("account_id = ?", id).Delete(model).Error
+			if err != nil {
+				return err
+			}
+		}
+		account := Account{Model: gorm.Model{ID: id}}
+		return tx.Unscoped().Delete(&account).Error
+	})
 }
 
 // First will query the gorm.DB and will return the first record and move it to dst.
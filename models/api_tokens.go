@@ -0,0 +1,331 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"muto/hash"
+	"muto/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+// API TOKEN - ERRORS
+const (
+	ErrTokenNameRequired modelError = "models: token name is required"
+	ErrTokenNameTooLong  modelError = "models: token name must be 64 characters or less"
+	ErrScopeRequired     modelError = "models: pick at least one scope"
+	ErrScopeInvalid      modelError = "models: scope is not valid"
+	ErrTokenExpired      modelError = "models: API token has expired"
+)
+
+// Scope limits what an API token can be used for.
+type Scope string
+
+const (
+	ScopeGalleriesRead  Scope = "galleries:read"
+	ScopeGalleriesWrite Scope = "galleries:write"
+	ScopeImagesWrite    Scope = "images:write"
+)
+
+// Scopes lists every scope a token can be given, in the order
+// they are shown on the settings page.
+var Scopes = []Scope{
+	ScopeGalleriesRead,
+	ScopeGalleriesWrite,
+	ScopeImagesWrite,
+}
+
+const (
+	// apiTokenPrefix makes our tokens easy to recognise, for
+	// people and for secret scanners.
+	apiTokenPrefix     = "muto_"
+	maxTokenNameLength = 64
+)
+
+// Test to verify apiTokenGorm implements the APITokenDB interface.
+var _ APITokenDB = &apiTokenGorm{}
+
+// APIToken is a personal access token that scripts can send as
+// a bearer token instead of signing in. Like remember tokens we
+// only store an HMAC of the token, so the raw value is only
+// available in Token right after Create.
+type APIToken struct {
+	gorm.Model
+	AccountID  uint   `gorm:"not null;index"`
+	Name       string `gorm:"not null"`
+	Scopes     string `gorm:"not null"`
+	Token      string `gorm:"-"`
+	TokenHash  string `gorm:"not null;unique_index"`
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+}
+
+// ScopeList returns the scopes the token was given.
+func (t *APIToken) ScopeList() []Scope {
+	var scopes []Scope
+	for _, s := range strings.Fields(t.Scopes) {
+		scopes = append(scopes, Scope(s))
+	}
+	return scopes
+}
+
+// SetScopes replaces the scopes the token is given.
+func (t *APIToken) SetScopes(scopes []Scope) {
+	strs := make([]string, len(scopes))
+	for i, s := range scopes {
+		strs[i] = string(s)
+	}
+	t.Scopes = strings.Join(strs, " ")
+}
+
+// HasScope reports whether the token was given scope.
+func (t *APIToken) HasScope(scope Scope) bool {
+	for _, s := range t.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the token is past its expiry. Tokens
+// without an expiry never expire.
+func (t *APIToken) Expired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+// APITokenService interface is a set of methods used to manipulate
+// and work with the API token model.
+type APITokenService interface {
+	APITokenDB
+}
+
+// APITokenDB is used to interact with the api_tokens table.
+type APITokenDB interface {
+	// ByToken looks up a token by its raw value. Expired tokens
+	// return ErrTokenExpired.
+	ByToken(token string) (*APIToken, error)
+	ByAccountID(accountID uint) ([]APIToken, error)
+
+	// Create generates the raw token, which is only available in
+	// the Token field until the APIToken is discarded.
+	Create(token *APIToken) error
+	Update(token *APIToken) error
+	Delete(id uint) error
+	DeleteByAccountID(accountID uint) error
+}
+
+// NewAPITokenService
+func NewAPITokenService(db *gorm.DB, hmacKey string) APITokenService {
+	return &apiTokenService{
+		APITokenDB: &apiTokenValidator{
+			APITokenDB: &apiTokenGorm{db},
+			hmac:       hash.NewHMAC(hmacKey),
+		},
+	}
+}
+
+type apiTokenService struct {
+	APITokenDB
+}
+
+func (ts *apiTokenService) ByToken(token string) (*APIToken, error) {
+	t, err := ts.APITokenDB.ByToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if t.Expired() {
+		return nil, ErrTokenExpired
+	}
+	return t, nil
+}
+
+// apiTokenValidator is our validation layer that validates and
+// normalizes tokens before passing them to the APITokenDB.
+type apiTokenValidator struct {
+	APITokenDB
+	hmac hash.HMAC
+}
+
+type apiTokenValFn func(*APIToken) error
+
+func runAPITokenValFns(token *APIToken, fns ...apiTokenValFn) error {
+	for _, fn := range fns {
+		if err := fn(token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VALIDATION - accountIDRequired
+func (tv *apiTokenValidator) accountIDRequired(t *APIToken) error {
+	if t.AccountID <= 0 {
+		return ErrAccountIDRequired
+	}
+	return nil
+}
+
+// VALIDATION - nameRequired
+func (tv *apiTokenValidator) nameRequired(t *APIToken) error {
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" {
+		return ErrTokenNameRequired
+	}
+	if len(t.Name) > maxTokenNameLength {
+		return ErrTokenNameTooLong
+	}
+	return nil
+}
+
+// VALIDATION - scopesValid
+func (tv *apiTokenValidator) scopesValid(t *APIToken) error {
+	scopes := t.ScopeList()
+	if len(scopes) == 0 {
+		return ErrScopeRequired
+	}
+	for _, s := range scopes {
+		if !validScope(s) {
+			return ErrScopeInvalid
+		}
+	}
+	return nil
+}
+
+// VALIDATION - generateToken
+func (tv *apiTokenValidator) generateToken(t *APIToken) error {
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	t.Token = apiTokenPrefix + token
+	return nil
+}
+
+// VALIDATION - hmacToken
+func (tv *apiTokenValidator) hmacToken(t *APIToken) error {
+	if t.Token == "" {
+		return nil
+	}
+	t.TokenHash = tv.hmac.Hash(t.Token)
+	return nil
+}
+
+// VALIDATION - tokenHashRequired
+func (tv *apiTokenValidator) tokenHashRequired(t *APIToken) error {
+	if t.TokenHash == "" {
+		return ErrTokenInvalid
+	}
+	return nil
+}
+
+// VALIDATION - ByToken hashes the raw token before looking it up.
+func (tv *apiTokenValidator) ByToken(token string) (*APIToken, error) {
+	t := APIToken{Token: token}
+	if err := runAPITokenValFns(&t, tv.hmacToken); err != nil {
+		return nil, err
+	}
+	return tv.APITokenDB.ByToken(t.TokenHash)
+}
+
+// VALIDATION - Create
+func (tv *apiTokenValidator) Create(t *APIToken) error {
+	err := runAPITokenValFns(t,
+		tv.accountIDRequired,
+		tv.nameRequired,
+		tv.scopesValid,
+		tv.generateToken,
+		tv.hmacToken)
+	if err != nil {
+		return err
+	}
+	return tv.APITokenDB.Create(t)
+}
+
+// VALIDATION - Update
+func (tv *apiTokenValidator) Update(t *APIToken) error {
+	err := runAPITokenValFns(t,
+		tv.accountIDRequired,
+		tv.nameRequired,
+		tv.scopesValid,
+		tv.tokenHashRequired)
+	if err != nil {
+		return err
+	}
+	return tv.APITokenDB.Update(t)
+}
+
+// VALIDATION - Delete
+func (tv *apiTokenValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return tv.APITokenDB.Delete(id)
+}
+
+// VALIDATION - DeleteByAccountID
+func (tv *apiTokenValidator) DeleteByAccountID(accountID uint) error {
+	if accountID <= 0 {
+		return ErrIDInvalid
+	}
+	return tv.APITokenDB.DeleteByAccountID(accountID)
+}
+
+func validScope(scope Scope) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// apiTokenGorm represents our database interaction layer
+// and implements the APITokenDB interface fully.
+type apiTokenGorm struct {
+	db *gorm.DB
+}
+
+// GORM - ByToken expects the token to already be hashed.
+func (tg *apiTokenGorm) ByToken(tokenHash string) (*APIToken, error) {
+	var t APIToken
+	err := first(tg.db.Where("token_hash = ?", tokenHash), &t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// GORM - ByAccountID returns the tokens of an account, newest
+// first.
+func (tg *apiTokenGorm) ByAccountID(accountID uint) ([]APIToken, error) {
+	var tokens []APIToken
+	db := tg.db.Where("account_id = ?", accountID).Order("id desc")
+	if err := db.Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// GORM - Create
+func (tg *apiTokenGorm) Create(t *APIToken) error {
+	return tg.db.Create(t).Error
+}
+
+// GORM - Update
+func (tg *apiTokenGorm) Update(t *APIToken) error {
+	return tg.db.Save(t).Error
+}
+
+// GORM - Delete
+func (tg *apiTokenGorm) Delete(id uint) error {
+	t := APIToken{Model: gorm.Model{ID: id}}
+	return tg.db.Delete(&t).Error
+}
+
+// GORM - DeleteByAccountID revokes every token of an account.
+func (tg *apiTokenGorm) DeleteByAccountID(accountID uint) error {
+	return tg.db.Where("account_id = ?", accountID).
+		Delete(&APIToken{}).Error
+}
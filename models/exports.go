@@ -0,0 +1,311 @@
+package models
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"time"
+)
+
+// ExportService builds personal data exports.
+type ExportService interface {
+	// Export writes a ZIP archive with everything we store about
+	// the account to w: a manifest.json describing the account,
+	// its profile, galleries, share links that can still be used,
+	// sessions and API tokens, the avatar and every image file
+	// under galleries/<id>/. Secrets, like password hashes and
+	// tokens, are left out.
+	Export(w io.Writer, account *Account) error
+}
+
+// NewExportService
+func NewExportService(ps ProfileService, gs GalleryService, is ImageService,
+	shs GalleryShareService, ss SessionService, ts APITokenService) ExportService {
+	return &exportService{
+		ps:  ps,
+		gs:  gs,
+		is:  is,
+		shs: shs,
+		ss:  ss,
+		ts:  ts,
+	}
+}
+
+type exportService struct {
+	ps  ProfileService
+	gs  GalleryService
+	is  ImageService
+	shs GalleryShareService
+	ss  SessionService
+	ts  APITokenService
+}
+
+// exportManifest is the machine readable part of an export. Its
+// JSON field names are part of the export format, so change them
+// with care.
+type exportManifest struct {
+	Version     int             `json:"version"`
+	GeneratedAt time.Time       `json:"generated_at"`
+	Account     exportAccount   `json:"account"`
+	Profile     *exportProfile  `json:"profile"`
+	Galleries   []exportGallery `json:"galleries"`
+	Sessions    []exportSession `json:"sessions"`
+	APITokens   []exportToken   `json:"api_tokens"`
+}
+
+type exportAccount struct {
+	ID               uint       `json:"id"`
+	Email            string     `json:"email"`
+	EmailVerifiedAt  *time.Time `json:"email_verified_at"`
+	TwoFactorEnabled bool       `json:"two_factor_enabled"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+type exportProfile struct {
+	Username    string    `json:"username"`
+	DisplayName string    `json:"display_name"`
+	Bio         string    `json:"bio"`
+	Avatar      string    `json:"avatar"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type exportGallery struct {
+	ID          uint          `json:"id"`
+	Title       string        `json:"title"`
+	Description string        `json:"description"`
+	CoverImage  string        `json:"cover_image"`
+	Visibility  Visibility    `json:"visibility"`
+	Category    Category      `json:"category"`
+	Tags        []string      `json:"tags"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+	Images      []exportImage `json:"images"`
+	Shares      []exportShare `json:"shares"`
+}
+
+type exportShare struct {
+	Label       string    `json:"label"`
+	HasPassword bool      `json:"has_password"`
+	MaxViews    int       `json:"max_views"`
+	Views       int       `json:"views"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type exportSession struct {
+	Device     string    `json:"device"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type exportToken struct {
+	Name       string     `json:"name"`
+	Scopes     string     `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+type exportImage struct {
+	Filename    string    `json:"filename"`
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	ContentType string    `json:"content_type"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Position    int       `json:"position"`
+	Caption     string    `json:"caption"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (es *exportService) Export(w io.Writer, account *Account) error {
+	manifest := exportManifest{
+		Version:     1,
+		GeneratedAt: time.Now().UTC(),
+		Account: exportAccount{
+			ID:               account.ID,
+			Email:            account.Email,
+			EmailVerifiedAt:  account.EmailVerifiedAt,
+			TwoFactorEnabled: account.TwoFactorEnabled(),
+			CreatedAt:        account.CreatedAt,
+			UpdatedAt:        account.UpdatedAt,
+		},
+		Galleries: []exportGallery{},
+		Sessions:  []exportSession{},
+		APITokens: []exportToken{},
+	}
+
+	zw := zip.NewWriter(w)
+	profile, err := es.ps.ByAccountID(account.ID)
+	switch err {
+	case nil:
+		manifest.Profile = &exportProfile{
+			Username:    profile.Username,
+			DisplayName: profile.DisplayName,
+			Bio:         profile.Bio,
+			CreatedAt:   profile.CreatedAt,
+			UpdatedAt:   profile.UpdatedAt,
+		}
+		if profile.Avatar != "" {
+			avatar, err := es.addAvatar(zw, account.ID, profile.Avatar)
+			if err != nil {
+				return err
+			}
+			manifest.Profile.Avatar = avatar
+		}
+	case ErrNotFound:
+	default:
+		return err
+	}
+
+	galleries, err := es.gs.ByAccountID(account.ID)
+	if err != nil {
+		return err
+	}
+	for _, gallery := range galleries {
+		eg := exportGallery{
+			ID:          gallery.ID,
+			Title:       gallery.Title,
+			Description: gallery.Description,
+			CoverImage:  gallery.CoverImage,
+			Visibility:  gallery.Visibility,
+			Category:    gallery.Category,
+			Tags:        gallery.TagNames(),
+			CreatedAt:   gallery.CreatedAt,
+			UpdatedAt:   gallery.UpdatedAt,
+			Images:      []exportImage{},
+			Shares:      []exportShare{},
+		}
+		images, err := es.is.ByGalleryID(gallery.ID)
+		if err != nil {
+			return err
+		}
+		for _, img := range images {
+			ei, err := es.addImage(zw, &img)
+			if err != nil {
+				return err
+			}
+			eg.Images = append(eg.Images, *ei)
+		}
+		shares, err := es.shs.ByGalleryID(gallery.ID)
+		if err != nil {
+			return err
+		}
+		for _, share := range shares {
+			eg.Shares = append(eg.Shares, exportShare{
+				Label:       share.Label,
+				HasPassword: share.HasPassword(),
+				MaxViews:    share.MaxViews,
+				Views:       share.Views,
+				ExpiresAt:   share.ExpiresAt,
+				CreatedAt:   share.CreatedAt,
+			})
+		}
+		manifest.Galleries = append(manifest.Galleries, eg)
+	}
+
+	sessions, err := es.ss.ByAccountID(account.ID)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		manifest.Sessions = append(manifest.Sessions, exportSession{
+			Device:     session.Device,
+			UserAgent:  session.UserAgent,
+			IP:         session.IP,
+			LastSeenAt: session.LastSeenAt,
+			ExpiresAt:  session.ExpiresAt,
+			CreatedAt:  session.CreatedAt,
+		})
+	}
+	tokens, err := es.ts.ByAccountID(account.ID)
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		manifest.APITokens = append(manifest.APITokens, exportToken{
+			Name:       token.Name,
+			Scopes:     token.Scopes,
+			ExpiresAt:  token.ExpiresAt,
+			LastUsedAt: token.LastUsedAt,
+			CreatedAt:  token.CreatedAt,
+		})
+	}
+
+	// The manifest goes last so it can include the size and
+	// checksum of every image we just wrote.
+	f, err := zw.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// addImage copies a single image into the archive.
+func (es *exportService) addImage(zw *zip.Writer, img *Image) (*exportImage, error) {
+	r, err := es.is.Open(img)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	name := path.Join("galleries", fmt.Sprint(img.GalleryID), img.Name())
+	f, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store, // images are already compressed
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return nil, err
+	}
+	return &exportImage{
+		Filename:    img.Filename,
+		Path:        name,
+		Size:        n,
+		SHA256:      hex.EncodeToString(h.Sum(nil)),
+		ContentType: img.ContentType,
+		Width:       img.Width,
+		Height:      img.Height,
+		Position:    img.Position,
+		Caption:     img.Caption,
+		CreatedAt:   img.CreatedAt,
+	}, nil
+}
+
+// addAvatar copies the account's avatar at the URL path into the
+// archive and returns its name within the archive.
+func (es *exportService) addAvatar(zw *zip.Writer, accountID uint, avatar string) (string, error) {
+	f, err := es.is.OpenAvatar(accountID, path.Base(avatar))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	name := "profile/" + path.Base(avatar)
+	dst, err := zw.Create(name)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(dst, f); err != nil {
+		return "", err
+	}
+	return name, nil
+}
@@ -1,22 +1,120 @@
 package models
 
 import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"muto/markdown"
+	"muto/rand"
+
 	"github.com/jinzhu/gorm"
 )
 
 // GALLERY - ERRORS
 const (
-	ErrAccountIDRequired modelError = "models: account ID is required"
-	ErrTitleRequired     modelError = "models: title is required"
+	ErrAccountIDRequired  modelError = "models: account ID is required"
+	ErrTitleRequired      modelError = "models: title is required"
+	ErrTitleTooLong       modelError = "models: title must be 48 characters or less"
+	ErrDescriptionTooLong modelError = "models: description must be 5000 characters or less"
+	ErrDescriptionHTML    modelError = "models: description can't contain HTML tags, use markdown instead"
+	ErrCoverImageInvalid  modelError = "models: cover image must be one of the gallery's images"
+	ErrVisibilityInvalid  modelError = "models: visibility must be private, unlisted or public"
+)
+
+const (
+	maxTitleLength       = 48
+	maxDescriptionLength = 5000
+	// slugBytes makes slugs 16 characters long.
+	slugBytes = 12
 )
 
 var _ GalleryDB = &galleryGorm{}
 
+// Visibility decides who can see a gallery and its images.
+type Visibility string
+
+const (
+	// VisibilityPrivate galleries can only be seen by their owner
+	// (and staff).
+	VisibilityPrivate Visibility = "private"
+	// VisibilityUnlisted galleries can be seen by anyone with the
+	// link, but aren't listed on the owner's profile. The link
+	// uses the gallery's Slug, as IDs are easily guessed.
+	VisibilityUnlisted Visibility = "unlisted"
+	// VisibilityPublic galleries are listed on the owner's profile.
+	VisibilityPublic Visibility = "public"
+)
+
+// Visibilities lists every visibility, from most to least
+// restrictive.
+var Visibilities = []Visibility{
+	VisibilityPrivate,
+	VisibilityUnlisted,
+	VisibilityPublic,
+}
+
 type Gallery struct {
 	gorm.Model
-	AccountID uint    `gorm:"not_null;index"`
-	Title     string  `gorm:"not_null"`
-	Images    []Image `gorm:"-"`
+	AccountID uint   `gorm:"not_null;index"`
+	Title     string `gorm:"not_null"`
+	// Slug is a random name for the gallery, used in the link to
+	// unlisted galleries. It is set by Create, and is unique.
+	Slug string `gorm:"not null;default:''"`
+	// Description is markdown. Use markdown.Render to show it.
+	Description string `gorm:"type:text;not null;default:''"`
+	// CoverImage is the Name of the image shown for the
+	// gallery in listings. When empty the first image is used.
+	CoverImage string     `gorm:"not null;default:''"`
+	Visibility Visibility `gorm:"not null;default:'private'"`
+	Category   Category   `gorm:"not null;default:'other';index"`
+	// Tags are loaded by ByID and ByAccountID. Create and Update
+	// replace the gallery's tags with these.
+	Tags []Tag `gorm:"many2many:gallery_tags;"`
+	// ImageCount is kept up to date by the ImageService so
+	// galleries can be sorted by it.
+	ImageCount int     `gorm:"not null;default:0"`
+	Images     []Image `gorm:"-"`
+}
+
+// TagNames returns the names of the gallery's tags.
+func (m *Gallery) TagNames() []string {
+	names := make([]string, len(m.Tags))
+	for i, tag := range m.Tags {
+		names[i] = tag.Name
+	}
+	return names
+}
+
+// UnlistedPath is the URL path of the link to the gallery that
+// works while it is unlisted.
+func (m *Gallery) UnlistedPath() string {
+	return "/g/" + m.Slug
+}
+
+// SetTags replaces the gallery's tags. The names are normalized
+// when the gallery is saved.
+func (m *Gallery) SetTags(names []string) {
+	m.Tags = make([]Tag, len(names))
+	for i, name := range names {
+		m.Tags[i] = Tag{Name: name}
+	}
+}
+
+// Cover returns the image chosen as the gallery's cover, falling
+// back to its first image. It returns nil for galleries without
+// images, and relies on Images having been loaded.
+func (m *Gallery) Cover() *Image {
+	for i := range m.Images {
+		if m.Images[i].Name() == m.CoverImage {
+			return &m.Images[i]
+		}
+	}
+	if len(m.Images) > 0 {
+		return &m.Images[0]
+	}
+	return nil
 }
 
 type GalleryService interface {
@@ -25,10 +123,29 @@ type GalleryService interface {
 
 type GalleryDB interface {
 	ByID(id uint) (*Gallery, error)
+	BySlug(slug string) (*Gallery, error)
 	ByAccountID(accountID uint) ([]Gallery, error)
+	// List returns one page of galleries whose title contains
+	// query, newest first, and how many match in total. An empty
+	// query lists every gallery.
+	List(query string, page Page) ([]Gallery, PageInfo, error)
+	// ListByAccountID is the paginated form of ByAccountID. It
+	// returns ErrCursorInvalid if opts.Cursor doesn't belong to
+	// a listing with the same sort and order.
+	ListByAccountID(accountID uint, opts GalleryListOptions) ([]Gallery, CursorInfo, error)
+	// ByCategory, ByTag and ByDateCreated list public galleries
+	// only, newest first, as they back pages anyone can browse.
+	// ByDateCreated includes galleries created from from up to,
+	// but not including, to.
+	ByCategory(category Category, page Page) ([]Gallery, PageInfo, error)
+	ByTag(tag string, page Page) ([]Gallery, PageInfo, error)
+	ByDateCreated(from, to time.Time, page Page) ([]Gallery, PageInfo, error)
 	Create(gallery *Gallery) error
 	Update(gallery *Gallery) error
 	Delete(id uint) error
+	// SetImageCount records how many images the gallery has,
+	// without changing its UpdatedAt.
+	SetImageCount(id uint, count int) error
 }
 
 // GALLERY - SERVICE
@@ -74,15 +191,148 @@ func (mv *galleryValidator) titleRequired(m *Gallery) error {
 	return nil
 }
 
+// GALLERY - VALIDATION - trimText
+func (mv *galleryValidator) trimText(m *Gallery) error {
+	m.Title = strings.TrimSpace(m.Title)
+	m.Description = strings.TrimSpace(m.Description)
+	return nil
+}
+
+// GALLERY - VALIDATION - titleMaxLength
+func (mv *galleryValidator) titleMaxLength(m *Gallery) error {
+	if utf8.RuneCountInString(m.Title) > maxTitleLength {
+		return ErrTitleTooLong
+	}
+	return nil
+}
+
+// GALLERY - VALIDATION - descriptionMaxLength
+func (mv *galleryValidator) descriptionMaxLength(m *Gallery) error {
+	if utf8.RuneCountInString(m.Description) > maxDescriptionLength {
+		return ErrDescriptionTooLong
+	}
+	return nil
+}
+
+// GALLERY - VALIDATION - descriptionMarkup rejects raw HTML in
+// descriptions, which should be plain markdown.
+func (mv *galleryValidator) descriptionMarkup(m *Gallery) error {
+	if markdown.HasHTML(m.Description) {
+		return ErrDescriptionHTML
+	}
+	return nil
+}
+
+// GALLERY - VALIDATION - coverImageName makes sure the cover is a
+// plain filename. Whether the gallery has that image is checked
+// by the caller, since images live outside the database.
+func (mv *galleryValidator) coverImageName(m *Gallery) error {
+	if m.CoverImage == "" {
+		return nil
+	}
+	if strings.ContainsAny(m.CoverImage, `/\`) || m.CoverImage == ".." {
+		return ErrCoverImageInvalid
+	}
+	return nil
+}
+
+// GALLERY - VALIDATION - generateSlug gives new galleries their
+// unlisted link.
+func (mv *galleryValidator) generateSlug(m *Gallery) error {
+	slug, err := rand.String(slugBytes)
+	if err != nil {
+		return err
+	}
+	m.Slug = slug
+	return nil
+}
+
+// GALLERY - VALIDATION - defaultVisibility keeps new galleries
+// private until their owner says otherwise.
+func (mv *galleryValidator) defaultVisibility(m *Gallery) error {
+	if m.Visibility == "" {
+		m.Visibility = VisibilityPrivate
+	}
+	return nil
+}
+
+// GALLERY - VALIDATION - visibilityValid
+func (mv *galleryValidator) visibilityValid(m *Gallery) error {
+	for _, v := range Visibilities {
+		if m.Visibility == v {
+			return nil
+		}
+	}
+	return ErrVisibilityInvalid
+}
+
+// GALLERY - VALIDATION - defaultCategory files galleries under
+// "other" until their owner picks a category.
+func (mv *galleryValidator) defaultCategory(m *Gallery) error {
+	if m.Category == "" {
+		m.Category = CategoryOther
+	}
+	return nil
+}
+
+// GALLERY - VALIDATION - categoryValid
+func (mv *galleryValidator) categoryValid(m *Gallery) error {
+	if !m.Category.Valid() {
+		return ErrCategoryInvalid
+	}
+	return nil
+}
+
+// GALLERY - VALIDATION - normalizeTags normalizes every tag and
+// drops empty and repeated ones.
+func (mv *galleryValidator) normalizeTags(m *Gallery) error {
+	seen := make(map[string]bool)
+	tags := make([]Tag, 0, len(m.Tags))
+	for _, tag := range m.Tags {
+		name := NormalizeTag(tag.Name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		tags = append(tags, Tag{Name: name})
+	}
+	m.Tags = tags
+	return nil
+}
+
+// GALLERY - VALIDATION - tagsValid
+func (mv *galleryValidator) tagsValid(m *Gallery) error {
+	if len(m.Tags) > maxTags {
+		return ErrTooManyTags
+	}
+	for _, tag := range m.Tags {
+		if !validTag(tag.Name) {
+			return ErrTagInvalid
+		}
+	}
+	return nil
+}
+
 // GALLERY - VALIDATION
-// // categoryRequired
 // // imageRequired
 
 // GALLERY - VALIDATION - Create
 func (mv *galleryValidator) Create(gallery *Gallery) error {
 	err := runGalleryValFns(gallery,
 		mv.accountIDRequired,
-		mv.titleRequired)
+		mv.trimText,
+		mv.titleRequired,
+		mv.titleMaxLength,
+		mv.descriptionMaxLength,
+		mv.descriptionMarkup,
+		mv.coverImageName,
+		mv.generateSlug,
+		mv.defaultVisibility,
+		mv.visibilityValid,
+		mv.defaultCategory,
+		mv.categoryValid,
+		mv.normalizeTags,
+		mv.tagsValid)
 	if err != nil {
 		return err
 	}
@@ -93,13 +343,50 @@ func (mv *galleryValidator) Create(gallery *Gallery) error {
 func (mv *galleryValidator) Update(gallery *Gallery) error {
 	err := runGalleryValFns(gallery,
 		mv.accountIDRequired,
-		mv.titleRequired)
+		mv.trimText,
+		mv.titleRequired,
+		mv.titleMaxLength,
+		mv.descriptionMaxLength,
+		mv.descriptionMarkup,
+		mv.coverImageName,
+		mv.defaultVisibility,
+		mv.visibilityValid,
+		mv.defaultCategory,
+		mv.categoryValid,
+		mv.normalizeTags,
+		mv.tagsValid)
 	if err != nil {
 		return err
 	}
 	return mv.GalleryDB.Update(gallery)
 }
 
+// GALLERY - VALIDATION - ByTag
+func (mv *galleryValidator) ByTag(tag string, page Page) ([]Gallery, PageInfo, error) {
+	return mv.GalleryDB.ByTag(NormalizeTag(tag), page)
+}
+
+// GALLERY - VALIDATION - BySlug
+func (mv *galleryValidator) BySlug(slug string) (*Gallery, error) {
+	if slug == "" {
+		return nil, ErrNotFound
+	}
+	return mv.GalleryDB.BySlug(slug)
+}
+
+// GALLERY - VALIDATION - ListByAccountID
+func (mv *galleryValidator) ListByAccountID(accountID uint, opts GalleryListOptions) ([]Gallery, CursorInfo, error) {
+	if opts.Sort != "" && !opts.Sort.Valid() {
+		return nil, CursorInfo{}, ErrSortInvalid
+	}
+	switch opts.Order {
+	case "", Ascending, Descending:
+	default:
+		return nil, CursorInfo{}, ErrOrderInvalid
+	}
+	return mv.GalleryDB.ListByAccountID(accountID, opts)
+}
+
 // GALLERY - VALIDATION - nonZeroID
 func (mv *galleryValidator) nonZeroID(gallery *Gallery) error {
 	if gallery.ID <= 0 {
@@ -129,7 +416,18 @@ func (mv *galleryValidator) Delete(id uint) error {
 // GALLERY - GORM
 func (mg *galleryGorm) ByID(id uint) (*Gallery, error) {
 	var gallery Gallery
-	db := mg.db.Where("id = ?", id)
+	db := mg.db.Preload("Tags").Where("id = ?", id)
+	err := first(db, &gallery)
+	if err != nil {
+		return nil, err
+	}
+	return &gallery, nil
+}
+
+// GALLERY - GORM
+func (mg *galleryGorm) BySlug(slug string) (*Gallery, error) {
+	var gallery Gallery
+	db := mg.db.Preload("Tags").Where("slug = ?", slug)
 	err := first(db, &gallery)
 	if err != nil {
 		return nil, err
@@ -140,7 +438,7 @@ func (mg *galleryGorm) ByID(id uint) (*Gallery, error) {
 // GALLERY - GORM
 func (mg *galleryGorm) ByAccountID(accountID uint) ([]Gallery, error) {
 	var galleries []Gallery
-	db := mg.db.Where("account_id = ?", accountID)
+	db := mg.db.Preload("Tags").Where("account_id = ?", accountID)
 	if err := db.Find(&galleries).Error; err != nil {
 		return nil, err
 	}
@@ -148,24 +446,192 @@ func (mg *galleryGorm) ByAccountID(accountID uint) ([]Gallery, error) {
 }
 
 // GALLERY - GORM
-// // ByCategory
-// // ByTag
-// // ByDateCreated
+func (mg *galleryGorm) List(query string, page Page) ([]Gallery, PageInfo, error) {
+	page = page.normalize()
+	info := PageInfo{Page: page}
+	db := mg.db.Model(&Gallery{})
+	if query != "" {
+		db = db.Where("LOWER(title) LIKE ?", likePattern(strings.ToLower(query)))
+	}
+	if err := db.Count(&info.Total).Error; err != nil {
+		return nil, info, err
+	}
+	var galleries []Gallery
+	err := db.Preload("Tags").Order("id DESC").
+		Offset(page.offset()).Limit(page.Size).
+		Find(&galleries).Error
+	return galleries, info, err
+}
+
+// GALLERY - GORM - ListByAccountID pages through the account's
+// galleries by keyset: each page selects the rows sorting after
+// (or before) the gallery its cursor points at, and asks for one
+// row more than it needs to know whether another page follows.
+func (mg *galleryGorm) ListByAccountID(accountID uint, opts GalleryListOptions) ([]Gallery, CursorInfo, error) {
+	opts = opts.normalize()
+	info := CursorInfo{Size: opts.Size}
+	db := mg.db.Model(&Gallery{}).Where("account_id = ?", accountID)
+	if err := db.Count(&info.Total).Error; err != nil {
+		return nil, info, err
+	}
+	column := opts.Sort.column()
+	desc := opts.Order == Descending
+	var cursor *galleryCursor
+	if opts.Cursor != "" {
+		var err error
+		cursor, err = parseGalleryCursor(opts)
+		if err != nil {
+			return nil, info, err
+		}
+		op := ">"
+		if desc != cursor.before {
+			op = "<"
+		}
+		db = db.Where(fmt.Sprintf("(%s, id) %s (?, ?)", column, op),
+			cursor.value, cursor.id)
+	}
+	// Pages before a cursor are read backwards from it, then
+	// flipped around.
+	backwards := cursor != nil && cursor.before
+	dir := "ASC"
+	if desc != backwards {
+		dir = "DESC"
+	}
+	var galleries []Gallery
+	err := db.Preload("Tags").
+		Order(fmt.Sprintf("%s %s, id %s", column, dir, dir)).
+		Limit(opts.Size + 1).
+		Find(&galleries).Error
+	if err != nil {
+		return nil, info, err
+	}
+	more := len(galleries) > opts.Size
+	if more {
+		galleries = galleries[:opts.Size]
+	}
+	if backwards {
+		for i, j := 0, len(galleries)-1; i < j; i, j = i+1, j-1 {
+			galleries[i], galleries[j] = galleries[j], galleries[i]
+		}
+	}
+	if len(galleries) == 0 {
+		return galleries, info, nil
+	}
+	first, last := &galleries[0], &galleries[len(galleries)-1]
+	if more || backwards {
+		info.Next = newGalleryCursor(opts, last, false)
+	}
+	if (more && backwards) || (cursor != nil && !backwards) {
+		info.Prev = newGalleryCursor(opts, first, true)
+	}
+	return galleries, info, nil
+}
+
+// GALLERY - GORM
+func (mg *galleryGorm) ByCategory(category Category, page Page) ([]Gallery, PageInfo, error) {
+	db := mg.db.Model(&Gallery{}).Where("category = ?", category)
+	return mg.listPublic(db, page)
+}
+
+// GALLERY - GORM
+func (mg *galleryGorm) ByTag(tag string, page Page) ([]Gallery, PageInfo, error) {
+	db := mg.db.Model(&Gallery{}).
+		Joins("JOIN gallery_tags ON gallery_tags.gallery_id = galleries.id").
+		Joins("JOIN tags ON tags.id = gallery_tags.tag_id").
+		Where("tags.name = ?", tag)
+	return mg.listPublic(db, page)
+}
+
+// GALLERY - GORM
+func (mg *galleryGorm) ByDateCreated(from, to time.Time, page Page) ([]Gallery, PageInfo, error) {
+	db := mg.db.Model(&Gallery{}).
+		Where("galleries.created_at >= ? AND galleries.created_at < ?", from, to)
+	return mg.listPublic(db, page)
+}
+
+// listPublic returns one page of the public galleries db selects,
+// newest first.
+func (mg *galleryGorm) listPublic(db *gorm.DB, page Page) ([]Gallery, PageInfo, error) {
+	page = page.normalize()
+	info := PageInfo{Page: page}
+	db = db.Where("galleries.visibility = ?", VisibilityPublic)
+	if err := db.Count(&info.Total).Error; err != nil {
+		return nil, info, err
+	}
+	var galleries []Gallery
+	err := db.Select("galleries.*").Preload("Tags").
+		Order("galleries.id DESC").Offset(page.offset()).Limit(page.Size).
+		Find(&galleries).Error
+	return galleries, info, err
+}
 
 // GALLERY - GORM
 func (mg *galleryGorm) Create(gallery *Gallery) error {
-	return mg.db.Create(gallery).Error
+	tags := gallery.Tags
+	gallery.Tags = nil
+	if err := mg.db.Create(gallery).Error; err != nil {
+		return err
+	}
+	return mg.replaceTags(gallery, tags)
 }
 
 // GALLERY - GORM
 func (mg *galleryGorm) Update(gallery *Gallery) error {
-	return mg.db.Save(gallery).Error
+	db := mg.db.Set("gorm:save_associations", false)
+	if err := db.Save(gallery).Error; err != nil {
+		return err
+	}
+	return mg.replaceTags(gallery, gallery.Tags)
 }
 
-// GALLERY - GORM
+// replaceTags links the gallery to tags, creating any tags that
+// don't exist yet, and unlinks every other tag.
+func (mg *galleryGorm) replaceTags(gallery *Gallery, tags []Tag) error {
+	for i := range tags {
+		err := mg.db.Where(Tag{Name: tags[i].Name}).FirstOrCreate(&tags[i]).Error
+		if err != nil {
+			return err
+		}
+	}
+	gallery.Tags = tags
+	return mg.db.Model(gallery).Association("Tags").Replace(tags).Error
+}
+
+// GALLERY - GORM - Delete removes the gallery for good, along
+// with its tags and share links, in a single transaction.
 func (mg *galleryGorm) Delete(id uint) error {
-	gallery := Gallery{Model: gorm.Model{ID: id}}
-	return mg.db.Delete(&gallery).Error
+	return mg.db.Transaction(func(tx *gorm.DB) error {
+		return deleteGalleries(tx, []uint{id})
+	})
+}
+
+// deleteGalleries permanently removes the galleries with the IDs
+// and every row that belongs to them. Their image files are left
+// for the ImageService to remove. It is meant to be run inside a
+// transaction.
+func deleteGalleries(tx *gorm.DB, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	err := tx.Exec("DELETE FROM gallery_tags WHERE gallery_id IN (?)", ids).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Unscoped().Where("gallery_id IN (?)", ids).Delete(&GalleryShare{}).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Where("gallery_id IN (?)", ids).Delete(&Image{}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Unscoped().Where("id IN (?)", ids).Delete(&Gallery{}).Error
+}
+
+// GALLERY - GORM
+func (mg *galleryGorm) SetImageCount(id uint, count int) error {
+	return mg.db.Model(&Gallery{}).Where("id = ?", id).
+		UpdateColumn("image_count", count).Error
 }
 
 // GALLERY - SERVICE
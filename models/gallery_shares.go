@@ -0,0 +1,426 @@
+package models
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"muto/hash"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// GALLERY SHARE - ERRORS
+const (
+	ErrShareExpiryRequired modelError = "models: share links must expire"
+	ErrShareExpiryTooLong  modelError = "models: share links can last 90 days at most"
+	ErrShareLabelTooLong   modelError = "models: share label must be 64 characters or less"
+	ErrShareMaxViews       modelError = "models: view limit can't be negative"
+	ErrShareUsedUp         modelError = "models: this link has been viewed as many times as it allows"
+	ErrShareUnavailable    modelError = "models: this link has expired or been revoked"
+)
+
+const (
+	maxShareDays        = 90
+	maxShareLabelLength = 64
+	// shareVisitLength is how long the images of a shared gallery
+	// keep loading after a view of the link.
+	shareVisitLength = time.Hour
+)
+
+// Test to verify galleryShareGorm implements the GalleryShareDB
+// interface.
+var _ GalleryShareDB = &galleryShareGorm{}
+
+// GalleryShare lets people without an account see a gallery,
+// whatever its visibility. The link is a token signed with
+// signToken, so only the share's ID lives in the token and
+// nothing secret is stored. Token is filled in by the service
+// whenever a share is returned.
+type GalleryShare struct {
+	gorm.Model
+	GalleryID uint   `gorm:"not null;index"`
+	Label     string `gorm:"not null;default:''"`
+	// Password is optional. Only its bcrypt hash is stored.
+	Password     string    `gorm:"-"`
+	PasswordHash string    `gorm:"not null;default:''"`
+	ExpiresAt    time.Time `gorm:"not null"`
+	// MaxViews limits how many times the gallery can be opened
+	// through the link. 0 means no limit.
+	MaxViews  int `gorm:"not null;default:0"`
+	Views     int `gorm:"not null;default:0"`
+	RevokedAt *time.Time
+	Token     string `gorm:"-"`
+}
+
+// Path is the URL path of the share link.
+func (s *GalleryShare) Path() string {
+	return "/s/" + s.Token
+}
+
+// HasPassword reports whether the link asks for a password.
+func (s *GalleryShare) HasPassword() bool {
+	return s.PasswordHash != ""
+}
+
+// Active reports whether the link can still be used.
+func (s *GalleryShare) Active() bool {
+	return s.RevokedAt == nil && time.Now().Before(s.ExpiresAt) &&
+		!s.UsedUp()
+}
+
+// UsedUp reports whether the link has reached its view limit.
+func (s *GalleryShare) UsedUp() bool {
+	return s.MaxViews > 0 && s.Views >= s.MaxViews
+}
+
+// GalleryShareService interface is a set of methods used to
+// manipulate and work with the gallery share model. Unlike the
+// GalleryShareDB it wraps, its ByGalleryID only returns links that
+// can still be used, and every share it returns has its Token set.
+type GalleryShareService interface {
+	GalleryShareDB
+	// ByToken verifies a share link token. Expired and revoked
+	// links return ErrShareUnavailable, and links that have
+	// reached their view limit ErrShareUsedUp. Use View to count
+	// a visit.
+	ByToken(token string) (*GalleryShare, error)
+	// VisitToken returns a token letting the images of the
+	// share's gallery load for a while after a visit was counted
+	// by View, for a cookie. ByVisitToken verifies it, returning
+	// the share as long as it is neither expired nor revoked.
+	VisitToken(share *GalleryShare) string
+	ByVisitToken(token string) (*GalleryShare, error)
+	// CheckPassword returns ErrPasswordIncorrect unless password
+	// unlocks the share.
+	CheckPassword(share *GalleryShare, password string) error
+	// View counts a visit, returning ErrShareUsedUp if the link
+	// has no views left.
+	View(share *GalleryShare) error
+	Revoke(share *GalleryShare) error
+	// UnlockToken returns a token proving the share's password
+	// was entered, for a cookie. Unlocked checks it.
+	UnlockToken(share *GalleryShare) string
+	Unlocked(share *GalleryShare, token string) bool
+}
+
+// GalleryShareDB is used to interact with the gallery_shares
+// table.
+type GalleryShareDB interface {
+	ByID(id uint) (*GalleryShare, error)
+	ByGalleryID(galleryID uint) ([]GalleryShare, error)
+	Create(share *GalleryShare) error
+	Update(share *GalleryShare) error
+	// AddView counts a view unless the share has reached its
+	// limit, in which case it returns ErrShareUsedUp.
+	AddView(id uint) error
+}
+
+// NewGalleryShareService
+func NewGalleryShareService(db *gorm.DB, pepper, hmacKey string) GalleryShareService {
+	return &galleryShareService{
+		GalleryShareDB: &galleryShareValidator{
+			GalleryShareDB: &galleryShareGorm{db},
+			pepper:         pepper,
+		},
+		hmac:   hash.NewHMAC(hmacKey),
+		pepper: pepper,
+	}
+}
+
+type galleryShareService struct {
+	GalleryShareDB
+	hmac   hash.HMAC
+	pepper string
+}
+
+func (ss *galleryShareService) ByToken(token string) (*GalleryShare, error) {
+	share, err := ss.byToken("share", token)
+	if err != nil {
+		return nil, err
+	}
+	if share.UsedUp() {
+		return nil, ErrShareUsedUp
+	}
+	return share, nil
+}
+
+func (ss *galleryShareService) VisitToken(share *GalleryShare) string {
+	expires := time.Now().Add(shareVisitLength)
+	if share.ExpiresAt.Before(expires) {
+		expires = share.ExpiresAt
+	}
+	return signToken(ss.hmac, expires, "share-visit",
+		strconv.FormatUint(uint64(share.ID), 10))
+}
+
+func (ss *galleryShareService) ByVisitToken(token string) (*GalleryShare, error) {
+	return ss.byToken("share-visit", token)
+}
+
+// byToken verifies a token signed for the share with kind, and
+// returns the share unless it has expired or been revoked.
+func (ss *galleryShareService) byToken(kind, token string) (*GalleryShare, error) {
+	fields, err := parseSignedToken(ss.hmac, token)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) != 2 || fields[0] != kind {
+		return nil, ErrTokenInvalid
+	}
+	id, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	share, err := ss.ByID(uint(id))
+	if err != nil {
+		return nil, err
+	}
+	if share.RevokedAt != nil || time.Now().After(share.ExpiresAt) {
+		return nil, ErrShareUnavailable
+	}
+	return share, nil
+}
+
+func (ss *galleryShareService) ByGalleryID(galleryID uint) ([]GalleryShare, error) {
+	shares, err := ss.GalleryShareDB.ByGalleryID(galleryID)
+	if err != nil {
+		return nil, err
+	}
+	var active []GalleryShare
+	for _, share := range shares {
+		if share.Active() {
+			ss.sign(&share)
+			active = append(active, share)
+		}
+	}
+	return active, nil
+}
+
+func (ss *galleryShareService) ByID(id uint) (*GalleryShare, error) {
+	share, err := ss.GalleryShareDB.ByID(id)
+	if err != nil {
+		return nil, err
+	}
+	ss.sign(share)
+	return share, nil
+}
+
+func (ss *galleryShareService) Create(share *GalleryShare) error {
+	if err := ss.GalleryShareDB.Create(share); err != nil {
+		return err
+	}
+	ss.sign(share)
+	return nil
+}
+
+func (ss *galleryShareService) CheckPassword(share *GalleryShare, password string) error {
+	if !share.HasPassword() {
+		return nil
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(share.PasswordHash),
+		[]byte(password+ss.pepper))
+	switch err {
+	case nil:
+		return nil
+	case bcrypt.ErrMismatchedHashAndPassword:
+		return ErrPasswordIncorrect
+	default:
+		return err
+	}
+}
+
+func (ss *galleryShareService) View(share *GalleryShare) error {
+	if err := ss.GalleryShareDB.AddView(share.ID); err != nil {
+		return err
+	}
+	share.Views++
+	return nil
+}
+
+func (ss *galleryShareService) Revoke(share *GalleryShare) error {
+	now := time.Now()
+	share.RevokedAt = &now
+	return ss.GalleryShareDB.Update(share)
+}
+
+func (ss *galleryShareService) UnlockToken(share *GalleryShare) string {
+	return signToken(ss.hmac, share.ExpiresAt, "share-unlock",
+		strconv.FormatUint(uint64(share.ID), 10))
+}
+
+func (ss *galleryShareService) Unlocked(share *GalleryShare, token string) bool {
+	fields, err := parseSignedToken(ss.hmac, token)
+	if err != nil {
+		return false
+	}
+	return len(fields) == 2 && fields[0] == "share-unlock" &&
+		fields[1] == strconv.FormatUint(uint64(share.ID), 10)
+}
+
+// sign sets the token of the share's link. Tokens are derived
+// from the share's ID and expiry, so they can be rebuilt at any
+// time instead of being stored.
+func (ss *galleryShareService) sign(share *GalleryShare) {
+	share.Token = signToken(ss.hmac, share.ExpiresAt, "share",
+		strconv.FormatUint(uint64(share.ID), 10))
+}
+
+// galleryShareValidator is our validation layer that validates
+// and normalizes shares before passing them to the
+// GalleryShareDB.
+type galleryShareValidator struct {
+	GalleryShareDB
+	pepper string
+}
+
+type galleryShareValFn func(*GalleryShare) error
+
+func runGalleryShareValFns(share *GalleryShare, fns ...galleryShareValFn) error {
+	for _, fn := range fns {
+		if err := fn(share); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VALIDATION - galleryIDRequired
+func (sv *galleryShareValidator) galleryIDRequired(s *GalleryShare) error {
+	if s.GalleryID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+// VALIDATION - labelLength
+func (sv *galleryShareValidator) labelLength(s *GalleryShare) error {
+	s.Label = strings.TrimSpace(s.Label)
+	if len(s.Label) > maxShareLabelLength {
+		return ErrShareLabelTooLong
+	}
+	return nil
+}
+
+// VALIDATION - expiryValid makes sure every link expires, and
+// not too far in the future.
+func (sv *galleryShareValidator) expiryValid(s *GalleryShare) error {
+	if s.ExpiresAt.IsZero() {
+		return ErrShareExpiryRequired
+	}
+	if s.ExpiresAt.After(time.Now().AddDate(0, 0, maxShareDays)) {
+		return ErrShareExpiryTooLong
+	}
+	return nil
+}
+
+// VALIDATION - maxViewsValid
+func (sv *galleryShareValidator) maxViewsValid(s *GalleryShare) error {
+	if s.MaxViews < 0 {
+		return ErrShareMaxViews
+	}
+	return nil
+}
+
+// VALIDATION - bcryptPassword hashes the optional password the
+// same way account passwords are hashed.
+func (sv *galleryShareValidator) bcryptPassword(s *GalleryShare) error {
+	if s.Password == "" {
+		return nil
+	}
+	hashed, err := bcrypt.GenerateFromPassword(
+		[]byte(s.Password+sv.pepper), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	s.PasswordHash = string(hashed)
+	s.Password = ""
+	return nil
+}
+
+// VALIDATION - ByID
+func (sv *galleryShareValidator) ByID(id uint) (*GalleryShare, error) {
+	if id <= 0 {
+		return nil, ErrIDInvalid
+	}
+	return sv.GalleryShareDB.ByID(id)
+}
+
+// VALIDATION - Create
+func (sv *galleryShareValidator) Create(s *GalleryShare) error {
+	err := runGalleryShareValFns(s,
+		sv.galleryIDRequired,
+		sv.labelLength,
+		sv.expiryValid,
+		sv.maxViewsValid,
+		sv.bcryptPassword)
+	if err != nil {
+		return err
+	}
+	return sv.GalleryShareDB.Create(s)
+}
+
+// VALIDATION - Update
+func (sv *galleryShareValidator) Update(s *GalleryShare) error {
+	err := runGalleryShareValFns(s,
+		sv.galleryIDRequired,
+		sv.labelLength,
+		sv.maxViewsValid)
+	if err != nil {
+		return err
+	}
+	return sv.GalleryShareDB.Update(s)
+}
+
+// galleryShareGorm represents our database interaction layer
+// and implements the GalleryShareDB interface fully.
+type galleryShareGorm struct {
+	db *gorm.DB
+}
+
+// GORM - ByID
+func (sg *galleryShareGorm) ByID(id uint) (*GalleryShare, error) {
+	var s GalleryShare
+	err := first(sg.db.Where("id = ?", id), &s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// GORM - ByGalleryID returns every share of a gallery, newest
+// first, including revoked and expired ones.
+func (sg *galleryShareGorm) ByGalleryID(galleryID uint) ([]GalleryShare, error) {
+	var shares []GalleryShare
+	db := sg.db.Where("gallery_id = ?", galleryID).Order("id desc")
+	if err := db.Find(&shares).Error; err != nil {
+		return nil, err
+	}
+	return shares, nil
+}
+
+// GORM - Create
+func (sg *galleryShareGorm) Create(s *GalleryShare) error {
+	return sg.db.Create(s).Error
+}
+
+// GORM - Update
+func (sg *galleryShareGorm) Update(s *GalleryShare) error {
+	return sg.db.Save(s).Error
+}
+
+// GORM - AddView checks the limit and counts the view in a single
+// statement, so two visitors can't both get the last view.
+func (sg *galleryShareGorm) AddView(id uint) error {
+	db := sg.db.Model(&GalleryShare{}).
+		Where("id = ? AND (max_views = 0 OR views < max_views)", id).
+		UpdateColumn("views", gorm.Expr("views + 1"))
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrShareUsedUp
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package models
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GALLERY SORT - ERRORS
+const (
+	ErrSortInvalid   modelError = "models: galleries can be sorted by created, updated, title or images"
+	ErrOrderInvalid  modelError = "models: order must be asc or desc"
+	ErrCursorInvalid modelError = "models: page cursor is not valid for this listing"
+)
+
+// GallerySort is what a listing of galleries is sorted by. Ties
+// are broken by ID so every gallery has a fixed place.
+type GallerySort string
+
+const (
+	SortCreated GallerySort = "created"
+	SortUpdated GallerySort = "updated"
+	SortTitle   GallerySort = "title"
+	SortImages  GallerySort = "images"
+)
+
+// GallerySorts lists every sort in the order they are offered on
+// the galleries page.
+var GallerySorts = []GallerySort{
+	SortCreated,
+	SortUpdated,
+	SortTitle,
+	SortImages,
+}
+
+// Valid reports whether s is one of GallerySorts.
+func (s GallerySort) Valid() bool {
+	for _, sort := range GallerySorts {
+		if s == sort {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultOrder is the order used when none is given: titles
+// A to Z, and the newest or biggest galleries first otherwise.
+func (s GallerySort) DefaultOrder() SortOrder {
+	if s == SortTitle {
+		return Ascending
+	}
+	return Descending
+}
+
+// column returns the column of the galleries table s sorts by.
+func (s GallerySort) column() string {
+	switch s {
+	case SortUpdated:
+		return "updated_at"
+	case SortTitle:
+		return "title"
+	case SortImages:
+		return "image_count"
+	default:
+		return "created_at"
+	}
+}
+
+// GalleryListOptions selects a page of galleries. The zero value
+// asks for the first page of the newest galleries at the default
+// page size.
+type GalleryListOptions struct {
+	Sort  GallerySort
+	Order SortOrder
+	// Cursor is the Next or Prev cursor of a previous page of the
+	// same listing, or empty for the first page.
+	Cursor string
+	Size   int
+}
+
+// normalize fills in the default sort, order and page size.
+func (o GalleryListOptions) normalize() GalleryListOptions {
+	if o.Sort == "" {
+		o.Sort = SortCreated
+	}
+	if o.Order == "" {
+		o.Order = o.Sort.DefaultOrder()
+	}
+	o.Size = Page{Size: o.Size}.normalize().Size
+	return o
+}
+
+// galleryCursor is a position in a sorted listing of galleries:
+// the sort value and ID of the gallery a page starts or ends at.
+// Before cursors ask for the page leading up to the gallery,
+// rather than the one following it.
+type galleryCursor struct {
+	sort   GallerySort
+	order  SortOrder
+	before bool
+	id     uint
+	value  interface{}
+}
+
+// newGalleryCursor returns the cursor of gallery in a listing
+// sorted by opts.
+func newGalleryCursor(opts GalleryListOptions, gallery *Gallery, before bool) string {
+	var value string
+	switch opts.Sort {
+	case SortUpdated:
+		value = strconv.FormatInt(gallery.UpdatedAt.UnixNano(), 10)
+	case SortTitle:
+		value = gallery.Title
+	case SortImages:
+		value = strconv.Itoa(gallery.ImageCount)
+	default:
+		value = strconv.FormatInt(gallery.CreatedAt.UnixNano(), 10)
+	}
+	direction := "a"
+	if before {
+		direction = "b"
+	}
+	// The value goes last since titles can contain anything,
+	// including the separator.
+	raw := fmt.Sprintf("%s|%s|%s|%d|%s", opts.Sort, opts.Order,
+		direction, gallery.ID, value)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// parseGalleryCursor decodes opts.Cursor, returning
+// ErrCursorInvalid if it is malformed or belongs to a listing
+// with a different sort or order.
+func parseGalleryCursor(opts GalleryListOptions) (*galleryCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(opts.Cursor)
+	if err != nil {
+		return nil, ErrCursorInvalid
+	}
+	fields := strings.SplitN(string(raw), "|", 5)
+	if len(fields) != 5 {
+		return nil, ErrCursorInvalid
+	}
+	c := galleryCursor{
+		sort:   GallerySort(fields[0]),
+		order:  SortOrder(fields[1]),
+		before: fields[2] == "b",
+	}
+	if c.sort != opts.Sort || c.order != opts.Order ||
+		(fields[2] != "a" && fields[2] != "b") {
+		return nil, ErrCursorInvalid
+	}
+	id, err := strconv.ParseUint(fields[3], 10, 64)
+	if err != nil {
+		return nil, ErrCursorInvalid
+	}
+	c.id = uint(id)
+	switch c.sort {
+	case SortTitle:
+		c.value = fields[4]
+	case SortImages:
+		n, err := strconv.Atoi(fields[4])
+		if err != nil {
+			return nil, ErrCursorInvalid
+		}
+		c.value = n
+	default:
+		n, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, ErrCursorInvalid
+		}
+		c.value = time.Unix(0, n).UTC()
+	}
+	return &c, nil
+}
@@ -0,0 +1,235 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path"
+	"strings"
+
+	"muto/resize"
+)
+
+// IMAGE SIZE - ERRORS
+const (
+	ErrImagePixels modelError = "models: images can be at most 50 megapixels"
+)
+
+const (
+	// maxImagePixels caps the pixels of an uploaded image, as a
+	// small file can decode into a huge image.
+	maxImagePixels = 50 * 1000 * 1000
+	// sizeQuality is the JPEG quality sizes are saved with.
+	sizeQuality = 85
+)
+
+// ImageSize is a downscaled copy of an image, made when it is
+// uploaded so pages don't have to load the original. Sizes are
+// stored next to the original, under a directory named after them.
+type ImageSize string
+
+const (
+	SizeThumb  ImageSize = "thumb"
+	SizeMedium ImageSize = "medium"
+	SizeLarge  ImageSize = "large"
+)
+
+// ImageSizes lists every size from smallest to largest.
+var ImageSizes = []ImageSize{
+	SizeThumb,
+	SizeMedium,
+	SizeLarge,
+}
+
+// Valid reports whether s is one of ImageSizes.
+func (s ImageSize) Valid() bool {
+	for _, size := range ImageSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// Pixels is the longest side of an image in the size.
+func (s ImageSize) Pixels() int {
+	switch s {
+	case SizeThumb:
+		return 320
+	case SizeMedium:
+		return 800
+	default:
+		return 1600
+	}
+}
+
+// HasSize reports whether the size was made for the image. Images
+// already smaller than a size don't get it, and neither do WebP
+// images, which the standard library can't decode.
+func (i *Image) HasSize(s ImageSize) bool {
+	for _, size := range strings.Fields(i.Sizes) {
+		if ImageSize(size) == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SizeName is the name the size of the image is stored under, or
+// empty if it has no such size. JPEGs stay JPEGs, and everything
+// else becomes a PNG so transparency is kept.
+func (i *Image) SizeName(s ImageSize) string {
+	if !i.HasSize(s) {
+		return ""
+	}
+	return i.sizeName()
+}
+
+// sizeName is the name every size of the image is stored under,
+// in the size's directory.
+func (i *Image) sizeName() string {
+	name := i.Name()
+	name = strings.TrimSuffix(name, path.Ext(name))
+	if i.ContentType == "image/jpeg" {
+		return name + ".jpg"
+	}
+	return name + ".png"
+}
+
+// SizePath is the URL path of the size of the image, falling back
+// to the original when it has no such size.
+func (i *Image) SizePath(s ImageSize) string {
+	if !i.HasSize(s) {
+		return i.Path()
+	}
+	return fmt.Sprintf("/images/galleries/%d/%s/%s",
+		i.GalleryID, s, i.SizeName(s))
+}
+
+// ThumbPath is the URL path of the image's thumbnail.
+func (i *Image) ThumbPath() string {
+	return i.SizePath(SizeThumb)
+}
+
+// Srcset lists the sizes of the image along with the original and
+// their widths, for an img tag's srcset attribute. It is empty if
+// the image has no sizes.
+func (i *Image) Srcset() string {
+	if i.Sizes == "" || i.Width == 0 {
+		return ""
+	}
+	var set []string
+	for _, size := range ImageSizes {
+		if !i.HasSize(size) {
+			continue
+		}
+		w, _ := resize.Dimensions(i.Width, i.Height, size.Pixels())
+		set = append(set, fmt.Sprintf("%s %dw", i.SizePath(size), w))
+	}
+	set = append(set, fmt.Sprintf("%s %dw", i.Path(), i.Width))
+	return strings.Join(set, ", ")
+}
+
+// sizeKey returns the key a size of the image is stored under,
+// with the same checks as blobKey.
+func (is *imageService) sizeKey(i *Image, s ImageSize) (string, error) {
+	key, err := is.blobKey(i)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(path.Dir(key), string(s), i.sizeName()), nil
+}
+
+func (is *imageService) OpenSize(i *Image, s ImageSize) (*ImageFile, error) {
+	if !i.HasSize(s) {
+		return nil, ErrNotFound
+	}
+	key, err := is.sizeKey(i, s)
+	if err != nil {
+		return nil, err
+	}
+	return is.open(key)
+}
+
+// makeSizes decodes the image from f and stores each size smaller
+// than it, recording them in Sizes. It returns ErrImageType if f
+// can't be decoded after all, eg because it was cut short.
+func (is *imageService) makeSizes(i *Image, f io.ReadSeeker) error {
+	i.Sizes = ""
+	if imageExts[i.ContentType] == "" || i.ContentType == "image/webp" {
+		return nil
+	}
+	if i.Width <= SizeThumb.Pixels() && i.Height <= SizeThumb.Pixels() {
+		return nil
+	}
+	// Only images older than the cap can be this big, and they are
+	// served as they are.
+	if i.Width*i.Height > maxImagePixels {
+		return nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return ErrImageType
+	}
+	// Work down from the largest size, scaling each from the one
+	// before rather than from the whole image.
+	var made []string
+	for n := len(ImageSizes) - 1; n >= 0; n-- {
+		size := ImageSizes[n]
+		if i.Width <= size.Pixels() && i.Height <= size.Pixels() {
+			continue
+		}
+		img = resize.Fit(img, size.Pixels())
+		if err := is.writeSize(i, size, img); err != nil {
+			is.removeSizes(i)
+			i.Sizes = ""
+			return err
+		}
+		made = append(made, string(size))
+		i.Sizes = strings.Join(made, " ")
+	}
+	return nil
+}
+
+// writeSize stores img as the size of the image.
+func (is *imageService) writeSize(i *Image, s ImageSize, img image.Image) error {
+	key, err := is.sizeKey(i, s)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	contentType := "image/png"
+	if i.ContentType == "image/jpeg" {
+		contentType = i.ContentType
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: sizeQuality})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return err
+	}
+	return is.store.Put(key, &buf, contentType)
+}
+
+// removeSizes removes the files of every size of the image.
+func (is *imageService) removeSizes(i *Image) error {
+	for _, size := range ImageSizes {
+		if !i.HasSize(size) {
+			continue
+		}
+		key, err := is.sizeKey(i, size)
+		if err != nil {
+			return err
+		}
+		if err := is.store.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
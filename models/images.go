@@ -1,95 +1,640 @@
 package models
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	imagepkg "image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
+	"log"
+	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"muto/rand"
+	"muto/storage"
+
+	"github.com/jinzhu/gorm"
+)
+
+// IMAGE - ERRORS
+const (
+	ErrAvatarInvalid  modelError = "models: avatar must be a JPEG, PNG or GIF image"
+	ErrCaptionTooLong modelError = "models: caption must be 500 characters or less"
+	ErrImagePath      modelError = "models: image is not stored in its gallery"
+	ErrImageType      modelError = "models: only JPEG, PNG, GIF and WebP images can be uploaded"
+	ErrImageTooLarge  modelError = "models: images must be 10 MB or smaller"
+	ErrUploadTooLarge modelError = "models: upload at most 50 MB of images at a time"
+)
+
+const (
+	// MaxImageSize caps the size of a single image, and
+	// MaxUploadSize the size of a whole upload request.
+	MaxImageSize  = 10 << 20 // 10 megabytes
+	MaxUploadSize = 50 << 20 // 50 megabytes
+
+	maxCaptionLength  = 500
+	maxFilenameLength = 255
+	// sniffLen is how many bytes http.DetectContentType looks at.
+	sniffLen = 512
+	// signedURLTTL is how long signed URLs of images work for.
+	signedURLTTL = 15 * time.Minute
 )
 
+// imageExts maps the content types images may have to the
+// extension they are stored with.
+var imageExts = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// Test to verify imageGorm implements the ImageDB interface.
+var _ ImageDB = &imageGorm{}
+
 type ImageService interface {
-	Create(galleryID uint, r io.Reader, filename string) error
+	// Create stores an image and records it in the database. It
+	// returns ErrImageType unless r is a JPEG, PNG, GIF or WebP
+	// image, and ErrImageTooLarge if it is over MaxImageSize.
+	Create(galleryID uint, r io.Reader, filename string) (*Image, error)
+	ByID(id uint) (*Image, error)
+	// ByGalleryID returns the gallery's images in order.
 	ByGalleryID(galleryID uint) ([]Image, error)
-	Delete(i *Image) error
+	// Update saves an image's caption and position.
+	Update(i *Image) error
+	// Delete removes the image with the ID from the gallery. It
+	// returns ErrNotFound if the gallery has no such image.
+	Delete(galleryID, id uint) error
+	// Open returns the contents of an image for reading.
+	// The caller must close it when done.
+	Open(i *Image) (io.ReadCloser, error)
+	// OpenFile opens an image for serving over HTTP. It returns
+	// ErrNotFound if the image doesn't exist, and the caller
+	// must close the file when done.
+	OpenFile(i *Image) (*ImageFile, error)
+	// OpenSize works like OpenFile for a size of the image. It
+	// returns ErrNotFound if the image has no such size.
+	OpenSize(i *Image, s ImageSize) (*ImageFile, error)
+	// SignedURL returns a URL the image, or its size s unless s
+	// is empty, can be downloaded from directly for a while. It
+	// returns "" if the image has to be served through OpenFile.
+	SignedURL(i *Image, s ImageSize) (string, error)
+	// DeleteAll removes every image stored for a gallery.
+	DeleteAll(galleryID uint) error
+	// Import records every stored image file that isn't in the
+	// database yet, such as files uploaded before images were
+	// kept in the database. Images whose file is missing are
+	// logged but kept, as the storage may just be unavailable.
+	// It is only meant to run once, when upgrading, as it would
+	// bring back files whose delete failed halfway.
+	Import() error
+	// CreateAvatar stores a new profile avatar for the account
+	// and returns its URL path. It returns ErrAvatarInvalid unless
+	// r is a JPEG, PNG or GIF image, and the same errors as Create
+	// if it is too large. Previous avatars are kept until
+	// PruneAvatars is called, so the profile can go on using its
+	// old one if saving the new one fails.
+	CreateAvatar(accountID uint, r io.Reader) (string, error)
+	// PruneAvatars removes every avatar of the account except the
+	// one at the URL path keep.
+	PruneAvatars(accountID uint, keep string) error
+	// DeleteAvatar removes every avatar of the account.
+	DeleteAvatar(accountID uint) error
+	// OpenAvatar works like OpenFile for the account's avatar
+	// with the name.
+	OpenAvatar(accountID uint, name string) (*ImageFile, error)
+}
+
+// ImageDB is used to interact with the images table.
+type ImageDB interface {
+	ByID(id uint) (*Image, error)
+	ByGalleryID(galleryID uint) ([]Image, error)
+	// Create adds the image at the end of its gallery unless it
+	// has a position already.
+	Create(i *Image) error
+	Update(i *Image) error
+	Delete(id uint) error
+	DeleteByGalleryID(galleryID uint) error
+}
+
+// ImageFile is an image opened for serving. Unlike the reader
+// returned by Open it can seek, so range requests work, and it
+// knows its size and when it last changed.
+type ImageFile struct {
+	io.ReadSeeker
+	io.Closer
+	Name    string
+	Size    int64
+	ModTime time.Time
 }
 
-// Image is used to represent images stored in a Gallery
-// Image is NOT stored in the database, and
-// instead references data stored on disk.
+// Image is an image in a gallery. The file itself is kept in the
+// ImageService's storage.BlobStore, at Key, and the database
+// describes it.
 type Image struct {
-	GalleryID uint
-	Filename  string
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	GalleryID uint `gorm:"not null;index"`
+	// Filename is the name the image was uploaded with. It is
+	// only for display; see Name.
+	Filename string `gorm:"not null"`
+	// Key is the key the file is stored under.
+	Key         string `gorm:"not null;unique_index"`
+	Size        int64  `gorm:"not null"`
+	ContentType string `gorm:"not null"`
+	// Width and Height are 0 when the dimensions couldn't be read.
+	Width  int `gorm:"not null;default:0"`
+	Height int `gorm:"not null;default:0"`
+	// Checksum is the hex encoded SHA-256 of the file.
+	Checksum string `gorm:"not null"`
+	Position int    `gorm:"not null;default:0"`
+	Caption  string `gorm:"type:text;not null;default:''"`
+	// Sizes lists the ImageSizes made for the image, separated by
+	// spaces.
+	Sizes string `gorm:"not null;default:''"`
 }
 
-type imageService struct{}
+// NewImageService returns an ImageService that keeps image files
+// in store, under keys like "galleries/1/abc.png".
+func NewImageService(db *gorm.DB, store storage.BlobStore) ImageService {
+	return &imageService{
+		ImageDB: &imageValidator{
+			ImageDB: &imageGorm{db},
+		},
+		store: store,
+	}
+}
 
-func NewImageService() ImageService {
-	return &imageService{}
+type imageService struct {
+	ImageDB
+	store storage.BlobStore
 }
 
 func (is *imageService) Create(galleryID uint,
-	r io.Reader, filename string) error {
-	path, err := is.mkImageDir(galleryID)
+	r io.Reader, filename string) (*Image, error) {
+	image := &Image{
+		GalleryID: galleryID,
+		Filename:  filename,
+	}
+	tmp, err := spool(r, image)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	// Store the file under a name of our own, so the uploaded
+	// name can't point anywhere else or replace another image.
+	b, err := rand.Bytes(16)
+	if err != nil {
+		return nil, err
+	}
+	image.Key = galleryPrefix(galleryID) + hex.EncodeToString(b) +
+		imageExts[image.ContentType]
+	err = is.makeSizes(image, tmp)
+	if err == nil {
+		err = is.put(image, tmp)
+	}
+	if err == nil {
+		err = is.ImageDB.Create(image)
+	}
+	if err != nil {
+		// Don't leave files behind that no row points at.
+		is.removeSizes(image)
+		is.store.Delete(image.Key)
+		return nil, err
+	}
+	return image, nil
+}
+
+// spool copies the image read from r to a temporary file, so only
+// images that pass every check are stored, and describes it in
+// image. It returns ErrImageType unless r is a JPEG, PNG, GIF or
+// WebP image, ErrImageTooLarge if it is over MaxImageSize and
+// ErrImagePixels if it is over maxImagePixels. The caller must
+// close and remove the file.
+func spool(r io.Reader, image *Image) (*os.File, error) {
+	// Sniff the type from the first bytes rather than trusting
+	// the filename or the Content-Type the browser sent.
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	image.ContentType = http.DetectContentType(head)
+	if _, ok := imageExts[image.ContentType]; !ok {
+		return nil, ErrImageType
+	}
+	tmp, err := os.CreateTemp("", "muto-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	// Copy reader data to the temporary file, hashing it on the
+	// way. Reading one byte past the limit tells us whether the
+	// image is too large.
+	h := sha256.New()
+	image.Size, err = io.Copy(io.MultiWriter(tmp, h),
+		io.LimitReader(br, MaxImageSize+1))
+	if err == nil && image.Size > MaxImageSize {
+		err = ErrImageTooLarge
+	}
+	if err == nil {
+		image.Checksum = hex.EncodeToString(h.Sum(nil))
+		err = describeImage(tmp, image)
+	}
+	if err == nil && image.Width*image.Height > maxImagePixels {
+		err = ErrImagePixels
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// put stores the contents of f as the image's file.
+func (is *imageService) put(i *Image, f io.ReadSeeker) error {
+	key, err := is.blobKey(i)
 	if err != nil {
 		return err
 	}
-	// Create a destination file
-	dst, err := os.Create(filepath.Join(path, filename))
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return is.store.Put(key, f, i.ContentType)
+}
+
+// Delete looks the image up itself rather than trusting one it is
+// given, so only files recorded for the gallery can be removed.
+// The row goes before the file: a file without a row is never
+// served and is only wasted space, while a row without a file
+// would be a broken image.
+func (is *imageService) Delete(galleryID, id uint) error {
+	i, err := is.ImageDB.ByID(id)
 	if err != nil {
 		return err
 	}
-	defer dst.Close()
-	// Copy reader data to the destination file
-	_, err = io.Copy(dst, r)
+	if i.GalleryID != galleryID {
+		return ErrNotFound
+	}
+	key, err := is.blobKey(i)
 	if err != nil {
 		return err
 	}
-	return nil
+	if err := is.ImageDB.Delete(i.ID); err != nil {
+		return err
+	}
+	if err := is.removeSizes(i); err != nil {
+		return err
+	}
+	return is.store.Delete(key)
+}
+
+func (is *imageService) Open(i *Image) (io.ReadCloser, error) {
+	return is.OpenFile(i)
+}
+
+func (is *imageService) OpenFile(i *Image) (*ImageFile, error) {
+	key, err := is.blobKey(i)
+	if err != nil {
+		return nil, err
+	}
+	return is.open(key)
+}
+
+func (is *imageService) SignedURL(i *Image, s ImageSize) (string, error) {
+	key, err := is.blobKey(i)
+	if s != "" && err == nil {
+		if !i.HasSize(s) {
+			return "", ErrNotFound
+		}
+		key, err = is.sizeKey(i, s)
+	}
+	if err != nil {
+		return "", err
+	}
+	return is.store.SignedURL(key, signedURLTTL)
 }
 
-func (is *imageService) Delete(i *Image) error {
-	return os.Remove(i.RelativePath())
+// blobKey returns the key the image is stored under. It returns
+// ErrImagePath unless that is directly inside the directory of the
+// image's gallery, so a key like "galleries/1/../2/x.png" can't
+// reach another gallery's files, or anything else. Backslashes are
+// refused too, as a store on Windows would take them for slashes.
+func (is *imageService) blobKey(i *Image) (string, error) {
+	if i.GalleryID == 0 || strings.Contains(i.Key, `\`) ||
+		path.Clean(i.Key) != i.Key ||
+		path.Dir(i.Key)+"/" != galleryPrefix(i.GalleryID) {
+		return "", ErrImagePath
+	}
+	return i.Key, nil
 }
 
-func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
-	path := is.imageDir(galleryID)
-	strings, err := filepath.Glob(filepath.Join(path, "*"))
+// open opens the blob under key as an ImageFile.
+func (is *imageService) open(key string) (*ImageFile, error) {
+	blob, err := is.store.Get(key)
+	if err == storage.ErrNotFound {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
-	// Setup the Image slice we are returning
-	ret := make([]Image, len(strings))
-	for i, imgStr := range strings {
-		ret[i] = Image{
-			Filename:  filepath.Base(imgStr),
+	return &ImageFile{
+		ReadSeeker: blob.ReadSeeker,
+		Closer:     blob.Closer,
+		Name:       path.Base(key),
+		Size:       blob.Size,
+		ModTime:    blob.ModTime,
+	}, nil
+}
+
+// DeleteAll removes every file stored for the gallery, including
+// any the database doesn't know about.
+func (is *imageService) DeleteAll(galleryID uint) error {
+	if err := is.ImageDB.DeleteByGalleryID(galleryID); err != nil {
+		return err
+	}
+	return is.deletePrefix(galleryPrefix(galleryID))
+}
+
+// deletePrefix removes every blob whose key starts with prefix.
+func (is *imageService) deletePrefix(prefix string) error {
+	keys, err := is.store.List(prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := is.store.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (is *imageService) Import() error {
+	keys, err := is.store.List("galleries/")
+	if err != nil {
+		return err
+	}
+	// Group the images by gallery, leaving out sizes, which are
+	// a directory further down.
+	byGallery := make(map[uint][]string)
+	var ids []uint
+	for _, key := range keys {
+		parts := strings.Split(key, "/")
+		if len(parts) != 3 {
+			continue
+		}
+		id, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if byGallery[uint(id)] == nil {
+			ids = append(ids, uint(id))
+		}
+		byGallery[uint(id)] = append(byGallery[uint(id)], key)
+	}
+	for _, id := range ids {
+		if err := is.importGallery(id, byGallery[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importGallery records the gallery's files, stored under keys,
+// that aren't in the database, in name order like they used to be
+// listed.
+func (is *imageService) importGallery(galleryID uint, keys []string) error {
+	images, err := is.ImageDB.ByGalleryID(galleryID)
+	if err != nil {
+		return err
+	}
+	stored := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		stored[key] = true
+	}
+	known := make(map[string]bool, len(images))
+	for _, image := range images {
+		known[image.Key] = true
+		if !stored[image.Key] {
+			log.Printf("models: image %d is missing its file %s",
+				image.ID, image.Key)
+		}
+	}
+	for _, key := range keys {
+		if known[key] {
+			continue
+		}
+		image := Image{
 			GalleryID: galleryID,
+			Filename:  path.Base(key),
+			Key:       key,
+		}
+		f, err := is.open(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		image.Size, err = io.Copy(h, f)
+		if err == nil {
+			image.Checksum = hex.EncodeToString(h.Sum(nil))
+			image.CreatedAt = f.ModTime
+			err = describeImage(f, &image)
+		}
+		if err == nil {
+			err = is.makeSizes(&image, f)
+		}
+		// Files uploaded before we checked what they were are
+		// kept, and served as downloads if they aren't images.
+		if err == ErrImageType {
+			err = nil
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if err := is.ImageDB.Create(&image); err != nil {
+			return err
 		}
 	}
-	return ret, nil
+	return nil
 }
 
-// Use this function when we know it is already made.
-func (is *imageService) imageDir(galleryID uint) string {
-	// Create the directory to contain our images
-	// filepath.Join will return a path like:
-	// images/galleries/123
-	// We use filepath.Join instead of building the path
-	// manually because the slashes and other characters
-	// could vary between operating systems.
-	return filepath.Join("images", "galleries",
-		fmt.Sprintf("%v", galleryID))
+// describeImage sets the dimensions of image from f, and its
+// content type when it doesn't have one yet. It returns
+// ErrImageType if f can't be decoded, as it only looks like an
+// image. WebP images are taken on trust and have no dimensions,
+// as the standard library can't read them.
+func describeImage(f io.ReadSeeker, image *Image) error {
+	if image.ContentType == "" {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		head := make([]byte, sniffLen)
+		n, err := io.ReadFull(f, head)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		image.ContentType = http.DetectContentType(head[:n])
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	config, _, err := imagepkg.DecodeConfig(f)
+	if err == nil {
+		image.Width = config.Width
+		image.Height = config.Height
+		return nil
+	}
+	if image.ContentType == "image/webp" {
+		return nil
+	}
+	return ErrImageType
 }
 
-func (is *imageService) mkImageDir(galleryID uint) (string, error) {
-	galleryPath := is.imageDir(galleryID)
-	// Create our directory (and any necessary parent dirs)
-	// using 0755 permissions.
-	err := os.MkdirAll(galleryPath, 0755)
+// CreateAvatar checks avatars like Create checks images, and
+// stores them with the extension of the type they turned out to be
+// rather than the one they were uploaded with.
+func (is *imageService) CreateAvatar(accountID uint, r io.Reader) (string, error) {
+	var avatar Image
+	tmp, err := spool(r, &avatar)
+	if err == ErrImageType {
+		return "", ErrAvatarInvalid
+	}
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	// Avatars are shown as they are, so WebP is left out as we
+	// can't check what it decodes to.
+	if avatar.ContentType == "image/webp" {
+		return "", ErrAvatarInvalid
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	// Every avatar gets a name of its own, so a new one never
+	// replaces the one the profile still points at, and browsers
+	// that cached the old one see the new one straight away.
+	b, err := rand.Bytes(16)
 	if err != nil {
 		return "", err
 	}
-	return galleryPath, nil
+	key := avatarPrefix(accountID) + hex.EncodeToString(b) +
+		imageExts[avatar.ContentType]
+	if err := is.store.Put(key, tmp, avatar.ContentType); err != nil {
+		return "", err
+	}
+	temp := url.URL{
+		Path: "/images/" + key,
+	}
+	return temp.String(), nil
+}
+
+func (is *imageService) PruneAvatars(accountID uint, keep string) error {
+	keys, err := is.store.List(avatarPrefix(accountID))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if "/images/"+key == keep {
+			continue
+		}
+		if err := is.store.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (is *imageService) DeleteAvatar(accountID uint) error {
+	return is.deletePrefix(avatarPrefix(accountID))
+}
+
+func (is *imageService) OpenAvatar(accountID uint, name string) (*ImageFile, error) {
+	// Avatars are kept directly in the account's directory, and
+	// none of their names start with a dot.
+	if path.Base(name) != name || strings.HasPrefix(name, ".") {
+		return nil, ErrNotFound
+	}
+	return is.open(avatarPrefix(accountID) + name)
+}
+
+// countedImages keeps the ImageCount of galleries up to date as
+// images are added and removed.
+type countedImages struct {
+	ImageService
+	gs GalleryDB
+}
+
+func (ci *countedImages) Create(galleryID uint, r io.Reader, filename string) (*Image, error) {
+	image, err := ci.ImageService.Create(galleryID, r, filename)
+	if err != nil {
+		return nil, err
+	}
+	return image, ci.count(galleryID)
+}
+
+func (ci *countedImages) Delete(galleryID, id uint) error {
+	if err := ci.ImageService.Delete(galleryID, id); err != nil {
+		return err
+	}
+	return ci.count(galleryID)
+}
+
+func (ci *countedImages) DeleteAll(galleryID uint) error {
+	if err := ci.ImageService.DeleteAll(galleryID); err != nil {
+		return err
+	}
+	return ci.gs.SetImageCount(galleryID, 0)
+}
+
+// count recounts the images of a gallery. Counting what is stored
+// rather than adding and subtracting means the count corrects
+// itself, eg after an upload that failed halfway.
+func (ci *countedImages) count(galleryID uint) error {
+	images, err := ci.ImageService.ByGalleryID(galleryID)
+	if err != nil {
+		return err
+	}
+	return ci.gs.SetImageCount(galleryID, len(images))
+}
+
+// galleryPrefix returns the prefix of the keys of a gallery's
+// images, like galleries/123/
+func galleryPrefix(galleryID uint) string {
+	return fmt.Sprintf("galleries/%d/", galleryID)
+}
+
+// avatarPrefix returns the prefix of the keys of an account's
+// avatar, like avatars/123/
+func avatarPrefix(accountID uint) string {
+	return fmt.Sprintf("avatars/%d/", accountID)
+}
+
+// Name is the name the image is stored under, which identifies
+// it within its gallery, eg in URLs and as a gallery's cover.
+// Images stored before keys were generated keep the name they
+// were uploaded with.
+func (i *Image) Name() string {
+	return path.Base(i.Key)
 }
 
 // Path is used to build the absolute path
@@ -97,16 +642,157 @@ func (is *imageService) mkImageDir(galleryID uint) (string, error) {
 // via a web request.
 func (i *Image) Path() string {
 	temp := url.URL{
-		Path: "/" + i.RelativePath(),
+		Path: fmt.Sprintf("/images/galleries/%d/%s", i.GalleryID, i.Name()),
 	}
 	return temp.String()
 }
 
-// RelativePath is used to build the path to this image
-// on our local disk, relative to where our
-// Go application is run from.
-func (i *Image) RelativePath() string {
-	// Convert the gallery ID to a string
-	galleryID := fmt.Sprintf("%v", i.GalleryID)
-	return filepath.ToSlash(filepath.Join("images", "galleries", galleryID, i.Filename))
+// imageValidator is our validation layer that validates and
+// normalizes images before passing them to the ImageDB.
+type imageValidator struct {
+	ImageDB
+}
+
+type imageValFn func(*Image) error
+
+func runImageValFns(image *Image, fns ...imageValFn) error {
+	for _, fn := range fns {
+		if err := fn(image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IMAGE - VALIDATION - galleryIDRequired
+func (iv *imageValidator) galleryIDRequired(i *Image) error {
+	if i.GalleryID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+// IMAGE - VALIDATION - cleanFilename tidies up the name the image
+// was uploaded with. It is only ever shown, never used as a path,
+// so rather than rejecting odd names we make the best of them.
+func (iv *imageValidator) cleanFilename(i *Image) error {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, i.Filename)
+	// Some browsers send the full path the file was picked from.
+	name = name[strings.LastIndexAny(name, `/\`)+1:]
+	name = strings.TrimSpace(name)
+	for utf8.RuneCountInString(name) > maxFilenameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "" || name == "." || name == ".." {
+		name = path.Base(i.Key)
+	}
+	i.Filename = name
+	return nil
+}
+
+// IMAGE - VALIDATION - captionLength
+func (iv *imageValidator) captionLength(i *Image) error {
+	i.Caption = strings.TrimSpace(i.Caption)
+	if utf8.RuneCountInString(i.Caption) > maxCaptionLength {
+		return ErrCaptionTooLong
+	}
+	return nil
+}
+
+// IMAGE - VALIDATION - ByID
+func (iv *imageValidator) ByID(id uint) (*Image, error) {
+	if id <= 0 {
+		return nil, ErrIDInvalid
+	}
+	return iv.ImageDB.ByID(id)
+}
+
+// IMAGE - VALIDATION - Create
+func (iv *imageValidator) Create(i *Image) error {
+	err := runImageValFns(i,
+		iv.galleryIDRequired,
+		iv.cleanFilename,
+		iv.captionLength)
+	if err != nil {
+		return err
+	}
+	return iv.ImageDB.Create(i)
+}
+
+// IMAGE - VALIDATION - Update
+func (iv *imageValidator) Update(i *Image) error {
+	err := runImageValFns(i,
+		iv.galleryIDRequired,
+		iv.cleanFilename,
+		iv.captionLength)
+	if err != nil {
+		return err
+	}
+	return iv.ImageDB.Update(i)
+}
+
+// IMAGE - VALIDATION - Delete
+func (iv *imageValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return iv.ImageDB.Delete(id)
+}
+
+// imageGorm represents our database interaction layer
+// and implements the ImageDB interface fully.
+type imageGorm struct {
+	db *gorm.DB
+}
+
+// IMAGE - GORM - ByID
+func (ig *imageGorm) ByID(id uint) (*Image, error) {
+	var image Image
+	if err := first(ig.db.Where("id = ?", id), &image); err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// IMAGE - GORM - ByGalleryID
+func (ig *imageGorm) ByGalleryID(galleryID uint) ([]Image, error) {
+	var images []Image
+	err := ig.db.Where("gallery_id = ?", galleryID).
+		Order("position, id").Find(&images).Error
+	return images, err
+}
+
+// IMAGE - GORM - Create
+func (ig *imageGorm) Create(i *Image) error {
+	if i.Position == 0 {
+		var last struct{ Position int }
+		err := ig.db.Model(&Image{}).Select("COALESCE(MAX(position), 0) AS position").
+			Where("gallery_id = ?", i.GalleryID).Scan(&last).Error
+		if err != nil {
+			return err
+		}
+		i.Position = last.Position + 1
+	}
+	return ig.db.Create(i).Error
+}
+
+// IMAGE - GORM - Update
+func (ig *imageGorm) Update(i *Image) error {
+	return ig.db.Save(i).Error
+}
+
+// IMAGE - GORM - Delete
+func (ig *imageGorm) Delete(id uint) error {
+	return ig.db.Where("id = ?", id).Delete(&Image{}).Error
+}
+
+// IMAGE - GORM - DeleteByGalleryID
+func (ig *imageGorm) DeleteByGalleryID(galleryID uint) error {
+	return ig.db.Where("gallery_id = ?", galleryID).Delete(&Image{}).Error
 }
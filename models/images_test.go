@@ -0,0 +1,167 @@
+package models
+
+import (
+	"strings"
+	"testing"
+
+	"muto/storage"
+)
+
+// fakeImageDB keeps images in a map, so the imageService can be
+// tested without a database.
+type fakeImageDB struct {
+	images map[uint]*Image
+}
+
+func (db *fakeImageDB) ByID(id uint) (*Image, error) {
+	i, ok := db.images[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	image := *i
+	return &image, nil
+}
+
+func (db *fakeImageDB) ByGalleryID(galleryID uint) ([]Image, error) {
+	var images []Image
+	for _, i := range db.images {
+		if i.GalleryID == galleryID {
+			images = append(images, *i)
+		}
+	}
+	return images, nil
+}
+
+func (db *fakeImageDB) Create(i *Image) error {
+	i.ID = uint(len(db.images) + 1)
+	image := *i
+	db.images[i.ID] = &image
+	return nil
+}
+
+func (db *fakeImageDB) Update(i *Image) error {
+	image := *i
+	db.images[i.ID] = &image
+	return nil
+}
+
+func (db *fakeImageDB) Delete(id uint) error {
+	delete(db.images, id)
+	return nil
+}
+
+func (db *fakeImageDB) DeleteByGalleryID(galleryID uint) error {
+	for id, i := range db.images {
+		if i.GalleryID == galleryID {
+			delete(db.images, id)
+		}
+	}
+	return nil
+}
+
+func newTestImageService(t *testing.T) (*imageService, *fakeImageDB) {
+	t.Helper()
+	db := &fakeImageDB{images: make(map[uint]*Image)}
+	return &imageService{
+		ImageDB: db,
+		store:   storage.NewLocal(t.TempDir()),
+	}, db
+}
+
+func TestBlobKey(t *testing.T) {
+	is, _ := newTestImageService(t)
+	tests := []struct {
+		name      string
+		galleryID uint
+		key       string
+		wantErr   bool
+	}{
+		{"generated key", 1, "galleries/1/0123abcd.png", false},
+		{"uploaded name", 1, "galleries/1/My Photo.jpg", false},
+		{"escaped dots are just a name", 1, "galleries/1/%2e%2e", false},
+		{"dot dot into another gallery", 1, "galleries/1/../2/x.png", true},
+		{"escaped dot dot directory", 1, "galleries/1/%2e%2e/x", true},
+		{"backslashes", 1, `galleries/1/a\..\b`, true},
+		{"backslash name", 1, `galleries/1/..\x.png`, true},
+		{"absolute", 1, "/galleries/1/x.png", true},
+		{"absolute elsewhere", 1, "/etc/passwd", true},
+		{"another gallery", 1, "galleries/2/x.png", true},
+		{"gallery with a longer ID", 1, "galleries/10/x.png", true},
+		{"size directory", 1, "galleries/1/thumb/x.png", true},
+		{"gallery directory", 1, "galleries/1", true},
+		{"trailing slash", 1, "galleries/1/", true},
+		{"unclean", 1, "galleries/1/./x.png", true},
+		{"avatar", 1, "avatars/1/x.png", true},
+		{"empty", 1, "", true},
+		{"no gallery", 0, "galleries/0/x.png", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := is.blobKey(&Image{GalleryID: tc.galleryID, Key: tc.key})
+			if tc.wantErr {
+				if err != ErrImagePath {
+					t.Errorf("blobKey(%q) = %q, %v, want ErrImagePath", tc.key, key, err)
+				}
+				return
+			}
+			if err != nil || key != tc.key {
+				t.Errorf("blobKey(%q) = %q, %v, want the key back", tc.key, key, err)
+			}
+		})
+	}
+}
+
+func TestDeleteOtherGallery(t *testing.T) {
+	is, db := newTestImageService(t)
+	put := func(key string) {
+		t.Helper()
+		if err := is.store.Put(key, strings.NewReader("x"), "image/png"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored := func(key string) bool {
+		t.Helper()
+		blob, err := is.store.Get(key)
+		if err == storage.ErrNotFound {
+			return false
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob.Close()
+		return true
+	}
+	put("galleries/2/x.png")
+	image := &Image{GalleryID: 2, Key: "galleries/2/x.png"}
+	db.Create(image)
+	// A row of gallery 1 pointing at a file of gallery 2, as a
+	// tampered row might.
+	stray := &Image{GalleryID: 1, Key: "galleries/1/../2/x.png"}
+	db.Create(stray)
+
+	if err := is.Delete(1, image.ID); err != ErrNotFound {
+		t.Errorf("Delete() from another gallery err = %v, want ErrNotFound", err)
+	}
+	if err := is.Delete(1, stray.ID); err != ErrImagePath {
+		t.Errorf("Delete() of a key outside its gallery err = %v, want ErrImagePath", err)
+	}
+	if _, err := db.ByID(image.ID); err != nil {
+		t.Errorf("image row is gone: %v", err)
+	}
+	if _, err := db.ByID(stray.ID); err != nil {
+		t.Errorf("stray row is gone: %v", err)
+	}
+	if !stored("galleries/2/x.png") {
+		t.Fatal("file was removed by another gallery")
+	}
+
+	if err := is.Delete(2, image.ID); err != nil {
+		t.Fatalf("Delete() from its own gallery err = %v", err)
+	}
+	if stored("galleries/2/x.png") {
+		t.Error("file is still stored after Delete()")
+	}
+	if _, err := db.ByID(image.ID); err != ErrNotFound {
+		t.Errorf("ByID() after Delete() err = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,357 @@
+package models
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// LOGIN THROTTLE - ERRORS
+const (
+	ErrTooManyAttempts modelError = "models: too many failed sign in attempts, please try again later"
+)
+
+const (
+	// accountFreeAttempts and ipFreeAttempts are how many failures
+	// we allow before locking an account or IP address out. An IP
+	// gets more room since many people can share one address.
+	accountFreeAttempts = 5
+	ipFreeAttempts      = 20
+	// lockoutBase is the first lockout duration. Every further
+	// failure doubles it, up to lockoutMax.
+	lockoutBase = time.Minute
+	lockoutMax  = time.Hour
+	// attemptWindow is how long failures are remembered for.
+	attemptWindow = 24 * time.Hour
+	// memoryLockouts is how many lockout records the in-memory
+	// store keeps. Older ones are dropped.
+	memoryLockouts = 1000
+)
+
+// Test to verify both stores implement the AttemptStore interface.
+var _ AttemptStore = &attemptMemory{}
+var _ AttemptStore = &attemptGorm{}
+
+// Lockout is an audit record written every time an account or
+// IP address gets locked out.
+type Lockout struct {
+	ID        uint      `gorm:"primary_key"`
+	Key       string    `gorm:"not null;index"`
+	IP        string    `gorm:"not null"`
+	Failures  int       `gorm:"not null"`
+	Until     time.Time `gorm:"not null"`
+	CreatedAt time.Time
+}
+
+// LoginThrottle tracks failed sign in attempts per account and per
+// IP address and refuses further attempts with an exponentially
+// growing lockout once too many have failed. Other passwords,
+// like those of share links, are throttled the same way by
+// passing a name for what is unlocked in place of the email.
+//
+// Every attempt Allow lets through is counted straight away, so
+// attempts made at the same time can't all slip in under the
+// limit. It stays counted as a failure unless Succeeded is called.
+type LoginThrottle interface {
+	// Allow returns ErrTooManyAttempts if either the email
+	// address or the IP address is currently locked out, and
+	// counts the attempt against both otherwise.
+	Allow(email, ip string) error
+	// Failed confirms that an attempt let through by Allow
+	// failed, recording any lockout it caused.
+	Failed(email, ip string) error
+	// Succeeded clears the failures recorded for the email and
+	// gives the IP back the attempt Allow counted.
+	Succeeded(email, ip string) error
+}
+
+// AttemptStore is where a LoginThrottle keeps its counts. We
+// provide an in-memory store for development and tests and a
+// Postgres store that is shared between app servers.
+type AttemptStore interface {
+	// Failures returns the failure count for the key and the
+	// time of the most recent failure.
+	Failures(key string) (int, time.Time, error)
+	// Reserve counts an attempt made at at for the key and
+	// returns the new count, unless the key is locked out with
+	// free attempts allowed, when it returns ErrTooManyAttempts.
+	// Failures older than attemptWindow are forgotten first. The
+	// check and the count happen atomically.
+	Reserve(key string, free int, at time.Time) (int, error)
+	// Release takes back one attempt counted by Reserve.
+	Release(key string) error
+	// Reset forgets every failure recorded for the key.
+	Reset(key string) error
+	// RecordLockout stores the audit record for a lockout.
+	RecordLockout(l *Lockout) error
+}
+
+// NewLoginThrottle
+func NewLoginThrottle(store AttemptStore) LoginThrottle {
+	return &loginThrottle{
+		store: store,
+		now:   time.Now,
+	}
+}
+
+type loginThrottle struct {
+	store AttemptStore
+	now   func() time.Time
+}
+
+func (lt *loginThrottle) Allow(email, ip string) error {
+	now := lt.now()
+	account := accountKey(email)
+	if _, err := lt.store.Reserve(account, accountFreeAttempts, now); err != nil {
+		return err
+	}
+	if _, err := lt.store.Reserve(ipKey(ip), ipFreeAttempts, now); err != nil {
+		// The attempt is refused, so it mustn't count against
+		// the account either.
+		if err := lt.store.Release(account); err != nil {
+			return err
+		}
+		return err
+	}
+	return nil
+}
+
+func (lt *loginThrottle) Failed(email, ip string) error {
+	if err := lt.recordLockout(accountKey(email), ip, accountFreeAttempts); err != nil {
+		return err
+	}
+	return lt.recordLockout(ipKey(ip), ip, ipFreeAttempts)
+}
+
+func (lt *loginThrottle) Succeeded(email, ip string) error {
+	if err := lt.store.Reset(accountKey(email)); err != nil {
+		return err
+	}
+	// The rest of the IP address's failures are deliberately left
+	// alone, otherwise an attacker could clear their count by
+	// signing in to an account of their own between guesses.
+	return lt.store.Release(ipKey(ip))
+}
+
+// recordLockout writes an audit record if the failures counted
+// for key lock it out.
+func (lt *loginThrottle) recordLockout(key, ip string, free int) error {
+	n, last, err := lt.store.Failures(key)
+	if err != nil {
+		return err
+	}
+	if n < free {
+		return nil
+	}
+	return lt.store.RecordLockout(&Lockout{
+		Key:      key,
+		IP:       ip,
+		Failures: n,
+		Until:    lockedUntil(n, free, last),
+	})
+}
+
+// lockedUntil works out when a key with n failures, the last at
+// last, may try again.
+func lockedUntil(n, free int, last time.Time) time.Time {
+	if n < free {
+		return time.Time{}
+	}
+	d := lockoutBase
+	for i := free; i < n && d < lockoutMax; i++ {
+		d *= 2
+	}
+	if d > lockoutMax {
+		d = lockoutMax
+	}
+	return last.Add(d)
+}
+
+// lockoutDoublings is how many times lockoutBase can double before
+// it reaches lockoutMax.
+func lockoutDoublings() int {
+	n := 0
+	for d := lockoutBase; d < lockoutMax; d *= 2 {
+		n++
+	}
+	return n
+}
+
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// NewAttemptMemory returns an AttemptStore that keeps everything
+// in memory. Counts are lost on restart and are not shared between
+// processes, so it is best suited to development and tests.
+func NewAttemptMemory() AttemptStore {
+	return &attemptMemory{
+		attempts: make(map[string]loginAttempt),
+	}
+}
+
+type attemptMemory struct {
+	mu       sync.Mutex
+	attempts map[string]loginAttempt
+	lockouts []Lockout
+	// pruned is when attempts last had the failures older than
+	// attemptWindow removed.
+	pruned time.Time
+}
+
+func (am *attemptMemory) Failures(key string) (int, time.Time, error) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	a := am.attempts[key]
+	return a.Failures, a.LastFailedAt, nil
+}
+
+func (am *attemptMemory) Reserve(key string, free int, at time.Time) (int, error) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	am.prune(at)
+	a := am.attempts[key]
+	if !a.LastFailedAt.IsZero() && at.Sub(a.LastFailedAt) > attemptWindow {
+		a = loginAttempt{}
+	}
+	if at.Before(lockedUntil(a.Failures, free, a.LastFailedAt)) {
+		return a.Failures, ErrTooManyAttempts
+	}
+	a.Key = key
+	a.Failures++
+	a.LastFailedAt = at
+	am.attempts[key] = a
+	return a.Failures, nil
+}
+
+func (am *attemptMemory) Release(key string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	a, ok := am.attempts[key]
+	if !ok {
+		return nil
+	}
+	a.Failures--
+	if a.Failures <= 0 {
+		delete(am.attempts, key)
+		return nil
+	}
+	am.attempts[key] = a
+	return nil
+}
+
+func (am *attemptMemory) Reset(key string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	delete(am.attempts, key)
+	return nil
+}
+
+func (am *attemptMemory) RecordLockout(l *Lockout) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	l.CreatedAt = time.Now()
+	if len(am.lockouts) >= memoryLockouts {
+		n := copy(am.lockouts, am.lockouts[len(am.lockouts)-memoryLockouts+1:])
+		am.lockouts = am.lockouts[:n]
+	}
+	am.lockouts = append(am.lockouts, *l)
+	return nil
+}
+
+// prune forgets every key whose last failure is older than
+// attemptWindow, as the throttle would reset it anyway. Otherwise
+// every address that ever failed once would be kept forever. It
+// only looks at every key once a minute, so failing stays cheap.
+func (am *attemptMemory) prune(now time.Time) {
+	if now.Sub(am.pruned) < time.Minute {
+		return
+	}
+	am.pruned = now
+	for key, a := range am.attempts {
+		if now.Sub(a.LastFailedAt) > attemptWindow {
+			delete(am.attempts, key)
+		}
+	}
+}
+
+// loginAttempt is the failure count we keep for each key.
+type loginAttempt struct {
+	Key          string    `gorm:"primary_key"`
+	Failures     int       `gorm:"not null"`
+	LastFailedAt time.Time `gorm:"not null"`
+}
+
+// NewAttemptGorm returns an AttemptStore backed by Postgres.
+func NewAttemptGorm(db *gorm.DB) AttemptStore {
+	return &attemptGorm{db}
+}
+
+type attemptGorm struct {
+	db *gorm.DB
+}
+
+// GORM - Failures
+func (ag *attemptGorm) Failures(key string) (int, time.Time, error) {
+	var a loginAttempt
+	err := first(ag.db.Where("key = ?", key), &a)
+	switch err {
+	case nil:
+		return a.Failures, a.LastFailedAt, nil
+	case ErrNotFound:
+		return 0, time.Time{}, nil
+	default:
+		return 0, time.Time{}, err
+	}
+}
+
+// GORM - Reserve checks the lockout and counts the attempt in a
+// single statement, so concurrent attempts can't all get past the
+// check before any of them is counted. The row is only updated
+// when the key has free attempts left, its failures have expired
+// or its lockout is over, which is lockedUntil in SQL.
+func (ag *attemptGorm) Reserve(key string, free int, at time.Time) (int, error) {
+	var n int
+	expired := at.Add(-attemptWindow)
+	err := ag.db.Raw(`INSERT INTO login_attempts (key, failures, last_failed_at)
+		VALUES (?, 1, ?)
+		ON CONFLICT (key) DO UPDATE
+		SET failures = CASE WHEN login_attempts.last_failed_at < ? THEN 1
+				ELSE login_attempts.failures + 1 END,
+			last_failed_at = EXCLUDED.last_failed_at
+		WHERE login_attempts.failures < ?
+			OR login_attempts.last_failed_at < ?
+			OR login_attempts.last_failed_at + interval '1 second' *
+				LEAST(? * power(2, LEAST(login_attempts.failures - ?, ?)), ?) <= ?
+		RETURNING failures`,
+		key, at, expired, free, expired,
+		lockoutBase.Seconds(), free, lockoutDoublings(), lockoutMax.Seconds(), at).
+		Row().Scan(&n)
+	if err == sql.ErrNoRows {
+		return 0, ErrTooManyAttempts
+	}
+	return n, err
+}
+
+// GORM - Release
+func (ag *attemptGorm) Release(key string) error {
+	return ag.db.Model(&loginAttempt{}).Where("key = ? AND failures > 0", key).
+		UpdateColumn("failures", gorm.Expr("failures - 1")).Error
+}
+
+// GORM - Reset
+func (ag *attemptGorm) Reset(key string) error {
+	return ag.db.Where("key = ?", key).Delete(&loginAttempt{}).Error
+}
+
+// GORM - RecordLockout
+func (ag *attemptGorm) RecordLockout(l *Lockout) error {
+	return ag.db.Create(l).Error
+}
@@ -0,0 +1,179 @@
+package models
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestThrottle returns a throttle on an in-memory store with a
+// clock the test moves by hand.
+func newTestThrottle() (*loginThrottle, *time.Time) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	return &loginThrottle{
+		store: NewAttemptMemory(),
+		now:   func() time.Time { return now },
+	}, &now
+}
+
+// fail makes n failed attempts for email from ip.
+func fail(t *testing.T, lt *loginThrottle, email, ip string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := lt.Allow(email, ip); err != nil {
+			t.Fatalf("attempt %d: Allow() err = %v", i+1, err)
+		}
+		if err := lt.Failed(email, ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLockedUntil(t *testing.T) {
+	last := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		n    int
+		want time.Duration
+	}{
+		{"free attempts left", accountFreeAttempts - 1, -1},
+		{"first lockout", accountFreeAttempts, lockoutBase},
+		{"doubles", accountFreeAttempts + 1, 2 * lockoutBase},
+		{"doubles again", accountFreeAttempts + 2, 4 * lockoutBase},
+		{"capped", accountFreeAttempts + 6, lockoutMax},
+		{"stays capped", accountFreeAttempts + 1000, lockoutMax},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := lockedUntil(tc.n, accountFreeAttempts, last)
+			if tc.want < 0 {
+				if !got.IsZero() {
+					t.Errorf("lockedUntil() = %v, want no lockout", got)
+				}
+				return
+			}
+			if want := last.Add(tc.want); !got.Equal(want) {
+				t.Errorf("lockedUntil() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	const email, ip = "pat@example.com", "192.0.2.1"
+	tests := []struct {
+		name string
+		// run fails or succeeds some attempts and moves the clock.
+		run       func(t *testing.T, lt *loginThrottle, now *time.Time)
+		wantAllow bool
+	}{
+		{"free attempts", func(t *testing.T, lt *loginThrottle, now *time.Time) {
+			fail(t, lt, email, ip, accountFreeAttempts-1)
+		}, true},
+		{"locked after the free attempts", func(t *testing.T, lt *loginThrottle, now *time.Time) {
+			fail(t, lt, email, ip, accountFreeAttempts)
+		}, false},
+		{"first lockout ends", func(t *testing.T, lt *loginThrottle, now *time.Time) {
+			fail(t, lt, email, ip, accountFreeAttempts)
+			*now = now.Add(lockoutBase)
+		}, true},
+		{"lockout doubles", func(t *testing.T, lt *loginThrottle, now *time.Time) {
+			fail(t, lt, email, ip, accountFreeAttempts)
+			*now = now.Add(lockoutBase)
+			fail(t, lt, email, ip, 1)
+			*now = now.Add(2*lockoutBase - time.Second)
+		}, false},
+		{"doubled lockout ends", func(t *testing.T, lt *loginThrottle, now *time.Time) {
+			fail(t, lt, email, ip, accountFreeAttempts)
+			*now = now.Add(lockoutBase)
+			fail(t, lt, email, ip, 1)
+			*now = now.Add(2 * lockoutBase)
+		}, true},
+		{"lockout is capped", func(t *testing.T, lt *loginThrottle, now *time.Time) {
+			fail(t, lt, email, ip, accountFreeAttempts)
+			for i := 0; i < 10; i++ {
+				*now = now.Add(lockoutMax)
+				fail(t, lt, email, ip, 1)
+			}
+			*now = now.Add(lockoutMax)
+		}, true},
+		{"failures expire", func(t *testing.T, lt *loginThrottle, now *time.Time) {
+			fail(t, lt, email, ip, accountFreeAttempts-1)
+			*now = now.Add(attemptWindow + time.Second)
+			fail(t, lt, email, ip, accountFreeAttempts-1)
+		}, true},
+		{"success clears the account", func(t *testing.T, lt *loginThrottle, now *time.Time) {
+			fail(t, lt, email, ip, accountFreeAttempts-1)
+			lt.Allow(email, ip)
+			lt.Succeeded(email, ip)
+			fail(t, lt, email, ip, accountFreeAttempts-1)
+		}, true},
+		{"every account from a locked IP", func(t *testing.T, lt *loginThrottle, now *time.Time) {
+			for i := 0; i < ipFreeAttempts; i++ {
+				fail(t, lt, string(rune('a'+i))+"@example.com", ip, 1)
+			}
+		}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			lt, now := newTestThrottle()
+			tc.run(t, lt, now)
+			err := lt.Allow(email, ip)
+			if tc.wantAllow && err != nil {
+				t.Errorf("Allow() err = %v, want nil", err)
+			}
+			if !tc.wantAllow && err != ErrTooManyAttempts {
+				t.Errorf("Allow() err = %v, want ErrTooManyAttempts", err)
+			}
+		})
+	}
+}
+
+func TestLoginThrottleSucceededKeepsIPFailures(t *testing.T) {
+	const ip = "192.0.2.1"
+	lt, _ := newTestThrottle()
+	fail(t, lt, "victim@example.com", ip, 3)
+	if err := lt.Allow("mine@example.com", ip); err != nil {
+		t.Fatal(err)
+	}
+	if err := lt.Succeeded("mine@example.com", ip); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := lt.store.Failures(ipKey(ip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("IP failures = %d, want 3", n)
+	}
+	n, _, err = lt.store.Failures(accountKey("victim@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("other account's failures = %d, want 3", n)
+	}
+}
+
+func TestLoginThrottleConcurrentAttempts(t *testing.T) {
+	const email, ip = "pat@example.com", "192.0.2.1"
+	lt, _ := newTestThrottle()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if lt.Allow(email, ip) == nil {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != accountFreeAttempts {
+		t.Errorf("%d attempts allowed at once, want %d", allowed, accountFreeAttempts)
+	}
+}
@@ -0,0 +1,100 @@
+package models
+
+import "strings"
+
+const (
+	// defaultPageSize is used when a listing doesn't ask for a
+	// page size, and maxPageSize caps what it can ask for.
+	defaultPageSize = 25
+	maxPageSize     = 100
+)
+
+// Page selects one page of a listing. Pages are numbered from 1,
+// so the zero value asks for the first page at the default size.
+type Page struct {
+	Number int
+	Size   int
+}
+
+// normalize clamps the page number and size to sensible values.
+func (p Page) normalize() Page {
+	if p.Number < 1 {
+		p.Number = 1
+	}
+	if p.Size < 1 {
+		p.Size = defaultPageSize
+	}
+	if p.Size > maxPageSize {
+		p.Size = maxPageSize
+	}
+	return p
+}
+
+func (p Page) offset() int {
+	return (p.Number - 1) * p.Size
+}
+
+// PageInfo describes where a page sits in the full listing so
+// views can render previous and next links.
+type PageInfo struct {
+	Page
+	Total int
+}
+
+// HasPrev reports whether there is a page before this one.
+func (pi PageInfo) HasPrev() bool {
+	return pi.Number > 1
+}
+
+// HasNext reports whether there is a page after this one.
+func (pi PageInfo) HasNext() bool {
+	return pi.Number*pi.Size < pi.Total
+}
+
+// Prev returns the number of the previous page.
+func (pi PageInfo) Prev() int {
+	return pi.Number - 1
+}
+
+// Next returns the number of the next page.
+func (pi PageInfo) Next() int {
+	return pi.Number + 1
+}
+
+// CursorInfo describes one page of a listing that is paginated
+// with cursors rather than page numbers. Cursors pick up where a
+// page left off, so a listing doesn't skip or repeat rows when
+// rows are added or removed in between requests.
+type CursorInfo struct {
+	Size  int
+	Total int
+	// Next and Prev are the cursors of the pages after and before
+	// this one. They are empty at either end of the listing.
+	Next string
+	Prev string
+}
+
+// HasPrev reports whether there is a page before this one.
+func (ci CursorInfo) HasPrev() bool {
+	return ci.Prev != ""
+}
+
+// HasNext reports whether there is a page after this one.
+func (ci CursorInfo) HasNext() bool {
+	return ci.Next != ""
+}
+
+// SortOrder is the direction of a sorted listing.
+type SortOrder string
+
+const (
+	Ascending  SortOrder = "asc"
+	Descending SortOrder = "desc"
+)
+
+// likePattern escapes the LIKE wildcards in a search query and
+// wraps it so it matches anywhere in a column.
+func likePattern(query string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(query) + "%"
+}
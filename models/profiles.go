@@ -0,0 +1,266 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+)
+
+// PROFILE - ERRORS
+const (
+	ErrUsernameRequired   modelError = "models: username is required"
+	ErrUsernameInvalid    modelError = "models: username must be 3 to 30 letters, numbers or underscores"
+	ErrUsernameTaken      modelError = "models: username is taken"
+	ErrDisplayNameTooLong modelError = "models: display name must be 64 characters or less"
+	ErrBioTooLong         modelError = "models: bio must be 500 characters or less"
+)
+
+const (
+	maxDisplayNameLen = 64
+	maxBioLen         = 500
+)
+
+// reservedUsernames can't be claimed because they would be
+// confused with the site itself.
+var reservedUsernames = map[string]bool{
+	"admin": true, "api": true, "muto": true, "support": true,
+}
+
+var _ ProfileDB = &profileGorm{}
+
+// Profile is the public face of an account. Each account has at
+// most one, reachable at /u/{username}.
+type Profile struct {
+	gorm.Model
+	AccountID   uint   `gorm:"not null;unique_index"`
+	Username    string `gorm:"not null;unique_index"`
+	DisplayName string `gorm:"not null"`
+	Bio         string `gorm:"type:text;not null"`
+	Avatar      string `gorm:"not null"`
+}
+
+// Name returns the display name, falling back to the username.
+func (p *Profile) Name() string {
+	if p.DisplayName != "" {
+		return p.DisplayName
+	}
+	return p.Username
+}
+
+type ProfileService interface {
+	ProfileDB
+}
+
+type ProfileDB interface {
+	ByAccountID(accountID uint) (*Profile, error)
+	ByUsername(username string) (*Profile, error)
+	// List returns one page of every profile, newest first.
+	List(page Page) ([]Profile, PageInfo, error)
+	Create(profile *Profile) error
+	Update(profile *Profile) error
+	Delete(id uint) error
+}
+
+// PROFILE - SERVICE
+func NewProfileService(db *gorm.DB) ProfileService {
+	return &profileService{
+		ProfileDB: &profileValidator{
+			ProfileDB: &profileGorm{db},
+			usernameRegex: regexp.MustCompile(
+				`^[a-z0-9_]{3,30}$`),
+		},
+	}
+}
+
+type profileService struct {
+	ProfileDB
+}
+
+// PROFILE - VALIDATION
+type profileValidator struct {
+	ProfileDB
+	usernameRegex *regexp.Regexp
+}
+
+type profileValFn func(*Profile) error
+
+func runProfileValFns(profile *Profile, fns ...profileValFn) error {
+	for _, fn := range fns {
+		if err := fn(profile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PROFILE - VALIDATION - accountIDRequired
+func (pv *profileValidator) accountIDRequired(p *Profile) error {
+	if p.AccountID <= 0 {
+		return ErrAccountIDRequired
+	}
+	return nil
+}
+
+// PROFILE - VALIDATION - normalizeUsername
+func (pv *profileValidator) normalizeUsername(p *Profile) error {
+	p.Username = strings.ToLower(strings.TrimSpace(p.Username))
+	p.Username = strings.TrimPrefix(p.Username, "@")
+	return nil
+}
+
+// PROFILE - VALIDATION - usernameRequired
+func (pv *profileValidator) usernameRequired(p *Profile) error {
+	if p.Username == "" {
+		return ErrUsernameRequired
+	}
+	return nil
+}
+
+// PROFILE - VALIDATION - usernameFormat
+func (pv *profileValidator) usernameFormat(p *Profile) error {
+	if !pv.usernameRegex.MatchString(p.Username) ||
+		reservedUsernames[p.Username] {
+		return ErrUsernameInvalid
+	}
+	return nil
+}
+
+// PROFILE - VALIDATION - usernameIsAvail
+func (pv *profileValidator) usernameIsAvail(p *Profile) error {
+	existing, err := pv.ByUsername(p.Username)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if existing.ID != p.ID {
+		return ErrUsernameTaken
+	}
+	return nil
+}
+
+// PROFILE - VALIDATION - trimText
+func (pv *profileValidator) trimText(p *Profile) error {
+	p.DisplayName = strings.TrimSpace(p.DisplayName)
+	p.Bio = strings.TrimSpace(p.Bio)
+	return nil
+}
+
+// PROFILE - VALIDATION - textLengths
+func (pv *profileValidator) textLengths(p *Profile) error {
+	if utf8.RuneCountInString(p.DisplayName) > maxDisplayNameLen {
+		return ErrDisplayNameTooLong
+	}
+	if utf8.RuneCountInString(p.Bio) > maxBioLen {
+		return ErrBioTooLong
+	}
+	return nil
+}
+
+// PROFILE - VALIDATION - ByUsername
+func (pv *profileValidator) ByUsername(username string) (*Profile, error) {
+	p := Profile{Username: username}
+	if err := runProfileValFns(&p, pv.normalizeUsername); err != nil {
+		return nil, err
+	}
+	return pv.ProfileDB.ByUsername(p.Username)
+}
+
+// PROFILE - VALIDATION - Create
+func (pv *profileValidator) Create(profile *Profile) error {
+	err := runProfileValFns(profile,
+		pv.accountIDRequired,
+		pv.normalizeUsername,
+		pv.usernameRequired,
+		pv.usernameFormat,
+		pv.usernameIsAvail,
+		pv.trimText,
+		pv.textLengths)
+	if err != nil {
+		return err
+	}
+	return pv.ProfileDB.Create(profile)
+}
+
+// PROFILE - VALIDATION - Update
+func (pv *profileValidator) Update(profile *Profile) error {
+	err := runProfileValFns(profile,
+		pv.accountIDRequired,
+		pv.normalizeUsername,
+		pv.usernameRequired,
+		pv.usernameFormat,
+		pv.usernameIsAvail,
+		pv.trimText,
+		pv.textLengths)
+	if err != nil {
+		return err
+	}
+	return pv.ProfileDB.Update(profile)
+}
+
+// PROFILE - VALIDATION - Delete
+func (pv *profileValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return pv.ProfileDB.Delete(id)
+}
+
+// PROFILE - GORM
+type profileGorm struct {
+	db *gorm.DB
+}
+
+// PROFILE - GORM - ByAccountID
+func (pg *profileGorm) ByAccountID(accountID uint) (*Profile, error) {
+	var profile Profile
+	err := first(pg.db.Where("account_id = ?", accountID), &profile)
+	if err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+// PROFILE - GORM - ByUsername
+func (pg *profileGorm) ByUsername(username string) (*Profile, error) {
+	var profile Profile
+	err := first(pg.db.Where("username = ?", username), &profile)
+	if err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+// PROFILE - GORM - List
+func (pg *profileGorm) List(page Page) ([]Profile, PageInfo, error) {
+	page = page.normalize()
+	info := PageInfo{Page: page}
+	db := pg.db.Model(&Profile{})
+	if err := db.Count(&info.Total).Error; err != nil {
+		return nil, info, err
+	}
+	var profiles []Profile
+	err := db.Order("id DESC").Offset(page.offset()).Limit(page.Size).
+		Find(&profiles).Error
+	return profiles, info, err
+}
+
+// PROFILE - GORM - Create
+func (pg *profileGorm) Create(profile *Profile) error {
+	return pg.db.Create(profile).Error
+}
+
+// PROFILE - GORM - Update
+func (pg *profileGorm) Update(profile *Profile) error {
+	return pg.db.Save(profile).Error
+}
+
+// PROFILE - GORM - Delete removes the profile for good so the
+// username can be claimed again.
+func (pg *profileGorm) Delete(id uint) error {
+	profile := Profile{Model: gorm.Model{ID: id}}
+	return pg.db.Unscoped().Delete(&profile).Error
+}
@@ -0,0 +1,166 @@
+package models
+
+import (
+	"time"
+
+	"muto/hash"
+	"muto/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// pwResetDuration is how long a password reset token
+	// can be used after it was issued.
+	pwResetDuration = 12 * time.Hour
+)
+
+// pwReset stores a hashed, single-use token that allows the
+// owning account to set a new password without knowing the
+// old one.
+type pwReset struct {
+	ID        uint      `gorm:"primary_key"`
+	AccountID uint      `gorm:"not null;index"`
+	Token     string    `gorm:"-"`
+	TokenHash string    `gorm:"not null;unique_index"`
+	ExpiresAt time.Time `gorm:"not null"`
+	CreatedAt time.Time
+}
+
+// Expired reports whether the reset token can no longer be used.
+func (pwr *pwReset) Expired() bool {
+	return time.Now().After(pwr.ExpiresAt)
+}
+
+type pwResetDB interface {
+	ByToken(token string) (*pwReset, error)
+	Create(pwr *pwReset) error
+	Delete(id uint) error
+	DeleteByAccountID(accountID uint) error
+}
+
+func newPwResetValidator(db pwResetDB, hmac hash.HMAC) *pwResetValidator {
+	return &pwResetValidator{
+		pwResetDB: db,
+		hmac:      hmac,
+	}
+}
+
+// pwResetValidator hashes tokens before they reach the database,
+// so a leaked table can not be used to reset passwords.
+type pwResetValidator struct {
+	pwResetDB
+	hmac hash.HMAC
+}
+
+type pwResetValFn func(*pwReset) error
+
+func runPwResetValFns(pwr *pwReset, fns ...pwResetValFn) error {
+	for _, fn := range fns {
+		if err := fn(pwr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VALIDATION - requireAccountID
+func (pwrv *pwResetValidator) requireAccountID(pwr *pwReset) error {
+	if pwr.AccountID <= 0 {
+		return ErrAccountIDRequired
+	}
+	return nil
+}
+
+// VALIDATION - setTokenIfUnset
+func (pwrv *pwResetValidator) setTokenIfUnset(pwr *pwReset) error {
+	if pwr.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	pwr.Token = token
+	return nil
+}
+
+// VALIDATION - hmacToken
+func (pwrv *pwResetValidator) hmacToken(pwr *pwReset) error {
+	if pwr.Token == "" {
+		return nil
+	}
+	pwr.TokenHash = pwrv.hmac.Hash(pwr.Token)
+	return nil
+}
+
+// VALIDATION - setExpiryIfUnset
+func (pwrv *pwResetValidator) setExpiryIfUnset(pwr *pwReset) error {
+	if !pwr.ExpiresAt.IsZero() {
+		return nil
+	}
+	pwr.ExpiresAt = time.Now().Add(pwResetDuration)
+	return nil
+}
+
+// VALIDATION - ByToken will hash the token before looking it up.
+func (pwrv *pwResetValidator) ByToken(token string) (*pwReset, error) {
+	pwr := pwReset{Token: token}
+	if err := runPwResetValFns(&pwr, pwrv.hmacToken); err != nil {
+		return nil, err
+	}
+	return pwrv.pwResetDB.ByToken(pwr.TokenHash)
+}
+
+// VALIDATION - Create
+func (pwrv *pwResetValidator) Create(pwr *pwReset) error {
+	err := runPwResetValFns(pwr,
+		pwrv.requireAccountID,
+		pwrv.setTokenIfUnset,
+		pwrv.hmacToken,
+		pwrv.setExpiryIfUnset)
+	if err != nil {
+		return err
+	}
+	return pwrv.pwResetDB.Create(pwr)
+}
+
+// VALIDATION - Delete
+func (pwrv *pwResetValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return pwrv.pwResetDB.Delete(id)
+}
+
+type pwResetGorm struct {
+	db *gorm.DB
+}
+
+// GORM - ByToken expects the token to already be hashed.
+func (pwrg *pwResetGorm) ByToken(tokenHash string) (*pwReset, error) {
+	var pwr pwReset
+	err := first(pwrg.db.Where("token_hash = ?", tokenHash), &pwr)
+	if err != nil {
+		return nil, err
+	}
+	return &pwr, nil
+}
+
+// GORM - Create
+func (pwrg *pwResetGorm) Create(pwr *pwReset) error {
+	return pwrg.db.Create(pwr).Error
+}
+
+// GORM - Delete
+func (pwrg *pwResetGorm) Delete(id uint) error {
+	pwr := pwReset{ID: id}
+	return pwrg.db.Delete(&pwr).Error
+}
+
+// GORM - DeleteByAccountID removes every outstanding reset token
+// for an account.
+func (pwrg *pwResetGorm) DeleteByAccountID(accountID uint) error {
+	return pwrg.db.Where("account_id = ?", accountID).
+		Delete(&pwReset{}).Error
+}
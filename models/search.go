@@ -0,0 +1,687 @@
+package models
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/jinzhu/gorm"
+)
+
+// SearchKind says what a search document describes.
+type SearchKind string
+
+const (
+	SearchGalleries SearchKind = "gallery"
+	SearchProfiles  SearchKind = "profile"
+)
+
+// HighlightStart and HighlightEnd surround the matching words in
+// the Title and Snippet of a SearchHit. Views replace them with
+// markup after escaping the text. They are control characters so
+// they can't clash with anything people type; Put strips them
+// from documents just in case.
+const (
+	HighlightStart = "\x02"
+	HighlightEnd   = "\x03"
+)
+
+const (
+	// snippetWords is roughly how many words of a document are
+	// shown with each hit.
+	snippetWords = 30
+	// reindexPageSize is how many rows Reindex loads at a time.
+	reindexPageSize = maxPageSize
+)
+
+// Test to verify both indexes implement the SearchIndex interface.
+var _ SearchIndex = &searchMemory{}
+var _ SearchIndex = &searchGorm{}
+
+// SearchDocument is what gets indexed for a gallery or a profile.
+type SearchDocument struct {
+	Kind SearchKind
+	// ID is the ID of the gallery or profile.
+	ID        uint
+	AccountID uint
+	// Public documents show up for everyone. The rest only show
+	// up for their owner.
+	Public   bool
+	Title    string
+	Body     string
+	Tags     []string
+	Category Category
+}
+
+// SearchQuery describes a search. Text is matched against the
+// title, body and tags of every document; the other fields
+// narrow the results down. Tag and Category only match galleries.
+type SearchQuery struct {
+	Text     string
+	Kind     SearchKind
+	Tag      string
+	Category Category
+	// ViewerID is the account searching, or 0 for guests. Their
+	// own galleries are found whatever their visibility.
+	ViewerID uint
+	Page     Page
+}
+
+// SearchHit is a document that matched a search. Title and
+// Snippet have the matching words highlighted.
+type SearchHit struct {
+	Kind      SearchKind
+	ID        uint
+	AccountID uint
+	Rank      float64
+	Title     string
+	Snippet   string
+}
+
+// SearchResult is a hit along with the gallery or profile it
+// found. Only one of Gallery and Profile is set.
+type SearchResult struct {
+	SearchHit
+	Gallery *Gallery
+	Profile *Profile
+}
+
+// SearchService finds galleries and profiles. WithSearch wraps the
+// gallery, image and profile services so that everything they save
+// is indexed, and Reindex fills the index from scratch.
+type SearchService interface {
+	Search(q SearchQuery) ([]SearchResult, PageInfo, error)
+	IndexGallery(gallery *Gallery) error
+	IndexProfile(profile *Profile) error
+	Remove(kind SearchKind, id uint) error
+	// Reindex indexes every gallery and profile.
+	Reindex() error
+}
+
+// SearchIndex is where a SearchService keeps its documents. We
+// provide an in-memory index for development and tests and a
+// Postgres full text index.
+type SearchIndex interface {
+	// Put adds the document, replacing any previous version.
+	Put(doc *SearchDocument) error
+	Delete(kind SearchKind, id uint) error
+	// Query returns one page of hits, best first, and how many
+	// hits there are in total.
+	Query(q SearchQuery) ([]SearchHit, int, error)
+}
+
+// NewSearchService returns a SearchService keeping its documents
+// in index. The captions of the images found through is are
+// indexed with their gallery, unless it is nil.
+func NewSearchService(index SearchIndex, gs GalleryDB, ps ProfileDB, is ImageService) SearchService {
+	return &searchService{
+		index: index,
+		gs:    gs,
+		ps:    ps,
+		is:    is,
+	}
+}
+
+type searchService struct {
+	index SearchIndex
+	gs    GalleryDB
+	ps    ProfileDB
+	is    ImageService
+}
+
+func (ss *searchService) Search(q SearchQuery) ([]SearchResult, PageInfo, error) {
+	q.Text = strings.TrimSpace(q.Text)
+	q.Tag = NormalizeTag(q.Tag)
+	q.Page = q.Page.normalize()
+	info := PageInfo{Page: q.Page}
+	hits, total, err := ss.index.Query(q)
+	if err != nil {
+		return nil, info, err
+	}
+	info.Total = total
+	results := make([]SearchResult, 0, len(hits))
+	for _, hit := range hits {
+		result := SearchResult{SearchHit: hit}
+		switch hit.Kind {
+		case SearchGalleries:
+			result.Gallery, err = ss.gs.ByID(hit.ID)
+			// The index can briefly lag behind, so check the
+			// gallery can still be seen before returning it.
+			if err == nil && result.Gallery.Visibility != VisibilityPublic &&
+				result.Gallery.AccountID != q.ViewerID {
+				continue
+			}
+		case SearchProfiles:
+			result.Profile, err = ss.ps.ByAccountID(hit.AccountID)
+		}
+		// Skip anything deleted since it was indexed.
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, info, err
+		}
+		results = append(results, result)
+	}
+	return results, info, nil
+}
+
+// IndexGallery indexes the captions of the gallery's images along
+// with its description.
+func (ss *searchService) IndexGallery(gallery *Gallery) error {
+	body := []string{gallery.Description}
+	if ss.is != nil {
+		images, err := ss.is.ByGalleryID(gallery.ID)
+		if err != nil {
+			return err
+		}
+		for _, image := range images {
+			if image.Caption != "" {
+				body = append(body, image.Caption)
+			}
+		}
+	}
+	return ss.index.Put(&SearchDocument{
+		Kind:      SearchGalleries,
+		ID:        gallery.ID,
+		AccountID: gallery.AccountID,
+		Public:    gallery.Visibility == VisibilityPublic,
+		Title:     gallery.Title,
+		Body:      strings.Join(body, "\n"),
+		Tags:      gallery.TagNames(),
+		Category:  gallery.Category,
+	})
+}
+
+func (ss *searchService) IndexProfile(profile *Profile) error {
+	return ss.index.Put(&SearchDocument{
+		Kind:      SearchProfiles,
+		ID:        profile.ID,
+		AccountID: profile.AccountID,
+		Public:    true,
+		Title:     profile.Name() + " @" + profile.Username,
+		Body:      profile.Bio,
+	})
+}
+
+func (ss *searchService) Remove(kind SearchKind, id uint) error {
+	return ss.index.Delete(kind, id)
+}
+
+func (ss *searchService) Reindex() error {
+	for page := (Page{Number: 1, Size: reindexPageSize}); ; page.Number++ {
+		galleries, info, err := ss.gs.List("", page)
+		if err != nil {
+			return err
+		}
+		for i := range galleries {
+			if err := ss.IndexGallery(&galleries[i]); err != nil {
+				return err
+			}
+		}
+		if !info.HasNext() {
+			break
+		}
+	}
+	for page := (Page{Number: 1, Size: reindexPageSize}); ; page.Number++ {
+		profiles, info, err := ss.ps.List(page)
+		if err != nil {
+			return err
+		}
+		for i := range profiles {
+			if err := ss.IndexProfile(&profiles[i]); err != nil {
+				return err
+			}
+		}
+		if !info.HasNext() {
+			break
+		}
+	}
+	return nil
+}
+
+// searchedGalleries keeps the search index up to date with every
+// gallery that is saved or deleted.
+type searchedGalleries struct {
+	GalleryService
+	search SearchService
+}
+
+func (sg *searchedGalleries) Create(gallery *Gallery) error {
+	if err := sg.GalleryService.Create(gallery); err != nil {
+		return err
+	}
+	return sg.search.IndexGallery(gallery)
+}
+
+func (sg *searchedGalleries) Update(gallery *Gallery) error {
+	if err := sg.GalleryService.Update(gallery); err != nil {
+		return err
+	}
+	return sg.search.IndexGallery(gallery)
+}
+
+func (sg *searchedGalleries) Delete(id uint) error {
+	if err := sg.GalleryService.Delete(id); err != nil {
+		return err
+	}
+	return sg.search.Remove(SearchGalleries, id)
+}
+
+// searchedAccounts removes the galleries and profile of every
+// account that is deleted from the search index, as deleting an
+// account deletes them in the database.
+type searchedAccounts struct {
+	AccountService
+	gs     GalleryDB
+	ps     ProfileDB
+	search SearchService
+}
+
+func (sa *searchedAccounts) Delete(id uint) error {
+	galleries, err := sa.gs.ByAccountID(id)
+	if err != nil {
+		return err
+	}
+	profile, err := sa.ps.ByAccountID(id)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if err := sa.AccountService.Delete(id); err != nil {
+		return err
+	}
+	for _, gallery := range galleries {
+		if err := sa.search.Remove(SearchGalleries, gallery.ID); err != nil {
+			return err
+		}
+	}
+	if profile != nil {
+		return sa.search.Remove(SearchProfiles, profile.ID)
+	}
+	return nil
+}
+
+// searchedImages reindexes the gallery of every image that is
+// saved or deleted, as its caption is part of the gallery's
+// document.
+type searchedImages struct {
+	ImageService
+	gs     GalleryDB
+	search SearchService
+}
+
+func (si *searchedImages) Create(galleryID uint, r io.Reader, filename string) (*Image, error) {
+	image, err := si.ImageService.Create(galleryID, r, filename)
+	if err != nil {
+		return nil, err
+	}
+	return image, si.reindex(galleryID)
+}
+
+func (si *searchedImages) Update(i *Image) error {
+	if err := si.ImageService.Update(i); err != nil {
+		return err
+	}
+	return si.reindex(i.GalleryID)
+}
+
+func (si *searchedImages) Delete(galleryID, id uint) error {
+	if err := si.ImageService.Delete(galleryID, id); err != nil {
+		return err
+	}
+	return si.reindex(galleryID)
+}
+
+// reindex indexes the gallery again, unless it is gone.
+func (si *searchedImages) reindex(galleryID uint) error {
+	gallery, err := si.gs.ByID(galleryID)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return si.search.IndexGallery(gallery)
+}
+
+// searchedProfiles keeps the search index up to date with every
+// profile that is saved or deleted.
+type searchedProfiles struct {
+	ProfileService
+	search SearchService
+}
+
+func (sp *searchedProfiles) Create(profile *Profile) error {
+	if err := sp.ProfileService.Create(profile); err != nil {
+		return err
+	}
+	return sp.search.IndexProfile(profile)
+}
+
+func (sp *searchedProfiles) Update(profile *Profile) error {
+	if err := sp.ProfileService.Update(profile); err != nil {
+		return err
+	}
+	return sp.search.IndexProfile(profile)
+}
+
+func (sp *searchedProfiles) Delete(id uint) error {
+	if err := sp.ProfileService.Delete(id); err != nil {
+		return err
+	}
+	return sp.search.Remove(SearchProfiles, id)
+}
+
+// stripHighlights removes the highlight markers from text.
+func stripHighlights(text string) string {
+	return strings.NewReplacer(HighlightStart, "", HighlightEnd, "").Replace(text)
+}
+
+// searchMemory keeps documents in a map and matches words by
+// prefix, so "port" finds "portrait". There's no stemming or
+// clever ranking, which is fine for development and tests.
+type searchMemory struct {
+	mu   sync.RWMutex
+	docs map[string]SearchDocument
+}
+
+// NewSearchMemory
+func NewSearchMemory() SearchIndex {
+	return &searchMemory{
+		docs: make(map[string]SearchDocument),
+	}
+}
+
+func searchKey(kind SearchKind, id uint) string {
+	return fmt.Sprintf("%s:%d", kind, id)
+}
+
+func (sm *searchMemory) Put(doc *SearchDocument) error {
+	d := *doc
+	d.Title = stripHighlights(d.Title)
+	d.Body = stripHighlights(d.Body)
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.docs[searchKey(d.Kind, d.ID)] = d
+	return nil
+}
+
+func (sm *searchMemory) Delete(kind SearchKind, id uint) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	delete(sm.docs, searchKey(kind, id))
+	return nil
+}
+
+func (sm *searchMemory) Query(q SearchQuery) ([]SearchHit, int, error) {
+	terms := searchTerms(q.Text)
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	var hits []SearchHit
+	for _, doc := range sm.docs {
+		if !searchFilter(q, doc) {
+			continue
+		}
+		rank := 0.0
+		for _, term := range terms {
+			// Title and tag matches count double, like the 'A'
+			// weight in Postgres.
+			n := 2*countMatches(doc.Title, term) +
+				2*countMatches(strings.Join(doc.Tags, " "), term) +
+				countMatches(doc.Body, term)
+			if n == 0 {
+				rank = -1
+				break
+			}
+			rank += float64(n)
+		}
+		if rank < 0 {
+			continue
+		}
+		hits = append(hits, SearchHit{
+			Kind:      doc.Kind,
+			ID:        doc.ID,
+			AccountID: doc.AccountID,
+			Rank:      rank,
+			Title:     highlight(doc.Title, terms),
+			Snippet:   snippet(doc.Body, terms),
+		})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Rank != hits[j].Rank {
+			return hits[i].Rank > hits[j].Rank
+		}
+		return hits[i].ID > hits[j].ID
+	})
+	total := len(hits)
+	page := q.Page.normalize()
+	start := page.offset()
+	if start > total {
+		start = total
+	}
+	end := start + page.Size
+	if end > total {
+		end = total
+	}
+	return hits[start:end], total, nil
+}
+
+// searchFilter reports whether doc passes the filters of q other
+// than its text.
+func searchFilter(q SearchQuery, doc SearchDocument) bool {
+	if !doc.Public && (q.ViewerID == 0 || doc.AccountID != q.ViewerID) {
+		return false
+	}
+	if q.Kind != "" && doc.Kind != q.Kind {
+		return false
+	}
+	if q.Category != "" && doc.Category != q.Category {
+		return false
+	}
+	if q.Tag != "" {
+		for _, tag := range doc.Tags {
+			if tag == q.Tag {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// searchTerms splits text into lowercase words.
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// countMatches counts the words of text that start with term.
+func countMatches(text, term string) int {
+	n := 0
+	for _, word := range searchTerms(text) {
+		if strings.HasPrefix(word, term) {
+			n++
+		}
+	}
+	return n
+}
+
+// matchesAny reports whether word starts with any of terms.
+func matchesAny(word string, terms []string) bool {
+	word = strings.ToLower(strings.TrimFunc(word, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}))
+	for _, term := range terms {
+		if word != "" && strings.HasPrefix(word, term) {
+			return true
+		}
+	}
+	return false
+}
+
+// highlight marks every word of text that matches terms.
+func highlight(text string, terms []string) string {
+	words := strings.Fields(text)
+	for i, word := range words {
+		if matchesAny(word, terms) {
+			words[i] = HighlightStart + word + HighlightEnd
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// snippet returns about snippetWords words of text starting a
+// little before the first match, with matches highlighted.
+func snippet(text string, terms []string) string {
+	words := strings.Fields(text)
+	start := 0
+	for i, word := range words {
+		if matchesAny(word, terms) {
+			start = i - 5
+			break
+		}
+	}
+	if start < 0 {
+		start = 0
+	}
+	end := start + snippetWords
+	if end > len(words) {
+		end = len(words)
+	}
+	return highlight(strings.Join(words[start:end], " "), terms)
+}
+
+// searchRow is how documents are stored in Postgres. The vector
+// column is filled in by Put with to_tsvector; titles and tags
+// weigh more than the body.
+type searchRow struct {
+	Kind      string `gorm:"primary_key"`
+	DocID     uint   `gorm:"primary_key;auto_increment:false"`
+	AccountID uint   `gorm:"not null;index"`
+	Public    bool   `gorm:"not null"`
+	Title     string `gorm:"type:text;not null"`
+	Body      string `gorm:"type:text;not null"`
+	// Tags are kept space separated, with a space at each end so
+	// a single tag can be matched with LIKE.
+	Tags     string `gorm:"type:text;not null"`
+	Category string `gorm:"not null;index"`
+	Vector   string `gorm:"type:tsvector"`
+}
+
+func (searchRow) TableName() string {
+	return "search_documents"
+}
+
+// searchGorm is a Postgres full text search index.
+type searchGorm struct {
+	db *gorm.DB
+}
+
+// NewSearchGorm
+func NewSearchGorm(db *gorm.DB) SearchIndex {
+	return &searchGorm{db}
+}
+
+// migrateSearchGorm adds the GIN index that makes the vector
+// column fast to search. gorm can't create it from struct tags.
+func migrateSearchGorm(db *gorm.DB) error {
+	return db.Exec("CREATE INDEX IF NOT EXISTS search_documents_vector " +
+		"ON search_documents USING GIN (vector)").Error
+}
+
+func (sg *searchGorm) Put(doc *SearchDocument) error {
+	title := stripHighlights(doc.Title)
+	body := stripHighlights(doc.Body)
+	tags := strings.Join(doc.Tags, " ")
+	return sg.db.Exec(`
+		INSERT INTO search_documents
+			(kind, doc_id, account_id, public, title, body, tags, category, vector)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?,
+			setweight(to_tsvector('english', ?), 'A') ||
+			setweight(to_tsvector('simple', ?), 'A') ||
+			setweight(to_tsvector('english', ?), 'B'))
+		ON CONFLICT (kind, doc_id) DO UPDATE SET
+			account_id = EXCLUDED.account_id,
+			public = EXCLUDED.public,
+			title = EXCLUDED.title,
+			body = EXCLUDED.body,
+			tags = EXCLUDED.tags,
+			category = EXCLUDED.category,
+			vector = EXCLUDED.vector`,
+		string(doc.Kind), doc.ID, doc.AccountID, doc.Public, title, body,
+		" "+tags+" ", string(doc.Category),
+		title, tags, body).Error
+}
+
+func (sg *searchGorm) Delete(kind SearchKind, id uint) error {
+	return sg.db.Where("kind = ? AND doc_id = ?", string(kind), id).
+		Delete(&searchRow{}).Error
+}
+
+func (sg *searchGorm) Query(q SearchQuery) ([]SearchHit, int, error) {
+	db := sg.db.Table("search_documents")
+	if q.ViewerID > 0 {
+		db = db.Where("public OR account_id = ?", q.ViewerID)
+	} else {
+		db = db.Where("public")
+	}
+	if q.Kind != "" {
+		db = db.Where("kind = ?", string(q.Kind))
+	}
+	if q.Category != "" {
+		db = db.Where("category = ?", string(q.Category))
+	}
+	if q.Tag != "" {
+		db = db.Where("tags LIKE ?", likePattern(" "+q.Tag+" "))
+	}
+	selects := "kind, doc_id, account_id, 0 AS rank, title, " +
+		"left(body, 200) AS snippet"
+	args := []interface{}{}
+	if q.Text != "" {
+		const tsq = "plainto_tsquery('english', ?)"
+		db = db.Where("vector @@ "+tsq, q.Text)
+		opts := fmt.Sprintf("StartSel=%s, StopSel=%s, MaxWords=%d, MinWords=%d",
+			HighlightStart, HighlightEnd, snippetWords, snippetWords/2)
+		selects = "kind, doc_id, account_id, " +
+			"ts_rank(vector, " + tsq + ") AS rank, " +
+			"ts_headline('english', title, " + tsq + ", ?) AS title, " +
+			"ts_headline('english', body, " + tsq + ", ?) AS snippet"
+		args = []interface{}{q.Text, q.Text, opts, q.Text, opts}
+	}
+	var total int
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	page := q.Page.normalize()
+	var rows []struct {
+		Kind      string
+		DocID     uint
+		AccountID uint
+		Rank      float64
+		Title     string
+		Snippet   string
+	}
+	err := db.Select(selects, args...).
+		Order("rank DESC, doc_id DESC").
+		Offset(page.offset()).Limit(page.Size).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	hits := make([]SearchHit, len(rows))
+	for i, row := range rows {
+		hits[i] = SearchHit{
+			Kind:      SearchKind(row.Kind),
+			ID:        row.DocID,
+			AccountID: row.AccountID,
+			Rank:      row.Rank,
+			Title:     row.Title,
+			Snippet:   row.Snippet,
+		}
+	}
+	return hits, total, nil
+}
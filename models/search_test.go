@@ -0,0 +1,229 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// searchIDs returns the kinds and IDs of hits, eg "gallery:1".
+func searchIDs(hits []SearchHit) string {
+	ids := make([]string, len(hits))
+	for i, hit := range hits {
+		ids[i] = searchKey(hit.Kind, hit.ID)
+	}
+	return strings.Join(ids, " ")
+}
+
+func newTestSearchMemory(t *testing.T) SearchIndex {
+	t.Helper()
+	sm := NewSearchMemory()
+	docs := []SearchDocument{
+		{Kind: SearchGalleries, ID: 1, AccountID: 1, Public: true,
+			Title: "Summer portraits", Body: "Portraits taken by the lake.",
+			Tags: []string{"summer", "people"}, Category: CategoryPhotography},
+		{Kind: SearchGalleries, ID: 2, AccountID: 1, Public: false,
+			Title: "Private portraits", Body: "Family only.",
+			Tags: []string{"family"}, Category: CategoryFamily},
+		{Kind: SearchGalleries, ID: 3, AccountID: 2, Public: false,
+			Title: "Secret sketches", Body: "Portrait studies.",
+			Tags: []string{"sketch"}, Category: CategoryArt},
+		{Kind: SearchGalleries, ID: 4, AccountID: 2, Public: true,
+			Title: "Lake trip", Body: "A weekend of hiking and a portrait or two.",
+			Tags: []string{"summer"}, Category: CategoryTravel},
+		{Kind: SearchProfiles, ID: 1, AccountID: 3, Public: true,
+			Title: "Pat @portraitpat", Body: "I paint."},
+	}
+	for i := range docs {
+		if err := sm.Put(&docs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sm
+}
+
+func TestSearchMemoryVisibility(t *testing.T) {
+	sm := newTestSearchMemory(t)
+	tests := []struct {
+		name     string
+		viewerID uint
+		want     string
+	}{
+		{"guests only see public documents", 0,
+			"gallery:1 profile:1 gallery:4"},
+		{"owners see their private galleries", 1,
+			"gallery:1 gallery:2 profile:1 gallery:4"},
+		{"others don't see private galleries", 2,
+			"gallery:1 profile:1 gallery:4 gallery:3"},
+		{"accounts without galleries see public documents", 3,
+			"gallery:1 profile:1 gallery:4"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			hits, total, err := sm.Query(SearchQuery{Text: "portrait", ViewerID: tc.viewerID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := searchIDs(hits); got != tc.want {
+				t.Errorf("hits = %q, want %q", got, tc.want)
+			}
+			if total != len(hits) {
+				t.Errorf("total = %d, want %d", total, len(hits))
+			}
+		})
+	}
+}
+
+func TestSearchMemoryFilters(t *testing.T) {
+	sm := newTestSearchMemory(t)
+	tests := []struct {
+		name string
+		q    SearchQuery
+		want string
+	}{
+		{"kind", SearchQuery{Text: "portrait", Kind: SearchProfiles},
+			"profile:1"},
+		{"tag", SearchQuery{Tag: "summer"},
+			"gallery:4 gallery:1"},
+		{"tag and text", SearchQuery{Text: "hiking", Tag: "summer"},
+			"gallery:4"},
+		{"tag of a private gallery", SearchQuery{Tag: "family"},
+			""},
+		{"tag of the viewer's private gallery", SearchQuery{Tag: "family", ViewerID: 1},
+			"gallery:2"},
+		{"unknown tag", SearchQuery{Tag: "winter"},
+			""},
+		{"category", SearchQuery{Category: CategoryTravel},
+			"gallery:4"},
+		{"category and text", SearchQuery{Text: "portrait", Category: CategoryPhotography},
+			"gallery:1"},
+		{"category without matches", SearchQuery{Text: "hiking", Category: CategoryPhotography},
+			""},
+		{"every term has to match", SearchQuery{Text: "lake portrait"},
+			"gallery:1 gallery:4"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			hits, _, err := sm.Query(tc.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := searchIDs(hits); got != tc.want {
+				t.Errorf("hits = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSearchMemoryHighlights(t *testing.T) {
+	sm := newTestSearchMemory(t)
+	hits, _, err := sm.Query(SearchQuery{Text: "lake", Kind: SearchGalleries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 2 {
+		t.Fatalf("got %d hits, want 2", len(hits))
+	}
+	// The title match counts double, so the trip comes first.
+	if want := HighlightStart + "Lake" + HighlightEnd + " trip"; hits[0].Title != want {
+		t.Errorf("Title = %q, want %q", hits[0].Title, want)
+	}
+	if want := "Portraits taken by the " + HighlightStart + "lake." + HighlightEnd; hits[1].Snippet != want {
+		t.Errorf("Snippet = %q, want %q", hits[1].Snippet, want)
+	}
+
+	// Markers typed into a document are never taken for ours.
+	sm.Put(&SearchDocument{Kind: SearchGalleries, ID: 9, Public: true,
+		Title: "Fake " + HighlightStart + "mark" + HighlightEnd, Body: "lake"})
+	hits, _, err = sm.Query(SearchQuery{Text: "lake", Kind: SearchGalleries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hit := range hits {
+		if hit.ID == 9 && hit.Title != "Fake mark" {
+			t.Errorf("Title = %q, want the markers stripped", hit.Title)
+		}
+	}
+}
+
+func TestSearchMemorySnippetStartsNearMatch(t *testing.T) {
+	sm := NewSearchMemory()
+	words := make([]string, 100)
+	for i := range words {
+		words[i] = fmt.Sprintf("w%d", i)
+	}
+	words[50] = "needle"
+	sm.Put(&SearchDocument{Kind: SearchGalleries, ID: 1, Public: true,
+		Title: "Haystack", Body: strings.Join(words, " ")})
+	hits, _, err := sm.Query(SearchQuery{Text: "needle"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 {
+		t.Fatalf("got %d hits, want 1", len(hits))
+	}
+	snippet := strings.Fields(hits[0].Snippet)
+	if len(snippet) != snippetWords {
+		t.Errorf("snippet has %d words, want %d", len(snippet), snippetWords)
+	}
+	if snippet[0] != "w45" || snippet[5] != HighlightStart+"needle"+HighlightEnd {
+		t.Errorf("Snippet = %q, want it to start five words before the match", hits[0].Snippet)
+	}
+}
+
+func TestSearchMemoryPaging(t *testing.T) {
+	sm := NewSearchMemory()
+	for id := uint(1); id <= 7; id++ {
+		sm.Put(&SearchDocument{Kind: SearchGalleries, ID: id, Public: true,
+			Title: "Gallery", Body: "cats"})
+	}
+	tests := []struct {
+		page Page
+		want string
+	}{
+		// Equal ranks are ordered newest first.
+		{Page{Number: 1, Size: 3}, "gallery:7 gallery:6 gallery:5"},
+		{Page{Number: 2, Size: 3}, "gallery:4 gallery:3 gallery:2"},
+		{Page{Number: 3, Size: 3}, "gallery:1"},
+		{Page{Number: 4, Size: 3}, ""},
+		// Out of range pages are clamped like everywhere else.
+		{Page{Number: 0, Size: 3}, "gallery:7 gallery:6 gallery:5"},
+	}
+	for _, tc := range tests {
+		hits, total, err := sm.Query(SearchQuery{Text: "cats", Page: tc.page})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := searchIDs(hits); got != tc.want {
+			t.Errorf("page %+v = %q, want %q", tc.page, got, tc.want)
+		}
+		if total != 7 {
+			t.Errorf("page %+v total = %d, want 7", tc.page, total)
+		}
+	}
+}
+
+func TestIndexGalleryIncludesCaptions(t *testing.T) {
+	db := &fakeImageDB{images: make(map[uint]*Image)}
+	db.Create(&Image{GalleryID: 1, Key: "galleries/1/a.png", Caption: "A heron fishing"})
+	db.Create(&Image{GalleryID: 1, Key: "galleries/1/b.png"})
+	db.Create(&Image{GalleryID: 2, Key: "galleries/2/c.png", Caption: "An otter"})
+	sm := NewSearchMemory()
+	ss := NewSearchService(sm, nil, nil, &imageService{ImageDB: db})
+
+	gallery := &Gallery{Title: "Birds", Description: "By the river.",
+		Visibility: VisibilityPublic}
+	gallery.ID = 1
+	if err := ss.IndexGallery(gallery); err != nil {
+		t.Fatal(err)
+	}
+	for text, want := range map[string]string{"heron": "gallery:1", "otter": "", "river": "gallery:1"} {
+		hits, _, err := sm.Query(SearchQuery{Text: text})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := searchIDs(hits); got != want {
+			t.Errorf("search for %q = %q, want %q", text, got, want)
+		}
+	}
+}
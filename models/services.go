@@ -1,15 +1,29 @@
 package models
 
 import (
+	"time"
+
+	"muto/rand"
+	"muto/storage"
+
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 )
 
 type Services struct {
-	Gallery GalleryService
-	Account AccountService
-	Image   ImageService
-	db      *gorm.DB
+	Gallery       GalleryService
+	Account       AccountService
+	Image         ImageService
+	Session       SessionService
+	TwoFactor     TwoFactorService
+	LoginThrottle LoginThrottle
+	Export        ExportService
+	Profile       ProfileService
+	APIToken      APITokenService
+	GalleryShare  GalleryShareService
+	Search        SearchService
+	searchIndex   SearchIndex
+	db            *gorm.DB
 }
 
 type ServicesConfig func(*Services) error
@@ -64,9 +78,103 @@ func WithGallery() ServicesConfig {
 	}
 }
 
-func WithImage() ServicesConfig {
+// WithImage must be provided after WithGallery, as galleries
+// are told how many images they have. store is where image files
+// are kept.
+func WithImage(store storage.BlobStore) ServicesConfig {
+	return func(s *Services) error {
+		s.Image = &countedImages{
+			ImageService: NewImageService(s.db, store),
+			gs:           s.Gallery,
+		}
+		return nil
+	}
+}
+
+func WithSession(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.Session = NewSessionService(s.db, hmacKey)
+		return nil
+	}
+}
+
+// WithTwoFactor must be provided after WithAccount, as the
+// two-factor service saves its changes through AccountService.
+func WithTwoFactor(hmacKey, totpKey string) ServicesConfig {
 	return func(s *Services) error {
-		s.Image = NewImageService()
+		s.TwoFactor = NewTwoFactorService(s.db, s.Account, hmacKey, totpKey)
+		return nil
+	}
+}
+
+// WithLoginThrottle picks where failed sign in attempts are
+// counted: "postgres" shares the counts between every app server,
+// anything else keeps them in memory.
+func WithLoginThrottle(store string) ServicesConfig {
+	return func(s *Services) error {
+		switch store {
+		case "postgres":
+			s.LoginThrottle = NewLoginThrottle(NewAttemptGorm(s.db))
+		default:
+			s.LoginThrottle = NewLoginThrottle(NewAttemptMemory())
+		}
+		return nil
+	}
+}
+
+func WithProfile() ServicesConfig {
+	return func(s *Services) error {
+		s.Profile = NewProfileService(s.db)
+		return nil
+	}
+}
+
+func WithAPIToken(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.APIToken = NewAPITokenService(s.db, hmacKey)
+		return nil
+	}
+}
+
+func WithGalleryShare(pepper, hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.GalleryShare = NewGalleryShareService(s.db, pepper, hmacKey)
+		return nil
+	}
+}
+
+// WithSearch must be provided after WithAccount, WithGallery,
+// WithImage and WithProfile, and before anything else that uses
+// them, as it wraps those services so everything they save is
+// indexed. store is where the index lives: "postgres" uses full
+// text search in the database, anything else keeps it in memory.
+func WithSearch(store string) ServicesConfig {
+	return func(s *Services) error {
+		switch store {
+		case "postgres":
+			s.searchIndex = NewSearchGorm(s.db)
+		default:
+			s.searchIndex = NewSearchMemory()
+		}
+		s.Search = NewSearchService(s.searchIndex, s.Gallery, s.Profile, s.Image)
+		if s.Image != nil {
+			s.Image = &searchedImages{s.Image, s.Gallery, s.Search}
+		}
+		if s.Account != nil {
+			s.Account = &searchedAccounts{s.Account, s.Gallery, s.Profile, s.Search}
+		}
+		s.Gallery = &searchedGalleries{s.Gallery, s.Search}
+		s.Profile = &searchedProfiles{s.Profile, s.Search}
+		return nil
+	}
+}
+
+// WithExport must be provided after WithProfile, WithGallery,
+// WithImage, WithGalleryShare, WithSession and WithAPIToken.
+func WithExport() ServicesConfig {
+	return func(s *Services) error {
+		s.Export = NewExportService(s.Profile, s.Gallery, s.Image,
+			s.GalleryShare, s.Session, s.APIToken)
 		return nil
 	}
 }
@@ -76,13 +184,116 @@ func (s *Services) Close() error {
 }
 
 func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&Account{}, &Gallery{}).Error
+	err := s.db.AutoMigrate(&Account{}, &Gallery{}, &Session{}, &pwReset{},
+		&recoveryCode{}, &loginAttempt{}, &Lockout{},
+		&Profile{}, &APIToken{}, &GalleryShare{}, &Tag{}, &Image{},
+		&schemaMigration{}).Error
+	if err != nil {
+		return err
+	}
+	if _, ok := s.searchIndex.(*searchGorm); ok {
+		if err := s.db.AutoMigrate(&searchRow{}).Error; err != nil {
+			return err
+		}
+		if err := migrateSearchGorm(s.db); err != nil {
+			return err
+		}
+	}
+	// Images used to only exist as files, so record any file the
+	// database doesn't know about yet, then bring every gallery's
+	// ImageCount in line with the images table. This only happens
+	// once, as afterwards a file without a row is one whose delete
+	// failed halfway, and must not come back.
+	if s.Image != nil {
+		err := s.once("import_images", func() error {
+			if err := s.Image.Import(); err != nil {
+				return err
+			}
+			return s.db.Exec("UPDATE galleries SET image_count = " +
+				"(SELECT COUNT(*) FROM images WHERE images.gallery_id = galleries.id)").Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// Galleries made before unlisted links used slugs have none,
+	// so give them one before slugs are made unique.
+	err = s.once("gallery_slugs", func() error {
+		var galleries []Gallery
+		err := s.db.Unscoped().Select("id").Where("slug = ?", "").
+			Find(&galleries).Error
+		if err != nil {
+			return err
+		}
+		for _, gallery := range galleries {
+			slug, err := rand.String(slugBytes)
+			if err != nil {
+				return err
+			}
+			err = s.db.Unscoped().Model(&Gallery{}).Where("id = ?", gallery.ID).
+				UpdateColumn("slug", slug).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !s.db.Dialect().HasIndex("galleries", "idx_galleries_slug") {
+		err := s.db.Model(&Gallery{}).AddUniqueIndex("idx_galleries_slug", "slug").Error
+		if err != nil {
+			return err
+		}
+	}
+	// Filenames were unique within a gallery while images were
+	// stored under them. Now only keys are.
+	if s.db.Dialect().HasIndex("images", "idx_images_gallery_filename") {
+		err := s.db.Model(&Image{}).RemoveIndex("idx_images_gallery_filename").Error
+		if err != nil {
+			return err
+		}
+	}
+	// Remember tokens used to live on the accounts table before
+	// sessions were introduced, so drop the old column if present.
+	if s.db.Dialect().HasColumn("accounts", "remember_hash") {
+		return s.db.Model(&Account{}).DropColumn("remember_hash").Error
+	}
+	return nil
 }
 
 func (s *Services) DestructiveReset() error {
-	err := s.db.DropTableIfExists(&Account{}, &Gallery{}).Error
+	err := s.db.DropTableIfExists(&Account{}, &Gallery{}, &Session{}, &pwReset{},
+		&recoveryCode{}, &loginAttempt{}, &Lockout{},
+		&Profile{}, &APIToken{}, &GalleryShare{}, &Tag{},
+		"gallery_tags", &searchRow{}, &Image{}, &schemaMigration{}).Error
 	if err != nil {
 		return err
 	}
 	return s.AutoMigrate()
 }
+
+// schemaMigration records that a one-off migration of the data,
+// rather than the tables, has run.
+type schemaMigration struct {
+	Name      string `gorm:"primary_key"`
+	CreatedAt time.Time
+}
+
+// once runs the migration fn unless one called name has run
+// before, and records it when fn succeeds.
+func (s *Services) once(name string, fn func() error) error {
+	err := first(s.db.Where("name = ?", name), &schemaMigration{})
+	switch err {
+	case nil:
+		return nil
+	case ErrNotFound:
+	default:
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	return s.db.Create(&schemaMigration{Name: name}).Error
+}
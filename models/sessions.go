@@ -0,0 +1,344 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"muto/hash"
+	"muto/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+// SESSION - ERRORS
+const (
+	ErrSessionExpired modelError = "models: session has expired"
+)
+
+const (
+	// sessionDuration is how long a session stays valid
+	// after it was created.
+	sessionDuration = 30 * 24 * time.Hour
+)
+
+// Test to verify sessionGorm implements the SessionDB interface.
+var _ SessionDB = &sessionGorm{}
+
+// Session represents a single signed in device. Every time an
+// account signs in we create a new session, so each device gets
+// its own remember token that can be revoked on its own.
+type Session struct {
+	gorm.Model
+	AccountID    uint      `gorm:"not null;index"`
+	Device       string    `gorm:"not null"`
+	UserAgent    string    `gorm:"not null"`
+	IP           string    `gorm:"not null"`
+	LastSeenAt   time.Time `gorm:"not null"`
+	ExpiresAt    time.Time `gorm:"not null"`
+	Remember     string    `gorm:"-"`
+	RememberHash string    `gorm:"not null;unique_index"`
+}
+
+// Expired reports whether the session is past its expiry.
+func (s *Session) Expired() bool {
+	return time.Now().After(s.ExpiresAt)
+}
+
+// SessionService interface is a set of methods used to manipulate
+// and work with the session model.
+type SessionService interface {
+	SessionDB
+}
+
+// SessionDB is used to interact with the sessions database.
+type SessionDB interface {
+	// Methods for querying sessions
+	ByID(id uint) (*Session, error)
+	ByRemember(token string) (*Session, error)
+	ByAccountID(accountID uint) ([]Session, error)
+
+	// Methods for altering sessions
+	Create(session *Session) error
+	Update(session *Session) error
+	Delete(id uint) error
+	DeleteByAccountID(accountID uint) error
+}
+
+// NewSessionService
+func NewSessionService(db *gorm.DB, hmacKey string) SessionService {
+	sg := &sessionGorm{db}
+	hmac := hash.NewHMAC(hmacKey)
+	return &sessionService{
+		SessionDB: &sessionValidator{
+			SessionDB: sg,
+			hmac:      hmac,
+		},
+	}
+}
+
+type sessionService struct {
+	SessionDB
+}
+
+// ByRemember will look up the session for the provided remember
+// token. Expired sessions are removed and ErrSessionExpired is
+// returned in their place.
+func (ss *sessionService) ByRemember(token string) (*Session, error) {
+	session, err := ss.SessionDB.ByRemember(token)
+	if err != nil {
+		return nil, err
+	}
+	if session.Expired() {
+		ss.SessionDB.Delete(session.ID)
+		return nil, ErrSessionExpired
+	}
+	return session, nil
+}
+
+// sessionValidator is our validation layer that validates and normalizes
+// session data before passing it to the SessionDB.
+type sessionValidator struct {
+	SessionDB
+	hmac hash.HMAC
+}
+
+type sessionValFn func(*Session) error
+
+func runSessionValFns(session *Session, fns ...sessionValFn) error {
+	for _, fn := range fns {
+		if err := fn(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VALIDATION - accountIDRequired
+func (sv *sessionValidator) accountIDRequired(session *Session) error {
+	if session.AccountID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+// VALIDATION - setRememberIfUnset
+func (sv *sessionValidator) setRememberIfUnset(session *Session) error {
+	if session.Remember != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	session.Remember = token
+	return nil
+}
+
+// VALIDATION - rememberMinBytes
+func (sv *sessionValidator) rememberMinBytes(session *Session) error {
+	if session.Remember == "" {
+		return nil
+	}
+	n, err := rand.NBytes(session.Remember)
+	if err != nil {
+		return err
+	}
+	if n < 32 {
+		return ErrRememberTooShort
+	}
+	return nil
+}
+
+// VALIDATION - hmacRemember
+func (sv *sessionValidator) hmacRemember(session *Session) error {
+	if session.Remember == "" {
+		return nil
+	}
+	session.RememberHash = sv.hmac.Hash(session.Remember)
+	return nil
+}
+
+// VALIDATION - rememberHashRequired
+func (sv *sessionValidator) rememberHashRequired(session *Session) error {
+	if session.RememberHash == "" {
+		return ErrRememberRequired
+	}
+	return nil
+}
+
+// VALIDATION - setDevice derives a short, human readable device
+// name from the user agent when one was not provided.
+func (sv *sessionValidator) setDevice(session *Session) error {
+	if session.Device != "" {
+		return nil
+	}
+	session.Device = deviceName(session.UserAgent)
+	return nil
+}
+
+// VALIDATION - setTimes fills in the last seen and expiry times
+// for new sessions.
+func (sv *sessionValidator) setTimes(session *Session) error {
+	now := time.Now()
+	if session.LastSeenAt.IsZero() {
+		session.LastSeenAt = now
+	}
+	if session.ExpiresAt.IsZero() {
+		session.ExpiresAt = now.Add(sessionDuration)
+	}
+	return nil
+}
+
+// VALIDATION - ByRemember will hash the remember token and then call
+// ByRemember on the subsequent SessionDB layer.
+func (sv *sessionValidator) ByRemember(token string) (*Session, error) {
+	session := Session{
+		Remember: token,
+	}
+	if err := runSessionValFns(&session, sv.hmacRemember); err != nil {
+		return nil, err
+	}
+	return sv.SessionDB.ByRemember(session.RememberHash)
+}
+
+// VALIDATION - Create will generate a remember token if one is not
+// already set and hash it before storing the session.
+func (sv *sessionValidator) Create(session *Session) error {
+	err := runSessionValFns(session,
+		sv.accountIDRequired,
+		sv.setRememberIfUnset,
+		sv.rememberMinBytes,
+		sv.hmacRemember,
+		sv.rememberHashRequired,
+		sv.setDevice,
+		sv.setTimes)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.Create(session)
+}
+
+// VALIDATION - Update
+func (sv *sessionValidator) Update(session *Session) error {
+	err := runSessionValFns(session,
+		sv.accountIDRequired,
+		sv.rememberMinBytes,
+		sv.hmacRemember,
+		sv.rememberHashRequired)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.Update(session)
+}
+
+// VALIDATION - Delete
+func (sv *sessionValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return sv.SessionDB.Delete(id)
+}
+
+// VALIDATION - DeleteByAccountID
+func (sv *sessionValidator) DeleteByAccountID(accountID uint) error {
+	if accountID <= 0 {
+		return ErrIDInvalid
+	}
+	return sv.SessionDB.DeleteByAccountID(accountID)
+}
+
+// sessionGorm represents our database interaction layer
+// and implements the SessionDB interface fully.
+type sessionGorm struct {
+	db *gorm.DB
+}
+
+// GORM - ByID
+func (sg *sessionGorm) ByID(id uint) (*Session, error) {
+	var session Session
+	err := first(sg.db.Where("id = ?", id), &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// GORM - ByRemember will lookup a session with the provided remember token.
+// This method expects the remember token to already be hashed.
+func (sg *sessionGorm) ByRemember(rememberHash string) (*Session, error) {
+	var session Session
+	err := first(sg.db.Where("remember_hash = ?", rememberHash), &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// GORM - ByAccountID returns the sessions of an account, most
+// recently used first.
+func (sg *sessionGorm) ByAccountID(accountID uint) ([]Session, error) {
+	var sessions []Session
+	db := sg.db.Where("account_id = ?", accountID).
+		Order("last_seen_at desc")
+	if err := db.Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// GORM - Create
+func (sg *sessionGorm) Create(session *Session) error {
+	return sg.db.Create(session).Error
+}
+
+// GORM - Update
+func (sg *sessionGorm) Update(session *Session) error {
+	return sg.db.Save(session).Error
+}
+
+// GORM - Delete
+func (sg *sessionGorm) Delete(id uint) error {
+	session := Session{Model: gorm.Model{ID: id}}
+	return sg.db.Delete(&session).Error
+}
+
+// GORM - DeleteByAccountID revokes every session of an account.
+func (sg *sessionGorm) DeleteByAccountID(accountID uint) error {
+	return sg.db.Where("account_id = ?", accountID).
+		Delete(&Session{}).Error
+}
+
+// deviceName makes a best guess at a friendly name for the device
+// behind a user agent string, eg "Firefox on Linux".
+func deviceName(ua string) string {
+	if ua == "" {
+		return "Unknown device"
+	}
+	browser := "Browser"
+	switch {
+	case strings.Contains(ua, "Edg"):
+		browser = "Edge"
+	case strings.Contains(ua, "Firefox"):
+		browser = "Firefox"
+	case strings.Contains(ua, "Chrome"):
+		browser = "Chrome"
+	case strings.Contains(ua, "Safari"):
+		browser = "Safari"
+	case strings.Contains(ua, "curl"):
+		browser = "curl"
+	}
+	platform := "unknown platform"
+	switch {
+	case strings.Contains(ua, "Android"):
+		platform = "Android"
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"):
+		platform = "iOS"
+	case strings.Contains(ua, "Windows"):
+		platform = "Windows"
+	case strings.Contains(ua, "Mac OS"):
+		platform = "macOS"
+	case strings.Contains(ua, "Linux"):
+		platform = "Linux"
+	}
+	return browser + " on " + platform
+}
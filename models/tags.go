@@ -0,0 +1,98 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// TAG - ERRORS
+const (
+	ErrTagInvalid      modelError = "models: tags can only contain letters, numbers and dashes, up to 32 characters"
+	ErrTooManyTags     modelError = "models: a gallery can have at most 10 tags"
+	ErrCategoryInvalid modelError = "models: category is not valid"
+)
+
+const (
+	maxTagLength = 32
+	maxTags      = 10
+)
+
+// tagRegex matches normalized tags: words of letters and numbers
+// joined by single dashes.
+var tagRegex = regexp.MustCompile(`^[\p{L}\p{N}]+(-[\p{L}\p{N}]+)*$`)
+
+// Tag is a free form label galleries can share. Tags are stored
+// once and linked to galleries through the gallery_tags table.
+type Tag struct {
+	ID   uint   `gorm:"primary_key"`
+	Name string `gorm:"not null;unique_index"`
+}
+
+// Path is the URL path of the page listing galleries with the
+// tag.
+func (t Tag) Path() string {
+	return "/tags/" + t.Name
+}
+
+// NormalizeTag lowercases a tag and joins its words with dashes,
+// so "Black and Grey" becomes "black-and-grey".
+func NormalizeTag(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), "-")
+}
+
+// validTag reports whether a normalized tag can be stored.
+func validTag(name string) bool {
+	return utf8.RuneCountInString(name) <= maxTagLength &&
+		tagRegex.MatchString(name)
+}
+
+// Category is the one fixed category a gallery is filed under,
+// as opposed to tags which owners make up.
+type Category string
+
+const (
+	CategoryArt         Category = "art"
+	CategoryDesign      Category = "design"
+	CategoryEvents      Category = "events"
+	CategoryFamily      Category = "family"
+	CategoryFood        Category = "food"
+	CategoryNature      Category = "nature"
+	CategoryPets        Category = "pets"
+	CategoryPhotography Category = "photography"
+	CategoryTattoo      Category = "tattoo"
+	CategoryTravel      Category = "travel"
+	CategoryOther       Category = "other"
+)
+
+// Categories lists every category in the order they are offered
+// on the edit page.
+var Categories = []Category{
+	CategoryArt,
+	CategoryDesign,
+	CategoryEvents,
+	CategoryFamily,
+	CategoryFood,
+	CategoryNature,
+	CategoryPets,
+	CategoryPhotography,
+	CategoryTattoo,
+	CategoryTravel,
+	CategoryOther,
+}
+
+// Valid reports whether c is one of Categories.
+func (c Category) Valid() bool {
+	for _, category := range Categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// Path is the URL path of the page listing galleries in the
+// category.
+func (c Category) Path() string {
+	return "/categories/" + string(c)
+}
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"muto/hash"
+)
+
+// Signed tokens let us hand out links that prove who created
+// them without storing anything in the database. A token is the
+// base64 encoded payload followed by a dot and the HMAC of that
+// payload, eg:
+//
+//	dmVyaWZ5fDEyfGFAYi5jb218MTUyMDAwMDAwMA==.3Xr...
+//
+// The last field of every payload is its unix expiry time.
+
+// signToken builds a signed token for the provided fields that
+// stops being valid at expires.
+func signToken(h hash.HMAC, expires time.Time, fields ...string) string {
+	fields = append(fields, strconv.FormatInt(expires.Unix(), 10))
+	payload := base64.URLEncoding.EncodeToString(
+		[]byte(strings.Join(fields, "|")))
+	return payload + "." + h.Hash(payload)
+}
+
+// parseSignedToken verifies the signature and expiry of a token
+// built with signToken and returns the fields it was signed with.
+// ErrTokenInvalid is returned for any token that fails a check.
+func parseSignedToken(h hash.HMAC, token string) ([]string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrTokenInvalid
+	}
+	payload, sig := parts[0], parts[1]
+	if !hmac.Equal([]byte(h.Hash(payload)), []byte(sig)) {
+		return nil, ErrTokenInvalid
+	}
+	b, err := base64.URLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	fields := strings.Split(string(b), "|")
+	expires, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	if time.Now().After(time.Unix(expires, 0)) {
+		return nil, ErrTokenInvalid
+	}
+	return fields[:len(fields)-1], nil
+}
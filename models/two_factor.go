@@ -0,0 +1,241 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"muto/encrypt"
+	"muto/hash"
+	"muto/totp"
+
+	"github.com/jinzhu/gorm"
+)
+
+// TWO FACTOR - ERRORS
+const (
+	ErrCodeInvalid        modelError = "models: two-factor code is not valid"
+	ErrTwoFactorEnabled   modelError = "models: two-factor authentication is already enabled"
+	ErrTwoFactorNotEnroll modelError = "models: two-factor enrollment has not been started"
+)
+
+const (
+	// totpIssuer is the name shown in authenticator apps.
+	totpIssuer = "MUTO"
+	// recoveryCodeCount is how many recovery codes are issued
+	// when two-factor authentication is enabled.
+	recoveryCodeCount = 10
+	// pendingLoginDuration is how long a user has to enter their
+	// code after providing the correct password.
+	pendingLoginDuration = 5 * time.Minute
+)
+
+// recoveryCode is a single-use code that can be entered instead
+// of a TOTP code when the authenticator is not available.
+type recoveryCode struct {
+	ID        uint   `gorm:"primary_key"`
+	AccountID uint   `gorm:"not null;index"`
+	CodeHash  string `gorm:"not null;unique_index"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// TwoFactorService manages TOTP based two-factor authentication.
+type TwoFactorService interface {
+	// Enroll creates a new secret for the account and returns it
+	// together with its otpauth:// URI. The secret is stored
+	// encrypted, but is not used until Confirm succeeds. Calling
+	// Enroll again before confirming returns the same secret.
+	Enroll(account *Account) (secret, uri string, err error)
+	// Confirm enables two-factor authentication once the account
+	// proves it can generate codes for the enrolled secret. The
+	// plain text recovery codes are returned and never stored.
+	Confirm(account *Account, code string) ([]string, error)
+	// Verify checks a TOTP code or an unused recovery code.
+	Verify(account *Account, code string) error
+	// Disable turns two-factor authentication off and removes
+	// the secret and recovery codes.
+	Disable(account *Account) error
+	// PendingToken returns a short lived signed token proving
+	// the account passed the password step of signing in.
+	PendingToken(account *Account) string
+	// ByPendingToken returns the account a pending token was
+	// created for.
+	ByPendingToken(token string) (*Account, error)
+}
+
+// NewTwoFactorService
+func NewTwoFactorService(db *gorm.DB, as AccountService, hmacKey, totpKey string) TwoFactorService {
+	return &twoFactorService{
+		db:   db,
+		as:   as,
+		hmac: hash.NewHMAC(hmacKey),
+		aes:  encrypt.NewAESGCM(totpKey),
+	}
+}
+
+type twoFactorService struct {
+	db   *gorm.DB
+	as   AccountService
+	hmac hash.HMAC
+	aes  encrypt.AESGCM
+}
+
+func (tfs *twoFactorService) Enroll(account *Account) (string, string, error) {
+	if account.TwoFactorEnabled() {
+		return "", "", ErrTwoFactorEnabled
+	}
+	if account.TOTPSecretEnc != "" {
+		secret, err := tfs.aes.Decrypt(account.TOTPSecretEnc)
+		if err == nil {
+			return secret, totp.URI(secret, totpIssuer, account.Email), nil
+		}
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", "", err
+	}
+	enc, err := tfs.aes.Encrypt(secret)
+	if err != nil {
+		return "", "", err
+	}
+	account.TOTPSecretEnc = enc
+	if err := tfs.as.Update(account); err != nil {
+		return "", "", err
+	}
+	return secret, totp.URI(secret, totpIssuer, account.Email), nil
+}
+
+func (tfs *twoFactorService) Confirm(account *Account, code string) ([]string, error) {
+	if account.TwoFactorEnabled() {
+		return nil, ErrTwoFactorEnabled
+	}
+	if account.TOTPSecretEnc == "" {
+		return nil, ErrTwoFactorNotEnroll
+	}
+	if err := tfs.verifyTOTP(account, code); err != nil {
+		return nil, err
+	}
+	codes, err := tfs.newRecoveryCodes(account.ID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	account.TOTPEnabledAt = &now
+	if err := tfs.as.Update(account); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (tfs *twoFactorService) Verify(account *Account, code string) error {
+	if !account.TwoFactorEnabled() {
+		return nil
+	}
+	code = normalizeCode(code)
+	if len(code) == totp.Digits {
+		return tfs.verifyTOTP(account, code)
+	}
+	return tfs.useRecoveryCode(account, code)
+}
+
+func (tfs *twoFactorService) Disable(account *Account) error {
+	err := tfs.db.Where("account_id = ?", account.ID).
+		Delete(&recoveryCode{}).Error
+	if err != nil {
+		return err
+	}
+	account.TOTPSecretEnc = ""
+	account.TOTPEnabledAt = nil
+	account.TOTPLastStep = 0
+	return tfs.as.Update(account)
+}
+
+func (tfs *twoFactorService) PendingToken(account *Account) string {
+	return signToken(tfs.hmac, time.Now().Add(pendingLoginDuration),
+		"2fa", fmt.Sprint(account.ID))
+}
+
+func (tfs *twoFactorService) ByPendingToken(token string) (*Account, error) {
+	fields, err := parseSignedToken(tfs.hmac, token)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) != 2 || fields[0] != "2fa" {
+		return nil, ErrTokenInvalid
+	}
+	id, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	return tfs.as.ByID(uint(id))
+}
+
+// verifyTOTP checks the code against the account's secret and
+// records the time step it was used for, so an intercepted code
+// can't be replayed while it is still valid.
+func (tfs *twoFactorService) verifyTOTP(account *Account, code string) error {
+	secret, err := tfs.aes.Decrypt(account.TOTPSecretEnc)
+	if err != nil {
+		return err
+	}
+	step, ok := totp.Validate(secret, normalizeCode(code), time.Now())
+	if !ok || step <= account.TOTPLastStep {
+		return ErrCodeInvalid
+	}
+	account.TOTPLastStep = step
+	return tfs.as.Update(account)
+}
+
+func (tfs *twoFactorService) useRecoveryCode(account *Account, code string) error {
+	var rc recoveryCode
+	db := tfs.db.Where("account_id = ? AND code_hash = ? AND used_at IS NULL",
+		account.ID, tfs.hmac.Hash(code))
+	err := first(db, &rc)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		return ErrCodeInvalid
+	default:
+		return err
+	}
+	now := time.Now()
+	rc.UsedAt = &now
+	return tfs.db.Save(&rc).Error
+}
+
+// newRecoveryCodes replaces any existing recovery codes for the
+// account and returns the new ones in a readable xxxxx-xxxxx form.
+func (tfs *twoFactorService) newRecoveryCodes(accountID uint) ([]string, error) {
+	err := tfs.db.Where("account_id = ?", accountID).
+		Delete(&recoveryCode{}).Error
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		secret, err := totp.GenerateSecret()
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(secret[:10])
+		rc := recoveryCode{
+			AccountID: accountID,
+			CodeHash:  tfs.hmac.Hash(code),
+		}
+		if err := tfs.db.Create(&rc).Error; err != nil {
+			return nil, err
+		}
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// normalizeCode strips the spaces and dashes people tend to type
+// and lower cases recovery codes.
+func normalizeCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.Replace(code, " ", "", -1)
+	return strings.Replace(code, "-", "", -1)
+}
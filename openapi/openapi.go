@@ -0,0 +1,446 @@
+// Package openapi builds an OpenAPI 3 document from the mux route
+// table and the Go types handlers read and write. Routes are
+// documented with a list of Operations; Build refuses to produce a
+// document when a route under the API prefix is missing from that
+// list, or an Operation no longer has a route.
+package openapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	version = "3.0.3"
+	// securityScheme is the name the bearer token scheme is
+	// registered under in the document's components.
+	securityScheme = "apiToken"
+)
+
+// Operation documents a single method on a route.
+type Operation struct {
+	Method string
+	// Path is the mux path template, with or without the
+	// variable patterns, eg "/api/v1/galleries/{id}".
+	Path    string
+	Summary string
+	// Scope is the API token scope the route requires. Routes
+	// without a scope are documented as public.
+	Scope string
+	// Query is a struct whose schema tags are the query string
+	// parameters the route accepts.
+	Query interface{}
+	// Body is the type of the JSON request body, if any.
+	Body interface{}
+	// Multipart lists the file fields of a multipart form body.
+	Multipart []string
+	// Status is the status code of a successful response and
+	// Response the type of its JSON body, if any. Responses that
+	// are a file instead set File to its media type.
+	Status   int
+	Response interface{}
+	File     string
+	// Error is the type of the JSON body of error responses.
+	Error interface{}
+}
+
+// Info describes the API as a whole.
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// Document is an OpenAPI 3 document, ready to be encoded as JSON.
+type Document struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       Info                             `json:"info"`
+	Paths      map[string]map[string]*operation `json:"paths"`
+	Components components                       `json:"components"`
+}
+
+type components struct {
+	Schemas         map[string]*Schema          `json:"schemas"`
+	SecuritySchemes map[string]*securitySchemes `json:"securitySchemes"`
+}
+
+type securitySchemes struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme"`
+}
+
+type operation struct {
+	Summary     string                `json:"summary,omitempty"`
+	Description string                `json:"description,omitempty"`
+	Parameters  []*parameter          `json:"parameters,omitempty"`
+	RequestBody *requestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*response  `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+type parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required,omitempty"`
+	Schema   *Schema `json:"schema"`
+}
+
+type requestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*mediaType `json:"content"`
+}
+
+type response struct {
+	Description string                `json:"description"`
+	Content     map[string]*mediaType `json:"content,omitempty"`
+}
+
+type mediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Schema is a JSON schema as used by OpenAPI 3.0.
+type Schema struct {
+	Ref        string             `json:"$ref,omitempty"`
+	Type       string             `json:"type,omitempty"`
+	Format     string             `json:"format,omitempty"`
+	Nullable   bool               `json:"nullable,omitempty"`
+	Items      *Schema            `json:"items,omitempty"`
+	Properties map[string]*Schema `json:"properties,omitempty"`
+	Required   []string           `json:"required,omitempty"`
+}
+
+// Build walks router and documents every route whose path starts
+// with prefix using ops. It returns an error naming every route
+// that has no Operation and every Operation that has no route.
+func Build(router *mux.Router, prefix string, info Info, ops []Operation) (*Document, error) {
+	routes := make(map[string]string)
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(tpl, prefix) {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// Subrouters and routes without methods don't
+			// serve anything themselves.
+			return nil
+		}
+		for _, m := range methods {
+			routes[opKey(m, tpl)] = tpl
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &Document{
+		OpenAPI: version,
+		Info:    info,
+		Paths:   make(map[string]map[string]*operation),
+		Components: components{
+			Schemas: make(map[string]*Schema),
+			SecuritySchemes: map[string]*securitySchemes{
+				securityScheme: {Type: "http", Scheme: "bearer"},
+			},
+		},
+	}
+	var problems []string
+	documented := make(map[string]bool)
+	for _, op := range ops {
+		key := opKey(op.Method, op.Path)
+		tpl, ok := routes[key]
+		if !ok {
+			problems = append(problems, "no route for documented "+key)
+			continue
+		}
+		documented[key] = true
+		path := cleanPath(tpl)
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = make(map[string]*operation)
+		}
+		doc.Paths[path][strings.ToLower(op.Method)] = doc.operation(op, tpl)
+	}
+	for key := range routes {
+		if !documented[key] {
+			problems = append(problems, "route missing from the spec: "+key)
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, errors.New("openapi: " + strings.Join(problems, "; "))
+	}
+	return doc, nil
+}
+
+// Handler serves the document as JSON.
+func Handler(doc *Document) http.Handler {
+	b, err := json.MarshalIndent(doc, "", "  ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err != nil {
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(b)
+	})
+}
+
+func (doc *Document) operation(op Operation, tpl string) *operation {
+	o := &operation{
+		Summary:   op.Summary,
+		Responses: make(map[string]*response),
+	}
+	for _, v := range pathVars(tpl) {
+		o.Parameters = append(o.Parameters, &parameter{
+			Name:     v.name,
+			In:       "path",
+			Required: true,
+			Schema:   &Schema{Type: v.typ},
+		})
+	}
+	if op.Query != nil {
+		o.Parameters = append(o.Parameters, queryParams(reflect.TypeOf(op.Query))...)
+	}
+	if op.Scope != "" {
+		o.Description = fmt.Sprintf("Requires an API token with the `%s` scope.", op.Scope)
+		o.Security = []map[string][]string{{securityScheme: {}}}
+	}
+	switch {
+	case op.Body != nil:
+		o.RequestBody = &requestBody{
+			Required: true,
+			Content: map[string]*mediaType{
+				"application/json": {Schema: doc.schema(reflect.TypeOf(op.Body))},
+			},
+		}
+	case len(op.Multipart) > 0:
+		form := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+		for _, field := range op.Multipart {
+			form.Properties[field] = &Schema{
+				Type:  "array",
+				Items: &Schema{Type: "string", Format: "binary"},
+			}
+			form.Required = append(form.Required, field)
+		}
+		o.RequestBody = &requestBody{
+			Required: true,
+			Content: map[string]*mediaType{
+				"multipart/form-data": {Schema: form},
+			},
+		}
+	}
+
+	ok := &response{Description: http.StatusText(op.Status)}
+	switch {
+	case op.Response != nil:
+		ok.Content = map[string]*mediaType{
+			"application/json": {Schema: doc.schema(reflect.TypeOf(op.Response))},
+		}
+	case op.File != "":
+		ok.Content = map[string]*mediaType{
+			op.File: {Schema: &Schema{Type: "string", Format: "binary"}},
+		}
+	}
+	o.Responses[fmt.Sprint(op.Status)] = ok
+	if op.Error != nil {
+		o.Responses["default"] = &response{
+			Description: "Error",
+			Content: map[string]*mediaType{
+				"application/json": {Schema: doc.schema(reflect.TypeOf(op.Error))},
+			},
+		}
+	}
+	return o
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schema returns the schema for t. Named structs are added to the
+// document's components and referenced, everything else is
+// described inline.
+func (doc *Document) schema(t reflect.Type) *Schema {
+	if t.Kind() == reflect.Ptr {
+		s := doc.schema(t.Elem())
+		if s.Ref != "" {
+			return s
+		}
+		s.Nullable = true
+		return s
+	}
+	if t == timeType {
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if t.Name() == "" {
+			return doc.object(t)
+		}
+		if _, ok := doc.Components.Schemas[t.Name()]; !ok {
+			// Register the name first so recursive types end.
+			doc.Components.Schemas[t.Name()] = &Schema{}
+			*doc.Components.Schemas[t.Name()] = *doc.object(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + t.Name()}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: doc.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object"}
+	default:
+		return scalar(t)
+	}
+}
+
+// object describes the exported fields of a struct the way
+// encoding/json would encode them.
+func (doc *Document) object(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name, omitempty := jsonName(f)
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && name == "" {
+			embedded := doc.object(f.Type)
+			for k, v := range embedded.Properties {
+				s.Properties[k] = v
+			}
+			s.Required = append(s.Required, embedded.Required...)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = doc.schema(f.Type)
+		if !omitempty && f.Type.Kind() != reflect.Ptr {
+			s.Required = append(s.Required, name)
+		}
+	}
+	sort.Strings(s.Required)
+	return s
+}
+
+func scalar(t reflect.Type) *Schema {
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	default:
+		return &Schema{Type: "string"}
+	}
+}
+
+// queryParams reads the query string parameters from the schema
+// tags of a form struct, as decoded by gorilla/schema.
+func queryParams(t reflect.Type) []*parameter {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var params []*parameter
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("schema"), ",")[0]
+		if f.PkgPath != "" || name == "" || name == "-" {
+			continue
+		}
+		params = append(params, &parameter{
+			Name:   name,
+			In:     "query",
+			Schema: scalar(f.Type),
+		})
+	}
+	return params
+}
+
+func jsonName(f reflect.StructField) (string, bool) {
+	parts := strings.Split(f.Tag.Get("json"), ",")
+	omitempty := false
+	for _, p := range parts[1:] {
+		if p == "omitempty" {
+			omitempty = true
+		}
+	}
+	return parts[0], omitempty
+}
+
+func opKey(method, path string) string {
+	return strings.ToUpper(method) + " " + cleanPath(path)
+}
+
+type pathVar struct {
+	name string
+	typ  string
+}
+
+// pathVars returns the variables of a mux path template. Variables
+// whose pattern only matches digits are documented as integers.
+func pathVars(tpl string) []pathVar {
+	var vars []pathVar
+	for _, v := range splitVars(tpl) {
+		name, pattern := v, ""
+		if i := strings.Index(v, ":"); i >= 0 {
+			name, pattern = v[:i], v[i+1:]
+		}
+		typ := "string"
+		if pattern == "[0-9]+" {
+			typ = "integer"
+		}
+		vars = append(vars, pathVar{name: name, typ: typ})
+	}
+	return vars
+}
+
+// cleanPath strips the patterns from a mux path template, eg
+// "/galleries/{id:[0-9]+}" becomes "/galleries/{id}".
+func cleanPath(tpl string) string {
+	for _, v := range splitVars(tpl) {
+		if i := strings.Index(v, ":"); i >= 0 {
+			tpl = strings.Replace(tpl, "{"+v+"}", "{"+v[:i]+"}", 1)
+		}
+	}
+	return tpl
+}
+
+// splitVars returns the contents of each top level {...} in a
+// mux path template. Patterns may contain braces of their own.
+func splitVars(tpl string) []string {
+	var vars []string
+	depth, start := 0, 0
+	for i, c := range tpl {
+		switch c {
+		case '{':
+			if depth == 0 {
+				start = i + 1
+			}
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				vars = append(vars, tpl[start:i])
+			}
+		}
+	}
+	return vars
+}
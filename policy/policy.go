@@ -0,0 +1,71 @@
+// Package policy decides who may do what. Every authorization
+// check in the app should go through Can so the rules live in
+// one place.
+package policy
+
+import "muto/models"
+
+// Action is something an account wants to do to a resource.
+type Action string
+
+const (
+	ViewGallery   Action = "gallery:view"
+	EditGallery   Action = "gallery:edit"
+	DeleteGallery Action = "gallery:delete"
+	UploadImage   Action = "image:upload"
+	DeleteImage   Action = "image:delete"
+
+	// UseAdmin is checked against a nil resource, since it is
+	// about the site as a whole.
+	UseAdmin Action = "site:admin"
+)
+
+// Can reports whether account may perform action on resource.
+// account is nil for guests. Unknown resources and actions are
+// always refused.
+func Can(account *models.Account, action Action, resource interface{}) bool {
+	switch res := resource.(type) {
+	case nil:
+		return canSite(account, action)
+	case *models.Gallery:
+		return canGallery(account, action, res)
+	default:
+		return false
+	}
+}
+
+// canSite keeps the admin console to admins.
+func canSite(account *models.Account, action Action) bool {
+	if account == nil {
+		return false
+	}
+	return action == UseAdmin && account.Role == models.RoleAdmin
+}
+
+// canGallery lets owners and admins do anything with a gallery.
+// Moderators can see every gallery and take galleries and images
+// down but can't change them. Everyone else can only look at
+// public galleries. Unlisted galleries are seen through their
+// link instead, which the controllers check.
+func canGallery(account *models.Account, action Action, gallery *models.Gallery) bool {
+	if action == ViewGallery && gallery.Visibility == models.VisibilityPublic {
+		return true
+	}
+	if account == nil {
+		return false
+	}
+	if gallery.AccountID == account.ID || account.Role == models.RoleAdmin {
+		switch action {
+		case ViewGallery, EditGallery, DeleteGallery, UploadImage, DeleteImage:
+			return true
+		}
+		return false
+	}
+	if account.Role == models.RoleModerator {
+		switch action {
+		case ViewGallery, DeleteGallery, DeleteImage:
+			return true
+		}
+	}
+	return false
+}
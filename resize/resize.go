@@ -0,0 +1,88 @@
+// Package resize scales images down using only the standard
+// library. Each pixel of the result averages the block of source
+// pixels it covers, which is plenty for photos shown smaller than
+// they were taken and needs no extra dependencies.
+package resize
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Dimensions returns the size an image of width by height pixels
+// is scaled to by Fit, keeping its aspect ratio. Neither side is
+// ever less than one pixel.
+func Dimensions(width, height, size int) (int, int) {
+	if width <= size && height <= size {
+		return width, height
+	}
+	if width >= height {
+		h := (height*size + width/2) / width
+		if h < 1 {
+			h = 1
+		}
+		return size, h
+	}
+	w := (width*size + height/2) / height
+	if w < 1 {
+		w = 1
+	}
+	return w, size
+}
+
+// Fit scales img down so both its sides are at most size pixels.
+// Images that already fit are returned as they are.
+func Fit(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := Dimensions(b.Dx(), b.Dy(), size)
+	if w == b.Dx() && h == b.Dy() {
+		return img
+	}
+	src := toRGBA(img)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	sw, sh := b.Dx(), b.Dy()
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, (y+1)*sh/h
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, (x+1)*sw/w
+			if x1 == x0 {
+				x1++
+			}
+			// RGBA is alpha premultiplied, so transparent pixels
+			// don't bleed their colour into the average.
+			var r, g, bl, a uint64
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					r += uint64(row[i])
+					g += uint64(row[i+1])
+					bl += uint64(row[i+2])
+					a += uint64(row[i+3])
+				}
+			}
+			n := uint64((x1 - x0) * (y1 - y0))
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8((r + n/2) / n)
+			dst.Pix[i+1] = uint8((g + n/2) / n)
+			dst.Pix[i+2] = uint8((bl + n/2) / n)
+			dst.Pix[i+3] = uint8((a + n/2) / n)
+		}
+	}
+	return dst
+}
+
+// toRGBA returns img as an *image.RGBA starting at 0,0, converting
+// it if needed. image/draw has fast paths for the types the
+// standard decoders return.
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Rect, img, b.Min, draw.Src)
+	return rgba
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NewLocal returns a BlobStore that keeps blobs as files under
+// dir, with each key as the file's path relative to it.
+func NewLocal(dir string) BlobStore {
+	return &localStore{dir: filepath.Clean(dir)}
+}
+
+type localStore struct {
+	dir string
+}
+
+// path returns the file blobs under key are kept in.
+func (ls *localStore) path(key string) (string, error) {
+	if !validKey(key) {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(ls.dir, filepath.FromSlash(key)), nil
+}
+
+func (ls *localStore) Put(key string, r io.Reader, contentType string) error {
+	p, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(p)
+	}
+	return err
+}
+
+func (ls *localStore) Get(key string) (*Blob, error) {
+	p, err := ls.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// Directories can be opened too, but they aren't blobs.
+	if info.IsDir() {
+		f.Close()
+		return nil, ErrNotFound
+	}
+	return &Blob{
+		ReadSeeker: f,
+		Closer:     f,
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+	}, nil
+}
+
+// Delete also removes the directories the blob leaves empty, so
+// deleting every blob of a gallery removes its directory too.
+func (ls *localStore) Delete(key string) error {
+	p, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for dir := filepath.Dir(p); len(dir) > len(ls.dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (ls *localStore) List(prefix string) ([]string, error) {
+	// Only walk the directory the prefix ends in, eg galleries/1
+	// for "galleries/1/" but the whole store for "gal".
+	start := filepath.Join(ls.dir, filepath.FromSlash(path.Dir(prefix+"_")))
+	var keys []string
+	err := filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == start {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(ls.dir, p)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// SignedURL always returns "", as files on disk can only be
+// served by the app.
+func (ls *localStore) SignedURL(key string, ttl time.Duration) (string, error) {
+	if !validKey(key) {
+		return "", ErrInvalidKey
+	}
+	return "", nil
+}
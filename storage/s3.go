@@ -0,0 +1,419 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config describes an S3 compatible bucket. Endpoint is the
+// service's base URL, eg "https://s3.eu-west-1.amazonaws.com", or
+// "http://localhost:9000" for MinIO or another stand-in running
+// locally.
+type S3Config struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PathStyle puts the bucket in the URL's path rather than its
+	// host name, as most stand-ins expect.
+	PathStyle bool
+}
+
+// NewS3 returns a BlobStore that keeps blobs as objects in an S3
+// compatible bucket, signing its requests with AWS Signature
+// Version 4.
+func NewS3(cfg S3Config) (BlobStore, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("storage: S3 endpoint %q needs a scheme and host", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("storage: S3 bucket is required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	return &s3Store{
+		cfg:      cfg,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+type s3Store struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+const (
+	s3Algorithm = "AWS4-HMAC-SHA256"
+	// s3Unsigned stands in for the hash of bodies we don't sign,
+	// ie those of presigned URLs.
+	s3Unsigned = "UNSIGNED-PAYLOAD"
+	s3DateTime = "20060102T150405Z"
+)
+
+// emptyHash is the SHA-256 of an empty body.
+var emptyHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+func (ss *s3Store) Put(key string, r io.Reader, contentType string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	// S3 needs the length up front, and signing the body needs its
+	// hash, so read it all. Images are small enough for that.
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", ss.objectURL(key, nil).String(),
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	sum := sha256.Sum256(body)
+	res, err := ss.do(req, hex.EncodeToString(sum[:]))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (ss *s3Store) Get(key string) (*Blob, error) {
+	if !validKey(key) {
+		return nil, ErrInvalidKey
+	}
+	req, err := http.NewRequest("HEAD", ss.objectURL(key, nil).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := ss.do(req, emptyHash)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	obj := &s3Object{ss: ss, key: key, size: res.ContentLength}
+	return &Blob{
+		ReadSeeker: obj,
+		Closer:     obj,
+		Size:       res.ContentLength,
+		ModTime:    modTime,
+	}, nil
+}
+
+func (ss *s3Store) Delete(key string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	req, err := http.NewRequest("DELETE", ss.objectURL(key, nil).String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := ss.do(req, emptyHash)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// s3ListResult is the part of a ListObjectsV2 response we use.
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (ss *s3Store) List(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		req, err := http.NewRequest("GET", ss.objectURL("", q).String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := ss.do(req, emptyHash)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// SignedURL returns a presigned GET URL for the object.
+func (ss *s3Store) SignedURL(key string, ttl time.Duration) (string, error) {
+	if !validKey(key) {
+		return "", ErrInvalidKey
+	}
+	return ss.presign(key, ttl, time.Now().UTC()), nil
+}
+
+// presign returns a URL for GETting the object under key, signed
+// at now.
+func (ss *s3Store) presign(key string, ttl time.Duration, now time.Time) string {
+	u := ss.objectURL(key, nil)
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", s3Algorithm)
+	q.Set("X-Amz-Credential", ss.cfg.AccessKeyID+"/"+ss.scope(now))
+	q.Set("X-Amz-Date", now.Format(s3DateTime))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(ttl/time.Second)))
+	q.Set("X-Amz-SignedHeaders", "host")
+	u.RawQuery = canonicalQuery(q)
+	canonical := strings.Join([]string{
+		"GET",
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		s3Unsigned,
+	}, "\n")
+	u.RawQuery += "&X-Amz-Signature=" + ss.signature(now, canonical)
+	return u.String()
+}
+
+// objectURL returns the URL of the object under key, or of the
+// bucket itself when key is empty.
+func (ss *s3Store) objectURL(key string, q url.Values) *url.URL {
+	u := *ss.endpoint
+	base := strings.TrimSuffix(u.Path, "/")
+	if ss.cfg.PathStyle {
+		base += "/" + ss.cfg.Bucket
+	} else {
+		u.Host = ss.cfg.Bucket + "." + u.Host
+	}
+	u.Path = base + "/" + key
+	u.RawPath = uriEncode(base, false) + "/" + uriEncode(key, false)
+	u.RawQuery = canonicalQuery(q)
+	return &u
+}
+
+// do signs and sends req, returning ErrNotFound for a 404 and an
+// error with S3's explanation for anything else that isn't a
+// success. payloadHash is the hex encoded SHA-256 of the body.
+func (ss *s3Store) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	ss.sign(req, payloadHash, time.Now().UTC())
+	res, err := ss.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	var s3Err struct {
+		Code    string
+		Message string
+	}
+	xml.NewDecoder(io.LimitReader(res.Body, 64<<10)).Decode(&s3Err)
+	return nil, fmt.Errorf("storage: S3 %s %s: %s %s %s", req.Method,
+		req.URL.Path, res.Status, s3Err.Code, s3Err.Message)
+}
+
+// sign adds the Authorization header for AWS Signature Version 4,
+// signing the host and the x-amz-* headers.
+func (ss *s3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	req.Header.Set("X-Amz-Date", now.Format(s3DateTime))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, ss.cfg.AccessKeyID, ss.scope(now), signedHeaders,
+		ss.signature(now, canonical)))
+}
+
+// scope is the credential scope of requests signed at now.
+func (ss *s3Store) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + ss.cfg.Region + "/s3/aws4_request"
+}
+
+// signature signs a canonical request made at now.
+func (ss *s3Store) signature(now time.Time, canonical string) string {
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{
+		s3Algorithm,
+		now.Format(s3DateTime),
+		ss.scope(now),
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+	key := []byte("AWS4" + ss.cfg.SecretAccessKey)
+	for _, part := range []string{now.Format("20060102"), ss.cfg.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes q sorted by name, the way Signature
+// Version 4 expects.
+func canonicalQuery(q url.Values) string {
+	names := make([]string, 0, len(q))
+	for name := range q {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		values := append([]string(nil), q[name]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(name, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent encodes everything but unreserved characters,
+// and slashes unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Object reads an object lazily, opening it with a ranged GET
+// from wherever it was last seeked to.
+type s3Object struct {
+	ss   *s3Store
+	key  string
+	size int64
+	off  int64
+	body io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.off >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		req, err := http.NewRequest("GET", o.ss.objectURL(o.key, nil).String(), nil)
+		if err != nil {
+			return 0, err
+		}
+		if o.off > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", o.off))
+		}
+		res, err := o.ss.do(req, emptyHash)
+		if err != nil {
+			return 0, err
+		}
+		o.body = res.Body
+	}
+	n, err := o.body.Read(p)
+	o.off += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	off := offset
+	switch whence {
+	case io.SeekCurrent:
+		off += o.off
+	case io.SeekEnd:
+		off += o.size
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("storage: seek to negative offset %d", off)
+	}
+	if off != o.off {
+		o.Close()
+		o.off = off
+	}
+	return off, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
@@ -0,0 +1,61 @@
+// Package storage keeps uploaded files, such as images, as blobs
+// addressed by slash separated keys like "galleries/1/abc.png".
+// We ship a store for the local disk and one for S3 compatible
+// buckets, so the rest of the app never needs to know which one
+// is in use.
+package storage
+
+import (
+	"errors"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when there is no blob under a key.
+	ErrNotFound = errors.New("storage: blob not found")
+	// ErrInvalidKey is returned for keys that are empty, absolute,
+	// try to climb out of the store with ".." or contain
+	// backslashes, which some systems take for slashes.
+	ErrInvalidKey = errors.New("storage: invalid key")
+)
+
+// BlobStore is anywhere blobs can be kept.
+type BlobStore interface {
+	// Put stores the contents of r under key, replacing any blob
+	// already there.
+	Put(key string, r io.Reader, contentType string) error
+	// Get opens the blob stored under key. It returns ErrNotFound
+	// if there is none, and the caller must close the blob when
+	// done.
+	Get(key string) (*Blob, error)
+	// Delete removes the blob under key. Removing a blob that
+	// doesn't exist is not an error.
+	Delete(key string) error
+	// List returns the keys of every blob starting with prefix,
+	// in order.
+	List(prefix string) ([]string, error)
+	// SignedURL returns a URL the blob can be downloaded from
+	// directly until ttl has passed, or "" if the store can't hand
+	// out such URLs and blobs have to be served through Get.
+	SignedURL(key string, ttl time.Duration) (string, error)
+}
+
+// Blob is an open blob. It can seek, so it can be served with
+// http.ServeContent.
+type Blob struct {
+	io.ReadSeeker
+	io.Closer
+	Size    int64
+	ModTime time.Time
+}
+
+// validKey reports whether key is relative, clean and stays
+// inside the store.
+func validKey(key string) bool {
+	return key != "" && !strings.HasPrefix(key, "/") &&
+		!strings.Contains(key, `\`) && path.Clean(key) == key &&
+		key != ".." && !strings.HasPrefix(key, "../")
+}
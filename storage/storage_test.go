@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"galleries/1/abc.png", true},
+		{"galleries/1/thumb/abc.png", true},
+		{"a", true},
+		// Only whole ".." segments climb out.
+		{"..a", true},
+		{"a/..b", true},
+		// Escapes are never decoded, so this is just an odd name.
+		{"galleries/1/%2e%2e/x", true},
+		{"", false},
+		{"/galleries/1/abc.png", false},
+		{"//galleries/1/abc.png", false},
+		{"..", false},
+		{"../x", false},
+		{"a/..", false},
+		{"galleries/1/../2/x.png", false},
+		{"galleries/1/./x.png", false},
+		{"./x", false},
+		{"galleries//1/x.png", false},
+		{"galleries/1/", false},
+		{`galleries/1/a\..\b`, false},
+		{`..\x`, false},
+	}
+	for _, tc := range tests {
+		if got := validKey(tc.key); got != tc.want {
+			t.Errorf("validKey(%q) = %t, want %t", tc.key, got, tc.want)
+		}
+	}
+}
+
+func TestLocalStaysInDir(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "store")
+	ls := NewLocal(dir)
+	outside := filepath.Join(root, "secret.txt")
+	if err := os.WriteFile(outside, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"../secret.txt", "a/../../secret.txt", outside} {
+		if _, err := ls.Get(key); err != ErrInvalidKey {
+			t.Errorf("Get(%q) err = %v, want ErrInvalidKey", key, err)
+		}
+		if err := ls.Delete(key); err != ErrInvalidKey {
+			t.Errorf("Delete(%q) err = %v, want ErrInvalidKey", key, err)
+		}
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("file outside the store is gone: %v", err)
+	}
+}
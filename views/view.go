@@ -8,8 +8,11 @@ import (
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"strings"
 
 	"muto/context"
+	"muto/markdown"
+	"muto/models"
 
 	"github.com/gorilla/csrf"
 )
@@ -35,6 +38,9 @@ func NewView(layout string, files ...string) *View {
 		"pathEscape": func(s string) string {
 			return url.PathEscape(s)
 		},
+		"markdown":  markdown.Render,
+		"join":      strings.Join,
+		"highlight": highlight,
 	}).ParseFiles(files...)
 
 	if err != nil {
@@ -94,6 +100,19 @@ func (v *View) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	v.Render(w, r, nil)
 }
 
+// highlightMarks turns the highlight markers of search results
+// into <mark> tags once the rest of the text has been escaped.
+var highlightMarks = strings.NewReplacer(
+	models.HighlightStart, "<mark>",
+	models.HighlightEnd, "</mark>")
+
+// highlight escapes a search result's title or snippet and marks
+// the words that matched.
+func highlight(text string) template.HTML {
+	return template.HTML(highlightMarks.Replace(
+		template.HTMLEscapeString(text)))
+}
+
 func layoutFiles() []string {
 	files, err := filepath.Glob(LayoutDir + "*" + TemplateExt)
 	if err != nil {